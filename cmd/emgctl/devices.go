@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+
+	"emg_esp32_classifier_backend/pkg/cerrors"
+	"emg_esp32_classifier_backend/pkg/dto"
+)
+
+var deviceCommands = map[string]command{
+	"list":      {"", "list devices", devicesList},
+	"show":      {"ID", "device details with reservation and config", devicesShow},
+	"provision": {"NAME", "register a device and print its token", devicesProvision},
+	"enable":    {"ID", "let a disabled device connect again", devicesEnable},
+	"disable":   {"ID", "refuse the device's handshakes", devicesDisable},
+	"token":     {"ID", "issue a new device token, the old one stops working", devicesToken},
+	"reset":     {"ID", "overwrite a stuck status (-status, default disconnected)", devicesReset},
+	"release":   {"ID", "end the reservation whoever holds it", devicesRelease},
+	"delete":    {"ID", "delete a device without trainings (-yes)", devicesDelete},
+}
+
+func devicesList(ctx context.Context, a *app, args []string) error {
+	fs := flags("devices list")
+	tag := fs.String("tag", "", "only devices with this tag")
+	status := fs.String("status", "", "only devices with this status")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	all, err := a.svc.GetDeviceList(ctx)
+	if err != nil {
+		return err
+	}
+
+	devices := []dto.Device{}
+	for _, d := range all {
+		if *tag != "" && !slices.Contains(d.Tags, *tag) {
+			continue
+		}
+		if *status != "" && string(d.Status) != *status {
+			continue
+		}
+		devices = append(devices, d)
+	}
+
+	rows := make([][]string, 0, len(devices))
+	for _, d := range devices {
+		rows = append(rows, []string{
+			itoa(d.ID),
+			d.Name,
+			string(d.Status),
+			formatBool(d.Disabled),
+			orDash(d.FirmwareVersion),
+			itoa(d.ChannelCount),
+			itoa(d.SampleRate),
+			orDash(strings.Join(d.Tags, ",")),
+			formatTime(d.LastSeen),
+		})
+	}
+
+	return a.table(devices, []string{"ID", "NAME", "STATUS", "DISABLED", "FIRMWARE", "CHANNELS", "RATE", "TAGS", "LAST SEEN"}, rows)
+}
+
+func devicesShow(ctx context.Context, a *app, args []string) error {
+	pos, err := parse(flags("devices show"), args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := atoi("device id", pos[0])
+	if err != nil {
+		return err
+	}
+
+	d, err := a.svc.GetDevice(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	res, err := a.svc.GetReservation(ctx, id)
+	if err != nil && !errors.Is(err, cerrors.ErrNotFound) {
+		return err
+	}
+
+	cfg, err := a.svc.GetDeviceConfig(ctx, id)
+	if err != nil && !errors.Is(err, cerrors.ErrNotFound) {
+		return err
+	}
+
+	reservedBy := "-"
+	if res != nil {
+		reservedBy = res.Owner + " until " + formatTime(res.ExpiresAt)
+	}
+
+	config := "-"
+	if cfg != nil {
+		state := "pending"
+		if cfg.AckedAt != nil {
+			state = "applied"
+		}
+		if cfg.AckError != "" {
+			state = "refused: " + cfg.AckError
+		}
+		config = "version " + itoa(cfg.Version) + ", " + state
+	}
+
+	kv := [][2]string{
+		{"id", itoa(d.ID)},
+		{"name", d.Name},
+		{"status", string(d.Status)},
+		{"disabled", formatBool(d.Disabled)},
+		{"tags", orDash(strings.Join(d.Tags, ","))},
+		{"firmware", orDash(d.FirmwareVersion)},
+		{"channels", itoa(d.ChannelCount)},
+		{"sample rate", itoa(d.SampleRate)},
+		{"last seen", formatTime(d.LastSeen)},
+		{"created", formatTime(d.CreatedAt)},
+		{"reserved by", reservedBy},
+		{"config", config},
+	}
+
+	return a.fields(map[string]any{"device": d, "reservation": res, "config": cfg}, kv)
+}
+
+func devicesProvision(ctx context.Context, a *app, args []string) error {
+	fs := flags("devices provision")
+	tags := fs.String("tags", "", "comma separated tags")
+	pos, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	var tagList []string
+	for _, t := range strings.Split(*tags, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tagList = append(tagList, t)
+		}
+	}
+
+	d, token, err := a.svc.ProvisionDevice(ctx, pos[0], tagList)
+	if err != nil {
+		return err
+	}
+
+	return a.done(map[string]any{"device": d, "token": token},
+		"device %d %s provisioned, token (shown once): %s", d.ID, d.Name, token)
+}
+
+func devicesEnable(ctx context.Context, a *app, args []string) error {
+	return setDisabled(ctx, a, "devices enable", args, false)
+}
+
+func devicesDisable(ctx context.Context, a *app, args []string) error {
+	return setDisabled(ctx, a, "devices disable", args, true)
+}
+
+func setDisabled(ctx context.Context, a *app, name string, args []string, disabled bool) error {
+	pos, err := parse(flags(name), args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := atoi("device id", pos[0])
+	if err != nil {
+		return err
+	}
+
+	d, err := a.svc.UpdateDevice(ctx, id, dto.DeviceUpdate{Disabled: &disabled})
+	if err != nil {
+		return err
+	}
+
+	state := "enabled"
+	if disabled {
+		state = "disabled"
+	}
+	return a.done(d, "device %d %s", d.ID, state)
+}
+
+func devicesToken(ctx context.Context, a *app, args []string) error {
+	pos, err := parse(flags("devices token"), args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := atoi("device id", pos[0])
+	if err != nil {
+		return err
+	}
+
+	token, err := a.svc.RotateDeviceToken(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	return a.done(map[string]any{"device_id": id, "token": token},
+		"new token of device %d (shown once): %s", id, token)
+}
+
+func devicesReset(ctx context.Context, a *app, args []string) error {
+	fs := flags("devices reset")
+	status := fs.String("status", string(dto.DeviceStatusDisconnected), "idle, reserved, streaming or disconnected")
+	pos, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := atoi("device id", pos[0])
+	if err != nil {
+		return err
+	}
+
+	if err := a.svc.ResetDeviceStatus(ctx, id, dto.DeviceStatus(*status)); err != nil {
+		return err
+	}
+
+	return a.done(map[string]any{"device_id": id, "status": *status}, "device %d is %s", id, *status)
+}
+
+func devicesRelease(ctx context.Context, a *app, args []string) error {
+	pos, err := parse(flags("devices release"), args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := atoi("device id", pos[0])
+	if err != nil {
+		return err
+	}
+
+	if err := a.svc.ForceReleaseDevice(ctx, id); err != nil {
+		return err
+	}
+
+	return a.done(map[string]any{"device_id": id, "status": "released"}, "device %d released", id)
+}
+
+func devicesDelete(ctx context.Context, a *app, args []string) error {
+	fs := flags("devices delete")
+	yes := fs.Bool("yes", false, "really delete")
+	pos, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := atoi("device id", pos[0])
+	if err != nil {
+		return err
+	}
+
+	if err := confirmed(*yes, "deleting a device"); err != nil {
+		return err
+	}
+
+	if err := a.svc.DeleteDevice(ctx, id); err != nil {
+		if errors.Is(err, cerrors.ErrDeviceHasData) {
+			return errors.New("device has recorded trainings, disable it instead")
+		}
+		return err
+	}
+
+	return a.done(map[string]any{"device_id": id, "status": "deleted"}, "device %d deleted", id)
+}
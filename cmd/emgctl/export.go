@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"os"
+)
+
+var exportCommands = map[string]command{
+	"csv": {"", "every recorded sample as CSV, like GET /training/raw/csv", exportCSV},
+}
+
+func exportCSV(ctx context.Context, a *app, args []string) error {
+	fs := flags("export csv")
+	out := fs.String("out", "", "write to this file instead of stdout")
+	normalize := fs.Bool("normalize", false, "add the features normalized by the subject's calibration")
+	activeOnly := fs.Bool("active-only", false, "only packets inside detected segments")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	data, err := a.svc.GetTrainingRawCSV(ctx, *normalize, *activeOnly)
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err = a.out.Write(data)
+		return err
+	}
+
+	if err := os.WriteFile(*out, data, 0o644); err != nil {
+		return err
+	}
+
+	return a.done(map[string]any{"file": *out, "bytes": len(data)}, "wrote %d bytes to %s", len(data), *out)
+}
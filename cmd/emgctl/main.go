@@ -0,0 +1,195 @@
+// Command emgctl runs routine operations on the backend's database without
+// psql: devices, movements, trainings and sessions, exports, the ML model and
+// maintenance. It reads the same config as the backend (CONFIG_FILE, env).
+//
+//	emgctl devices list
+//	emgctl -o json trainings list -device 3
+//	emgctl trainings delete -yes 42
+//	emgctl maintenance migrate
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"emg_esp32_classifier_backend/internal/config"
+	"emg_esp32_classifier_backend/internal/repo"
+	"emg_esp32_classifier_backend/internal/svc"
+	"emg_esp32_classifier_backend/pkg/logging"
+)
+
+type app struct {
+	cfg *config.Config
+	db  *sql.DB
+	svc *svc.Service
+
+	out  io.Writer
+	json bool
+}
+
+type command struct {
+	args string // positional arguments, for the usage
+	help string
+	run  func(ctx context.Context, a *app, args []string) error
+}
+
+var groups = map[string]map[string]command{
+	"devices":     deviceCommands,
+	"movements":   movementCommands,
+	"trainings":   trainingCommands,
+	"export":      exportCommands,
+	"model":       modelCommands,
+	"maintenance": maintenanceCommands,
+}
+
+func main() {
+	fs := flag.NewFlagSet("emgctl", flag.ExitOnError)
+	configPath := fs.String("config", os.Getenv("CONFIG_FILE"), "backend TOML config file")
+	output := fs.String("o", "table", "output: table or json")
+	timeout := fs.Duration("timeout", 5*time.Minute, "give up after")
+	verbose := fs.Bool("v", false, "log what the service does")
+	fs.Usage = func() { usage(fs) }
+	fs.Parse(os.Args[1:])
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintln(os.Stderr, "-o must be table or json")
+		os.Exit(2)
+	}
+
+	level := slog.LevelWarn
+	if *verbose {
+		level = slog.LevelInfo
+	}
+	logging.Setup(os.Stderr, "text", level)
+
+	args := fs.Args()
+	if len(args) < 2 {
+		usage(fs)
+		os.Exit(2)
+	}
+	cmd, ok := groups[args[0]][args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", strings.Join(args[:2], " "))
+		usage(fs)
+		os.Exit(2)
+	}
+
+	var cfgArgs []string
+	if *configPath != "" {
+		cfgArgs = []string{"-config", *configPath}
+	}
+	cfg, err := config.Load(cfgArgs, os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	db, err := repo.NewPostgresConnection(cfg.DB.DSN())
+	if err != nil {
+		fail(err)
+	}
+	defer db.Close()
+
+	if err := db.PingContext(ctx); err != nil {
+		fail(fmt.Errorf("database: %w", err))
+	}
+
+	a := &app{
+		cfg:  cfg,
+		db:   db,
+		svc:  svc.NewService(repo.NewPostgresRepository(db), cfg),
+		out:  os.Stdout,
+		json: *output == "json",
+	}
+
+	if err := cmd.run(ctx, a, args[2:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(2)
+		}
+		fail(err)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, "emgctl:", err)
+	os.Exit(1)
+}
+
+func usage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintln(w, "usage: emgctl [flags] <group> <command> [command flags] [args]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "flags:")
+	fs.PrintDefaults()
+
+	names := make([]string, 0, len(groups))
+	for g := range groups {
+		names = append(names, g)
+	}
+	sort.Strings(names)
+
+	for _, g := range names {
+		fmt.Fprintf(w, "\n%s:\n", g)
+
+		cmds := make([]string, 0, len(groups[g]))
+		for c := range groups[g] {
+			cmds = append(cmds, c)
+		}
+		sort.Strings(cmds)
+
+		for _, c := range cmds {
+			cmd := groups[g][c]
+			fmt.Fprintf(w, "  %-28s %s\n", strings.TrimSpace(c+" "+cmd.args), cmd.help)
+		}
+	}
+	fmt.Fprintln(w, "\nrun a command with -h for its flags")
+}
+
+// flags returns the flag set of a command, parse errors are returned and not
+// fatal.
+func flags(name string) *flag.FlagSet {
+	return flag.NewFlagSet("emgctl "+name, flag.ContinueOnError)
+}
+
+// parse parses the command flags and checks the positional arguments.
+func parse(fs *flag.FlagSet, args []string, want int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != want {
+		return nil, fmt.Errorf("%s: expected %d argument(s), got %d", fs.Name(), want, fs.NArg())
+	}
+	return fs.Args(), nil
+}
+
+func atoi(name, s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q", name, s)
+	}
+	return n, nil
+}
+
+// confirmed guards destructive commands, they need -yes.
+func confirmed(yes bool, what string) error {
+	if !yes {
+		return fmt.Errorf("%s cannot be undone, repeat with -yes", what)
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"emg_esp32_classifier_backend/internal/repo"
+)
+
+var maintenanceCommands = map[string]command{
+	"migrations": {"", "list migrations not applied yet", maintenanceMigrations},
+	"migrate":    {"", "apply pending migrations", maintenanceMigrate},
+	"reconcile":  {"", "mark every device disconnected, only with the backend stopped (-yes)", maintenanceReconcile},
+	"expire":     {"", "drop idle sessions and run out reservations", maintenanceExpire},
+}
+
+func maintenanceMigrations(ctx context.Context, a *app, args []string) error {
+	if _, err := parse(flags("maintenance migrations"), args, 0); err != nil {
+		return err
+	}
+
+	pending, err := repo.PendingMigrations(ctx, a.db)
+	if err != nil {
+		return err
+	}
+	if pending == nil {
+		pending = []string{}
+	}
+
+	rows := make([][]string, 0, len(pending))
+	for _, name := range pending {
+		rows = append(rows, []string{name})
+	}
+
+	return a.table(pending, []string{"PENDING"}, rows)
+}
+
+func maintenanceMigrate(ctx context.Context, a *app, args []string) error {
+	if _, err := parse(flags("maintenance migrate"), args, 0); err != nil {
+		return err
+	}
+
+	pending, err := repo.PendingMigrations(ctx, a.db)
+	if err != nil {
+		return err
+	}
+	if pending == nil {
+		pending = []string{}
+	}
+
+	if err := repo.Migrate(ctx, a.db); err != nil {
+		return err
+	}
+
+	return a.done(map[string]any{"applied": pending}, "applied %d migration(s)", len(pending))
+}
+
+func maintenanceReconcile(ctx context.Context, a *app, args []string) error {
+	fs := flags("maintenance reconcile")
+	yes := fs.Bool("yes", false, "the backend is stopped")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	if err := confirmed(*yes, "resetting the status of connected devices"); err != nil {
+		return err
+	}
+
+	if err := a.svc.ReconcileDevices(ctx, nil); err != nil {
+		return err
+	}
+
+	return a.done(map[string]any{"status": "reconciled"}, "every device is disconnected")
+}
+
+func maintenanceExpire(ctx context.Context, a *app, args []string) error {
+	fs := flags("maintenance expire")
+	ttl := fs.Duration("session-ttl", time.Duration(a.cfg.Training.SessionTTL), "drop sessions idle for longer")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	expired, err := a.svc.ExpireStoredSessions(ctx, *ttl)
+	if err != nil {
+		return err
+	}
+
+	if err := a.svc.ExpireReservations(ctx); err != nil {
+		return err
+	}
+
+	return a.done(map[string]any{"expired_sessions": len(expired)},
+		"%d session(s) expired, reservations past their end released", len(expired))
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"emg_esp32_classifier_backend/pkg/dto"
+)
+
+var modelCommands = map[string]command{
+	"status":   {"", "whether the ML service answers", modelStatus},
+	"evaluate": {"ID...", "classify stored trainings and count the predicted classes", modelEvaluate},
+}
+
+func modelStatus(ctx context.Context, a *app, args []string) error {
+	if _, err := parse(flags("model status"), args, 0); err != nil {
+		return err
+	}
+
+	status := "ok"
+	if err := a.svc.ModelHealth(ctx); err != nil {
+		status = err.Error()
+	}
+
+	return a.fields(map[string]any{"url": a.svc.ModelURL(), "status": status}, [][2]string{
+		{"url", a.svc.ModelURL()},
+		{"status", status},
+	})
+}
+
+func modelEvaluate(ctx context.Context, a *app, args []string) error {
+	fs := flags("model evaluate")
+	activeOnly := fs.Bool("active-only", true, "only packets inside detected segments")
+	normalize := fs.Bool("normalize", false, "apply the subject's calibration like live inference")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("%s: expected at least one training id", fs.Name())
+	}
+
+	ids := make([]int, 0, fs.NArg())
+	for _, s := range fs.Args() {
+		id, err := atoi("training id", s)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+
+	movements, err := a.svc.GetMovements(ctx)
+	if err != nil {
+		return err
+	}
+	names := make(map[int]string, len(movements))
+	for _, m := range movements {
+		names[m.Movement_id] = m.Name
+	}
+
+	evs := make([]*dto.ModelEvaluation, 0, len(ids))
+	rows := make([][]string, 0, len(ids))
+	for _, id := range ids {
+		ev, err := a.svc.EvaluateModel(ctx, id, *activeOnly, *normalize)
+		if err != nil {
+			return fmt.Errorf("training %d: %w", id, err)
+		}
+		evs = append(evs, ev)
+
+		top, share := topClass(ev)
+		rows = append(rows, []string{
+			itoa(ev.TrainingID),
+			orDash(names[ev.MovementID]),
+			orDash(top),
+			fmt.Sprintf("%.0f%%", share*100),
+			itoa(ev.Packets),
+			itoa(ev.Failed),
+		})
+	}
+
+	return a.table(evs, []string{"TRAINING", "MOVEMENT", "PREDICTED", "SHARE", "PACKETS", "FAILED"}, rows)
+}
+
+// topClass is the most predicted class and its share of the packets, ties go
+// to the alphabetically first.
+func topClass(ev *dto.ModelEvaluation) (string, float64) {
+	if ev.Packets == 0 {
+		return "", 0
+	}
+
+	classes := make([]string, 0, len(ev.Classes))
+	for c := range ev.Classes {
+		classes = append(classes, c)
+	}
+	sort.Strings(classes)
+
+	top := ""
+	for _, c := range classes {
+		if top == "" || ev.Classes[c] > ev.Classes[top] {
+			top = c
+		}
+	}
+
+	return top, float64(ev.Classes[top]) / float64(ev.Packets)
+}
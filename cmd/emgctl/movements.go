@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+
+	"emg_esp32_classifier_backend/pkg/dto"
+)
+
+var movementCommands = map[string]command{
+	"list": {"", "list movements", movementsList},
+	"add":  {"NAME", "add a movement (-description)", movementsAdd},
+}
+
+func movementsList(ctx context.Context, a *app, args []string) error {
+	if _, err := parse(flags("movements list"), args, 0); err != nil {
+		return err
+	}
+
+	ms, err := a.svc.GetMovements(ctx)
+	if err != nil {
+		return err
+	}
+	if ms == nil {
+		ms = []dto.Movements{}
+	}
+
+	rows := make([][]string, 0, len(ms))
+	for _, m := range ms {
+		rows = append(rows, []string{itoa(m.Movement_id), m.Name, orDash(m.Description)})
+	}
+
+	return a.table(ms, []string{"ID", "NAME", "DESCRIPTION"}, rows)
+}
+
+func movementsAdd(ctx context.Context, a *app, args []string) error {
+	fs := flags("movements add")
+	description := fs.String("description", "", "what the subject does")
+	pos, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	m, err := a.svc.CreateMovement(ctx, pos[0], *description)
+	if err != nil {
+		return err
+	}
+
+	return a.done(m, "movement %d %s added", m.Movement_id, m.Name)
+}
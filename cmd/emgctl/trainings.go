@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/sessions"
+)
+
+var trainingCommands = map[string]command{
+	"list":         {"", "list trainings, newest first", trainingsList},
+	"show":         {"ID", "training with quality and segments per repetition", trainingsShow},
+	"delete":       {"ID", "delete a training and its samples (-yes)", trainingsDelete},
+	"sessions":     {"", "list open sessions", trainingsSessions},
+	"drop-session": {"DEVICE_ID", "delete a stuck session of a device", trainingsDropSession},
+}
+
+func trainingsList(ctx context.Context, a *app, args []string) error {
+	fs := flags("trainings list")
+	var f dto.TrainingFilter
+	fs.IntVar(&f.DeviceID, "device", 0, "only trainings of this device")
+	fs.IntVar(&f.MovementID, "movement", 0, "only trainings of this movement")
+	fs.StringVar(&f.Subject, "subject", "", "only trainings of this subject")
+	fs.IntVar(&f.Limit, "limit", 50, "at most this many, 0 for all")
+	if _, err := parse(fs, args, 0); err != nil {
+		return err
+	}
+
+	ts, err := a.svc.ListTrainings(ctx, f)
+	if err != nil {
+		return err
+	}
+	if ts == nil {
+		ts = []dto.Training{}
+	}
+
+	rows := make([][]string, 0, len(ts))
+	for _, t := range ts {
+		rows = append(rows, []string{
+			itoa(t.ID),
+			itoa(t.DeviceID),
+			itoa(t.MovementID),
+			orDash(t.Subject),
+			itoa(t.Repetition),
+			formatBool(t.Finished),
+			itoa(t.Packets),
+			itoa(t.Flagged),
+			formatTime(t.CreatedAt),
+		})
+	}
+
+	return a.table(ts, []string{"ID", "DEVICE", "MOVEMENT", "SUBJECT", "REP", "FINISHED", "PACKETS", "FLAGGED", "CREATED"}, rows)
+}
+
+func trainingsShow(ctx context.Context, a *app, args []string) error {
+	pos, err := parse(flags("trainings show"), args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := atoi("training id", pos[0])
+	if err != nil {
+		return err
+	}
+
+	t, err := a.svc.GetTraining(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	quality, err := a.svc.GetTrainingQuality(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	segments, err := a.svc.GetTrainingSegments(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if a.json {
+		return a.printJSON(map[string]any{"training": t, "quality": quality, "segments": segments})
+	}
+
+	err = a.fields(nil, [][2]string{
+		{"id", itoa(t.ID)},
+		{"device", itoa(t.DeviceID)},
+		{"movement", itoa(t.MovementID)},
+		{"subject", orDash(t.Subject)},
+		{"repetition", itoa(t.Repetition)},
+		{"finished", formatBool(t.Finished)},
+		{"packets", itoa(t.Packets)},
+		{"created", formatTime(t.CreatedAt)},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(a.out)
+
+	segs := map[int]int{}
+	for _, s := range segments {
+		segs[s.Repetition]++
+	}
+
+	rows := make([][]string, 0, len(quality))
+	for _, q := range quality {
+		rows = append(rows, []string{
+			itoa(q.Repetition),
+			fmt.Sprintf("%.2f", q.Score),
+			formatBool(q.Flagged),
+			fmt.Sprintf("%.1f%%", q.ClippingRatio*100),
+			fmt.Sprintf("%.1f", q.SNRdB),
+			itoa(segs[q.Repetition]),
+		})
+	}
+
+	return a.table(nil, []string{"REP", "SCORE", "FLAGGED", "CLIPPED", "SNR DB", "SEGMENTS"}, rows)
+}
+
+func trainingsDelete(ctx context.Context, a *app, args []string) error {
+	fs := flags("trainings delete")
+	yes := fs.Bool("yes", false, "really delete")
+	pos, err := parse(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := atoi("training id", pos[0])
+	if err != nil {
+		return err
+	}
+
+	if err := confirmed(*yes, "deleting a training"); err != nil {
+		return err
+	}
+
+	if err := a.svc.DeleteTraining(ctx, id); err != nil {
+		return err
+	}
+
+	return a.done(map[string]any{"training_id": id, "status": "deleted"}, "training %d deleted", id)
+}
+
+func trainingsSessions(ctx context.Context, a *app, args []string) error {
+	if _, err := parse(flags("trainings sessions"), args, 0); err != nil {
+		return err
+	}
+
+	open, err := a.svc.ListSessions(ctx)
+	if err != nil {
+		return err
+	}
+	if open == nil {
+		open = []*sessions.Session{}
+	}
+
+	rows := make([][]string, 0, len(open))
+	for _, ss := range open {
+		state := "waiting"
+		if ss.Recording {
+			state = "recording"
+		}
+		if !ss.InterruptedAt.IsZero() {
+			state = "interrupted"
+		}
+
+		rows = append(rows, []string{
+			itoa(ss.DeviceID),
+			itoa(ss.TrainingID),
+			itoa(ss.MovementID),
+			orDash(ss.Subject),
+			itoa(ss.Rep),
+			state,
+			time.Since(ss.UpdatedAt).Round(time.Second).String(),
+		})
+	}
+
+	return a.table(open, []string{"DEVICE", "TRAINING", "MOVEMENT", "SUBJECT", "REP", "STATE", "IDLE"}, rows)
+}
+
+func trainingsDropSession(ctx context.Context, a *app, args []string) error {
+	pos, err := parse(flags("trainings drop-session"), args, 1)
+	if err != nil {
+		return err
+	}
+	id, err := atoi("device id", pos[0])
+	if err != nil {
+		return err
+	}
+
+	if err := a.svc.DropSession(ctx, id); err != nil {
+		return err
+	}
+
+	return a.done(map[string]any{"device_id": id, "status": "dropped"},
+		"session of device %d dropped, a running backend forgets it on restart", id)
+}
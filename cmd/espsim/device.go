@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"strconv"
+	"sync"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/models"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	handshakeTimeout = 10 * time.Second
+	writeWait        = 10 * time.Second
+	maxBackoff       = 30 * time.Second
+)
+
+// deviceConfig is the part of set_config the simulator acts on.
+type deviceConfig struct {
+	sampleRate int
+	packetSize int
+	gain       int
+	channels   []int // active, zero based
+}
+
+// backendMessage is everything the backend sends to an ESP.
+type backendMessage struct {
+	models.WsBackendToEsp
+	DeviceID int    `json:"device_id"` // handshake_ok
+	Error    string `json:"error"`
+}
+
+// streamEvents are the events of one kind of stream, begin and finish are
+// empty when the kind has none.
+type streamEvents struct {
+	begin, data, finish models.Event
+}
+
+var (
+	recordingEvents   = streamEvents{models.EventRawStreamBegin, models.EventRawStreamInProc, models.EventRawStreamFinish}
+	liveEvents        = streamEvents{data: models.EventLiveStreamData}
+	calibrationEvents = streamEvents{data: models.EventCalibrationData, finish: models.EventCalibrationFinish}
+)
+
+type device struct {
+	o     options
+	name  string
+	token string
+	src   source
+	log   *slog.Logger
+
+	rng    *rand.Rand // only used by the goroutine running the device
+	offset time.Duration
+	drift  float64 // ppm
+	born   time.Time
+
+	cfg deviceConfig // changed by set_config between streams
+
+	mu   sync.Mutex // serialises writes, gorilla allows one writer
+	conn *websocket.Conn
+
+	cancel context.CancelFunc // of the running stream
+	done   chan struct{}
+}
+
+func newDevice(o options, i int, src source) *device {
+	name := fmt.Sprintf("%s-%03d", o.name, i)
+
+	// the same name gets the same token, restarts of the simulator are known
+	// devices to the backend
+	token := o.token
+	if token == "" {
+		token = "espsim-" + name
+	}
+
+	rng := rand.New(rand.NewPCG(o.seed, uint64(i)))
+
+	channels := make([]int, o.channels)
+	for ch := range channels {
+		channels[ch] = ch
+	}
+
+	return &device{
+		o:      o,
+		name:   name,
+		token:  token,
+		src:    src,
+		log:    slog.With("device_name", name),
+		rng:    rng,
+		offset: time.Duration((rng.Float64()*2 - 1) * float64(o.clockSkew)),
+		drift:  (rng.Float64()*2 - 1) * 50,
+		born:   time.Now(),
+		cfg: deviceConfig{
+			sampleRate: o.sampleRate,
+			packetSize: o.packetSize,
+			gain:       o.gain,
+			channels:   channels,
+		},
+	}
+}
+
+// run keeps the device connected until ctx is cancelled, like firmware it
+// reconnects with backoff whenever the socket goes away (a restarting backend
+// closes with 1012).
+func (d *device) run(ctx context.Context) {
+	backoff := time.Second
+
+	for {
+		registered, err := d.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if registered {
+			backoff = time.Second
+		}
+
+		wait := backoff/2 + time.Duration(d.rng.Int64N(int64(backoff)))
+		d.log.Warn("disconnected", "err", err, "retry_in", wait)
+		reconnects.Add(1)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+
+		backoff = min(2*backoff, maxBackoff)
+	}
+}
+
+// session is one connection, it reports whether the handshake went through.
+func (d *device) session(ctx context.Context) (bool, error) {
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, d.o.url, nil)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	d.mu.Lock()
+	d.conn = conn
+	d.mu.Unlock()
+
+	// unblocks ReadMessage when the simulator stops
+	stopClose := context.AfterFunc(ctx, func() {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(time.Second))
+		conn.Close()
+	})
+	defer stopClose()
+
+	err = d.send(models.WsEspToBackend{
+		Event:           models.HandShake,
+		Token:           d.token,
+		EnrollToken:     d.o.enrollToken,
+		FirmwareVersion: d.o.firmware,
+		ChannelCount:    d.o.channels,
+		SampleRate:      d.o.sampleRate,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(handshakeTimeout))
+
+	var msg backendMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		return false, fmt.Errorf("handshake: %w", err)
+	}
+	if msg.Event != "handshake_ok" {
+		return false, fmt.Errorf("handshake: %s %s", msg.Event, msg.Error)
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	connected.Add(1)
+	defer connected.Add(-1)
+
+	log := d.log.With("device_id", msg.DeviceID)
+	log.Info("connected")
+
+	defer d.stopStream()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return true, err
+		}
+		received := time.Now()
+
+		var msg backendMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Warn("invalid message", "err", err)
+			continue
+		}
+
+		if err := d.handle(ctx, log, msg, received); err != nil {
+			return true, err
+		}
+	}
+}
+
+func (d *device) handle(ctx context.Context, log *slog.Logger, msg backendMessage, received time.Time) error {
+	log.Debug("command", "event", msg.Event)
+
+	switch msg.Event {
+	case models.EventESPTimeSync:
+		return d.send(models.WsEspToBackend{
+			Event: models.EventTimeSyncReply,
+			T1:    msg.T1,
+			T2:    d.clock(received),
+			T3:    d.clock(time.Now()),
+		})
+
+	case models.EventESPSetConfig:
+		ack := models.WsEspToBackend{Event: models.EventConfigAck, ConfigVersion: msg.ConfigVersion}
+		if err := d.applyConfig(msg.Config); err != nil {
+			ack.Error = err.Error()
+		}
+		log.Info("config", "version", msg.ConfigVersion, "err", ack.Error)
+		return d.send(ack)
+
+	case models.EventESPStartRawStream:
+		d.startStream(ctx, log, streamSpec{
+			kind:       kindRecording,
+			movementID: msg.MovementID,
+			duration:   time.Duration(msg.Duration) * time.Second,
+		}, recordingEvents)
+
+	case models.EventESPStartLiveStream:
+		d.startStream(ctx, log, streamSpec{kind: kindLive}, liveEvents)
+
+	case models.EventESPStartCalibration:
+		d.startStream(ctx, log, streamSpec{
+			kind:     kindCalibration,
+			phase:    msg.Phase,
+			duration: time.Duration(msg.Duration) * time.Second,
+		}, calibrationEvents)
+
+	case models.EventESPStopRawStream, models.EventESPStopLiveStream, models.EventESPStopCalibration:
+		d.stopStream()
+
+	case "error":
+		log.Warn("backend error", "err", msg.Error)
+	}
+
+	return nil
+}
+
+// applyConfig refuses what the firmware would refuse, the backend then keeps
+// the config unacknowledged.
+func (d *device) applyConfig(c *models.DeviceConfig) error {
+	if c == nil {
+		return errors.New("no config")
+	}
+	if c.SampleRate < 1 || c.PacketSize < 1 || c.Gain < 1 {
+		return errors.New("sample_rate, packet_size and gain must be positive")
+	}
+	if len(c.ActiveChannels) == 0 {
+		return errors.New("no active channel")
+	}
+	for _, ch := range c.ActiveChannels {
+		if ch < 0 || ch >= d.o.channels {
+			return fmt.Errorf("channel %d out of range", ch)
+		}
+	}
+
+	d.cfg = deviceConfig{
+		sampleRate: c.SampleRate,
+		packetSize: c.PacketSize,
+		gain:       c.Gain,
+		channels:   append([]int(nil), c.ActiveChannels...),
+	}
+	return nil
+}
+
+// startStream replaces the running stream, if any.
+func (d *device) startStream(ctx context.Context, log *slog.Logger, sp streamSpec, ev streamEvents) {
+	d.stopStream()
+
+	sp.cfg = d.cfg
+	st := d.src.open(sp, rand.New(rand.NewPCG(d.rng.Uint64(), d.rng.Uint64())))
+	rng := rand.New(rand.NewPCG(d.rng.Uint64(), d.rng.Uint64()))
+
+	ctx, d.cancel = context.WithCancel(ctx)
+	d.done = make(chan struct{})
+
+	log.Info("stream started", "event", ev.data, "movement_id", sp.movementID, "phase", sp.phase, "duration", sp.duration)
+
+	go func(done chan struct{}) {
+		defer close(done)
+		if err := d.stream(ctx, st, sp.duration, ev, rng); err != nil {
+			log.Warn("stream failed", "err", err)
+		}
+	}(d.done)
+}
+
+// stopStream cancels the running stream and waits for it.
+func (d *device) stopStream() {
+	if d.cancel == nil {
+		return
+	}
+	d.cancel()
+	<-d.done
+	d.cancel = nil
+}
+
+// stream sends packets in real time, each once its last sample would have
+// been taken. Packets falling into a dropout are lost, as over bad WiFi.
+func (d *device) stream(ctx context.Context, st stream, duration time.Duration, ev streamEvents, rng *rand.Rand) error {
+	start := time.Now()
+
+	if ev.begin != "" {
+		if err := d.send(models.WsEspToBackend{Event: ev.begin, Timestamp: d.timestamp(start)}); err != nil {
+			return err
+		}
+	}
+
+	next := start
+	var lostUntil time.Time
+
+	for duration == 0 || next.Sub(start) < duration {
+		raw, span := st.next()
+		first := next
+		next = next.Add(span)
+
+		select {
+		case <-time.After(time.Until(next)):
+		case <-ctx.Done():
+			return nil
+		}
+
+		if next.Before(lostUntil) {
+			packetsLost.Add(1)
+			continue
+		}
+		if d.o.dropout > 0 && rng.Float64() < d.o.dropout {
+			lostUntil = next.Add(d.o.dropLen)
+			packetsLost.Add(1)
+			continue
+		}
+
+		if err := d.send(models.WsEspToBackend{Event: ev.data, Timestamp: d.timestamp(first), Raw: raw}); err != nil {
+			return err
+		}
+		packetsSent.Add(1)
+	}
+
+	if ev.finish != "" {
+		return d.send(models.WsEspToBackend{Event: ev.finish, Timestamp: d.timestamp(next)})
+	}
+	return nil
+}
+
+func (d *device) send(msg models.WsEspToBackend) error {
+	msg.DeviceName = d.name
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return d.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// clock is the device clock in ns, off from the host clock by a fixed offset
+// and a drift like a real crystal.
+func (d *device) clock(t time.Time) int64 {
+	elapsed := t.Sub(d.born)
+	return t.Add(d.offset + time.Duration(float64(elapsed)*d.drift/1e6)).UnixNano()
+}
+
+func (d *device) timestamp(t time.Time) string {
+	return strconv.FormatInt(d.clock(t), 10)
+}
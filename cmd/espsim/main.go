@@ -0,0 +1,164 @@
+// Command espsim simulates ESP32 EMG boards against /ws/esp, for working on
+// the backend without hardware and for load tests with many devices.
+//
+//	espsim -url ws://localhost:8080/ws/esp -n 50 -enroll-token secret
+//	espsim -replay training_raw.csv
+//
+// Every device does the handshake, answers time_sync and set_config and obeys
+// raw_stream, start_live_stream and start_calibration with their stop
+// commands. The signal is synthetic EMG or training_raw rows replayed from a
+// CSV export (GET /training/raw/csv).
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/logging"
+)
+
+type options struct {
+	url         string
+	devices     int
+	name        string
+	token       string
+	enrollToken string
+	firmware    string
+	channels    int
+	sampleRate  int
+	packetSize  int
+	gain        int
+	replay      string
+
+	noise     float64
+	amplitude float64
+	mainsHz   float64
+	mainsAmp  float64
+	dropout   float64
+	dropLen   time.Duration
+	clockSkew time.Duration
+	movements int
+	liveHold  time.Duration
+	rampUp    time.Duration
+	stats     time.Duration
+	seed      uint64
+}
+
+// counters over all devices, logged every -stats
+var (
+	connected   atomic.Int64
+	packetsSent atomic.Int64
+	packetsLost atomic.Int64
+	reconnects  atomic.Int64
+)
+
+func main() {
+	var o options
+	var logLevel, logFormat string
+
+	flag.StringVar(&o.url, "url", "ws://localhost:8080/ws/esp", "backend ESP websocket")
+	flag.IntVar(&o.devices, "n", 1, "simulated devices")
+	flag.StringVar(&o.name, "name", "sim", "device name prefix, devices are <name>-001 ...")
+	flag.StringVar(&o.token, "token", "", "device token, derived from the device name when empty")
+	flag.StringVar(&o.enrollToken, "enroll-token", "", "enroll secret for devices the backend does not know")
+	flag.StringVar(&o.firmware, "firmware", "espsim", "firmware version reported at handshake")
+	flag.IntVar(&o.channels, "channels", 8, "channels reported at handshake")
+	flag.IntVar(&o.sampleRate, "rate", 1000, "sample rate (Hz) until set_config changes it")
+	flag.IntVar(&o.packetSize, "packet", 50, "samples per channel and packet until set_config changes it")
+	flag.IntVar(&o.gain, "gain", 6, "gain until set_config changes it, amplitudes are given at this gain")
+	flag.StringVar(&o.replay, "replay", "", "CSV export of training_raw to replay instead of synthetic EMG")
+
+	flag.Float64Var(&o.noise, "noise", 40, "noise floor (counts, standard deviation)")
+	flag.Float64Var(&o.amplitude, "amplitude", 1500, "contraction amplitude (counts at -gain)")
+	flag.Float64Var(&o.mainsHz, "mains-hz", 50, "mains frequency")
+	flag.Float64Var(&o.mainsAmp, "mains", 20, "mains hum amplitude (counts), 0 turns it off")
+	flag.Float64Var(&o.dropout, "dropout", 0, "probability that a packet starts a dropout")
+	flag.DurationVar(&o.dropLen, "dropout-len", 300*time.Millisecond, "how long a dropout loses packets")
+	flag.DurationVar(&o.clockSkew, "clock-skew", 5*time.Second, "largest offset of a device clock from the host clock")
+	flag.IntVar(&o.movements, "movements", 4, "movement classes live streams cycle through")
+	flag.DurationVar(&o.liveHold, "live-hold", 3*time.Second, "how long each movement is held in live streams")
+	flag.DurationVar(&o.rampUp, "ramp", 300*time.Millisecond, "contraction ramp up and down")
+	flag.DurationVar(&o.stats, "stats", 10*time.Second, "interval of the stats log line, 0 turns it off")
+	flag.Uint64Var(&o.seed, "seed", uint64(time.Now().UnixNano()), "random seed")
+
+	flag.StringVar(&logLevel, "log-level", "info", "debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", "text", "text or json")
+	flag.Parse()
+
+	logging.Setup(os.Stderr, logFormat, logging.ParseLevel(logLevel))
+
+	if o.devices < 1 || o.channels < 1 || o.sampleRate < 1 || o.packetSize < 1 || o.gain < 1 || o.movements < 1 {
+		fmt.Fprintln(os.Stderr, "-n, -channels, -rate, -packet, -gain and -movements must be positive")
+		os.Exit(2)
+	}
+
+	var src source = newSynthetic(o)
+	if o.replay != "" {
+		rs, err := loadReplay(o.replay)
+		if err != nil {
+			slog.Error("load replay", "err", err)
+			os.Exit(1)
+		}
+		slog.Info("replaying", "file", o.replay, "repetitions", len(rs.reps), "packets", rs.packets)
+		src = rs
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if o.stats > 0 {
+		go logStats(ctx, o.stats)
+	}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= o.devices; i++ {
+		d := newDevice(o, i, src)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.run(ctx)
+		}()
+
+		// a few hundred handshakes at once look like an attack, not a fleet
+		// powering up
+		select {
+		case <-time.After(20 * time.Millisecond):
+		case <-ctx.Done():
+		}
+	}
+
+	wg.Wait()
+	slog.Info("stopped", "packets_sent", packetsSent.Load(), "packets_lost", packetsLost.Load())
+}
+
+func logStats(ctx context.Context, every time.Duration) {
+	t := time.NewTicker(every)
+	defer t.Stop()
+
+	var last int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		sent := packetsSent.Load()
+		slog.Info("stats",
+			"connected", connected.Load(),
+			"packets_sent", sent,
+			"packets_per_s", float64(sent-last)/every.Seconds(),
+			"packets_lost", packetsLost.Load(),
+			"reconnects", reconnects.Load(),
+		)
+		last = sent
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// recording is one repetition of the export, packets in the order they were
+// taken and the time between them.
+type recording struct {
+	movementID int
+	packets    [][]int
+	gaps       []time.Duration
+	rest       []bool // segment column said rest
+}
+
+// replaySource plays recorded repetitions back. Samples go out as they were
+// stored, set_config does not change them.
+type replaySource struct {
+	reps       []*recording
+	byMovement map[int][]*recording
+	packets    int
+
+	mu   sync.Mutex
+	turn map[int]int // next repetition per movement, devices take turns
+}
+
+func loadReplay(path string) (*replaySource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+
+	col := map[string]int{}
+	for i, name := range header {
+		col[name] = i
+	}
+	for _, name := range []string{"training_id", "movement_id", "repetition", "timestamp", "raw"} {
+		if _, ok := col[name]; !ok {
+			return nil, fmt.Errorf("column %s missing, expected a training raw CSV export", name)
+		}
+	}
+	segment, hasSegment := col["segment"]
+
+	type repKey struct{ training, rep int }
+	type row struct {
+		ts   time.Time
+		raw  []int
+		rest bool
+	}
+	rows := map[repKey][]row{}
+	movements := map[repKey]int{}
+	var order []repKey
+
+	for line := 2; ; line++ {
+		rec, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		training, err1 := strconv.Atoi(rec[col["training_id"]])
+		rep, err2 := strconv.Atoi(rec[col["repetition"]])
+		movement, err3 := strconv.Atoi(rec[col["movement_id"]])
+		ts, err4 := time.Parse(time.RFC3339Nano, rec[col["timestamp"]])
+		raw, err5 := parseRaw(rec[col["raw"]])
+		if err := errors.Join(err1, err2, err3, err4, err5); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if len(raw) == 0 {
+			continue
+		}
+
+		k := repKey{training, rep}
+		if _, ok := rows[k]; !ok {
+			order = append(order, k)
+			movements[k] = movement
+		}
+		rows[k] = append(rows[k], row{ts: ts, raw: raw, rest: hasSegment && rec[segment] == "rest"})
+	}
+
+	if len(order) == 0 {
+		return nil, errors.New("no samples in the export")
+	}
+
+	s := &replaySource{byMovement: map[int][]*recording{}, turn: map[int]int{}}
+
+	for _, k := range order {
+		rs := rows[k]
+		sort.SliceStable(rs, func(i, j int) bool { return rs[i].ts.Before(rs[j].ts) })
+
+		rec := &recording{movementID: movements[k]}
+		for i, x := range rs {
+			var gap time.Duration
+			if i > 0 {
+				gap = x.ts.Sub(rs[i-1].ts)
+			}
+			rec.packets = append(rec.packets, x.raw)
+			rec.gaps = append(rec.gaps, gap)
+			rec.rest = append(rec.rest, x.rest)
+		}
+		fixGaps(rec.gaps)
+
+		s.reps = append(s.reps, rec)
+		s.byMovement[rec.movementID] = append(s.byMovement[rec.movementID], rec)
+		s.packets += len(rec.packets)
+	}
+
+	return s, nil
+}
+
+// fixGaps gives the first packet the median gap and keeps pauses in the
+// recording (reconnects, clock steps) from stalling the replay.
+func fixGaps(gaps []time.Duration) {
+	sorted := append([]time.Duration(nil), gaps[1:]...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	median := 50 * time.Millisecond
+	if len(sorted) > 0 {
+		median = sorted[len(sorted)/2]
+	}
+	gaps[0] = median
+
+	for i, g := range gaps {
+		gaps[i] = max(time.Millisecond, min(g, time.Second))
+	}
+}
+
+func parseRaw(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	raw := make([]int, len(parts))
+	for i, p := range parts {
+		v, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return nil, err
+		}
+		raw[i] = v
+	}
+	return raw, nil
+}
+
+// open picks the repetitions for the command: recordings of the movement for
+// raw_stream (any when the export has none of it), everything in turn for
+// live streams, rest or active packets for calibration.
+func (s *replaySource) open(sp streamSpec, _ *rand.Rand) stream {
+	pool := s.reps
+
+	switch sp.kind {
+	case kindRecording:
+		if reps := s.byMovement[sp.movementID]; len(reps) > 0 {
+			pool = reps
+		}
+	case kindCalibration:
+		if rec := s.segment(sp.phase == "rest"); len(rec.packets) > 0 {
+			pool = []*recording{rec}
+		}
+	}
+
+	s.mu.Lock()
+	first := s.turn[sp.movementID] % len(pool)
+	s.turn[sp.movementID]++
+	s.mu.Unlock()
+
+	return &replayStream{pool: pool, rep: first}
+}
+
+// segment collects the rest or the active packets of all repetitions.
+func (s *replaySource) segment(rest bool) *recording {
+	out := &recording{}
+	for _, rec := range s.reps {
+		for i, r := range rec.rest {
+			if r == rest {
+				out.packets = append(out.packets, rec.packets[i])
+				out.gaps = append(out.gaps, rec.gaps[i])
+			}
+		}
+	}
+	return out
+}
+
+type replayStream struct {
+	pool   []*recording
+	rep    int
+	packet int
+}
+
+// next loops over the pool, a command longer than the recording repeats it.
+func (st *replayStream) next() ([]int, time.Duration) {
+	rec := st.pool[st.rep]
+	raw, gap := rec.packets[st.packet], rec.gaps[st.packet]
+
+	st.packet++
+	if st.packet == len(rec.packets) {
+		st.packet = 0
+		st.rep = (st.rep + 1) % len(st.pool)
+	}
+
+	return raw, gap
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math"
+	"math/rand/v2"
+	"time"
+)
+
+type streamKind int
+
+const (
+	kindRecording   streamKind = iota // raw_stream, one repetition
+	kindLive                          // start_live_stream, until stopped
+	kindCalibration                   // start_calibration, rest or mvc
+)
+
+// streamSpec is what a command asked for. cfg is the device config when the
+// stream started, set_config during a stream applies to the next one.
+type streamSpec struct {
+	kind       streamKind
+	movementID int
+	phase      string
+	duration   time.Duration // 0 for live
+	cfg        deviceConfig
+}
+
+// source makes the streams of all devices, open is called from several
+// goroutines.
+type source interface {
+	open(sp streamSpec, rng *rand.Rand) stream
+}
+
+// stream returns the samples of one packet, interleaved by channel, and the
+// time they cover.
+type stream interface {
+	next() (raw []int, span time.Duration)
+}
+
+// synthetic EMG: gaussian noise floor, contractions as amplitude modulated
+// noise on a channel pattern per movement, mains hum on every channel.
+type synthetic struct {
+	o options
+}
+
+func newSynthetic(o options) *synthetic {
+	return &synthetic{o: o}
+}
+
+func (s *synthetic) open(sp streamSpec, rng *rand.Rand) stream {
+	return &synthStream{o: s.o, sp: sp, rng: rng}
+}
+
+type synthStream struct {
+	o   options
+	sp  streamSpec
+	rng *rand.Rand
+	n   int // samples per channel so far
+}
+
+func (st *synthStream) next() ([]int, time.Duration) {
+	cfg := st.sp.cfg
+	raw := make([]int, 0, len(cfg.channels)*cfg.packetSize)
+
+	// amplitudes are given at the startup gain, a higher gain clips
+	scale := float64(cfg.gain) / float64(st.o.gain)
+
+	for range cfg.packetSize {
+		t := float64(st.n) / float64(cfg.sampleRate)
+		movement, env := st.activity(t)
+
+		for _, ch := range cfg.channels {
+			v := st.o.noise * st.rng.NormFloat64()
+			if env > 0 {
+				v += env * st.o.amplitude * channelWeight(movement, ch) * st.rng.NormFloat64()
+			}
+			v += st.o.mainsAmp * math.Sin(2*math.Pi*st.o.mainsHz*t+float64(ch))
+
+			raw = append(raw, clip(v*scale))
+		}
+		st.n++
+	}
+
+	return raw, time.Duration(cfg.packetSize) * time.Second / time.Duration(cfg.sampleRate)
+}
+
+// activity gives the movement held at t seconds into the stream and how hard
+// (0 rest, 1 a normal contraction).
+func (st *synthStream) activity(t float64) (int, float64) {
+	ramp := st.o.rampUp.Seconds()
+
+	switch st.sp.kind {
+	case kindRecording:
+		// the subject reacts to the cue and relaxes before the end, which
+		// gives the segment detection a rest on both sides
+		d := st.sp.duration.Seconds()
+		on := math.Min(0.5, d*0.1)
+		off := d - math.Min(0.8, d*0.15)
+		return st.sp.movementID, envelope(t, on, off, ramp)
+
+	case kindLive:
+		// rest and movement take turns, the movements cycle through the classes
+		hold := st.o.liveHold.Seconds()
+		i := int(t / hold)
+		if i%2 == 0 {
+			return 0, 0
+		}
+		start := float64(i) * hold
+		movement := (i/2)%st.o.movements + 1
+		return movement, envelope(t, start, start+hold, ramp)
+
+	case kindCalibration:
+		if st.sp.phase != "mvc" {
+			return 0, 0
+		}
+		d := st.sp.duration.Seconds()
+		return -1, 1.6 * envelope(t, math.Min(0.5, d*0.1), d, ramp)
+	}
+
+	return 0, 0
+}
+
+// envelope rises from on, falls to off, ramp seconds each.
+func envelope(t, on, off, ramp float64) float64 {
+	if t < on || t > off {
+		return 0
+	}
+	if ramp <= 0 {
+		return 1
+	}
+	return math.Min(1, math.Min((t-on)/ramp, (off-t)/ramp))
+}
+
+// channelWeight is how strongly a channel picks up a movement. Each movement
+// has one main channel and a fixed random pattern on the others, so classes
+// are separable. movement -1 (MVC) drives all channels fully.
+func channelWeight(movement, ch int) float64 {
+	if movement < 0 {
+		return 1
+	}
+	if movement > 0 && (movement-1)%8 == ch%8 {
+		return 1
+	}
+
+	// splitmix64 of (movement, channel), stable across runs and devices
+	x := uint64(movement)*0x9e3779b97f4a7c15 + uint64(ch) + 1
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	u := float64(x>>11) / (1 << 53)
+
+	return 0.05 + 0.6*u*u
+}
+
+func clip(v float64) int {
+	return int(math.Max(-32768, math.Min(32767, math.Round(v))))
+}
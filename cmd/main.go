@@ -1,28 +1,158 @@
 package main
 
 import (
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
+	"emg_esp32_classifier_backend/internal/config"
 	"emg_esp32_classifier_backend/internal/ctrl/httpH"
 	"emg_esp32_classifier_backend/internal/ctrl/ws"
 	"emg_esp32_classifier_backend/internal/repo"
 	"emg_esp32_classifier_backend/internal/svc"
+	"emg_esp32_classifier_backend/pkg/auth"
+	"emg_esp32_classifier_backend/pkg/capture"
+	"emg_esp32_classifier_backend/pkg/health"
+	"emg_esp32_classifier_backend/pkg/logging"
+	"emg_esp32_classifier_backend/pkg/metrics"
+	"emg_esp32_classifier_backend/pkg/tracing"
 )
 
 func main() {
-	db, err := repo.NewPostgresConnection()
+	// cancelled on SIGTERM / SIGINT, stops the background loops
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	logging.Setup(os.Stderr, cfg.Log.Format, logging.ParseLevel(cfg.Log.Level))
+
+	shutdownTracing, err := tracing.Setup(cfg.Tracing.Exporter, cfg.Tracing.Endpoint, "emg-backend", cfg.Tracing.SampleRatio)
+	if err != nil {
+		fatal("tracing", err)
+	}
+
+	db, err := repo.NewPostgresConnection(cfg.DB.DSN())
 	if err != nil {
-		log.Fatal(err)
+		fatal("open database", err)
+	}
+
+	// postgres usually starts together with the backend, give it time
+	// instead of failing on the first request
+	waitCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.DB.WaitTimeout))
+	if err := repo.WaitForDB(waitCtx, db); err != nil {
+		fatal("wait for database", err)
+	}
+	if err := repo.Migrate(waitCtx, db); err != nil {
+		fatal("migrate", err)
 	}
+	cancel()
 
 	repository := repo.NewPostgresRepository(db)
 
-	service := svc.NewService(repository)
+	users, err := repository.ListUsers(ctx)
+	if err != nil {
+		fatal("list users", err)
+	}
+	if err := cfg.ValidateAuth(len(users)); err != nil {
+		fatal("config", err)
+	}
+
+	service := svc.NewService(repository, cfg)
+
+	authenticator := auth.NewAuthenticator(
+		cfg.Auth.JWTSecret,
+		auth.ParseAPIKeys(cfg.Auth.APIKeys),
+		repository,
+		cfg.Auth.Disabled,
+	)
+
+	origins := auth.ParseOrigins(strings.Join(cfg.Auth.AllowedOrigins, ","))
+	ws.SetCheckOrigin(origins.CheckOrigin)
+	ws.Configure(cfg.WS)
+
+	var rec *capture.Writer
+	if cfg.WS.RecordFile != "" {
+		if rec, err = capture.Create(cfg.WS.RecordFile); err != nil {
+			fatal("open record file", err)
+		}
+		ws.SetRecorder(rec)
+		slog.Warn("recording websocket traffic", "file", cfg.WS.RecordFile)
+	}
 
 	hub := ws.NewHub()
 
+	service.OnDeviceStatusChange(hub.BroadcastDeviceStatus)
+	service.OnESPCommand(hub.SendCommandToESP)
+	service.OnESPDisconnect(hub.DisconnectESP)
+	service.OnDeviceDeleted(ws.ForgetDevice)
+
+	hub.RegisterMetrics(metrics.Registry)
+	service.RegisterMetrics(metrics.Registry)
+
+	checker := health.NewChecker()
+	checker.Add(health.Check{
+		Name:     "db",
+		Critical: true,
+		Timeout:  time.Second,
+		Fn:       db.PingContext,
+	})
+	checker.Add(health.Check{
+		Name:     "migrations",
+		Critical: true,
+		Timeout:  2 * time.Second,
+		Fn: func(ctx context.Context) error {
+			pending, err := repo.PendingMigrations(ctx, db)
+			if err != nil {
+				return err
+			}
+			if len(pending) > 0 {
+				return fmt.Errorf("pending: %s", strings.Join(pending, ", "))
+			}
+			return nil
+		},
+	})
+	service.RegisterHealthChecks(checker)
+
+	// load balancers stop sending new connections once this fails
+	var shuttingDown atomic.Bool
+	checker.Add(health.Check{
+		Name:     "shutdown",
+		Critical: true,
+		Fn: func(context.Context) error {
+			if shuttingDown.Load() {
+				return errors.New("shutting down")
+			}
+			return nil
+		},
+	})
+
+	sessionTTL := time.Duration(cfg.Training.SessionTTL)
+
+	if err := service.RestoreSessions(context.Background(), sessionTTL); err != nil {
+		slog.Error("restore sessions", "err", err)
+	}
+
+	if err := service.ReconcileDevices(context.Background(), hub.ConnectedESPs()); err != nil {
+		slog.Error("reconcile devices", "err", err)
+	}
+
+	go hub.RunControlExpiry(ctx, time.Duration(cfg.Devices.ControlExpiry))
+
+	go service.RunSweeper(ctx, time.Duration(cfg.Devices.SweepInterval), time.Duration(cfg.Devices.DisconnectTimeout), sessionTTL)
+
 	frontendWS := ws.NewFrontendWSHandler(service, hub)
 	espWS := ws.NewEspWSHandler(service, hub)
 
@@ -30,46 +160,171 @@ func main() {
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/ws/frontend", frontendWS.HandleFrontendWS)
+	mux.HandleFunc("/ws/frontend", auth.Require(auth.PermView, frontendWS.HandleFrontendWS))
 	mux.HandleFunc("/ws/esp", espWS.HandleEspWS)
 
-	mux.HandleFunc("/devices", httpHandler.GetDeviceList)
-	mux.HandleFunc("/movements", httpHandler.GetMovements)
-	mux.HandleFunc("/training/raw/csv", httpHandler.GetTrainingRawCSV)
+	mux.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			auth.Require(auth.PermManageDevices, httpHandler.ProvisionDevice)(w, r)
+			return
+		}
+		auth.Require(auth.PermView, httpHandler.GetDeviceList)(w, r)
+	})
+	mux.HandleFunc("/movements", auth.Require(auth.PermView, httpHandler.GetMovements))
+	mux.HandleFunc("/training/raw/csv", auth.Require(auth.PermExport, httpHandler.GetTrainingRawCSV))
+	mux.HandleFunc("/training/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/quality") {
+			auth.Require(auth.PermView, httpHandler.GetTrainingQuality)(w, r)
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/segments") {
+			auth.Require(auth.PermView, httpHandler.GetTrainingSegments)(w, r)
+			return
+		}
+
+		http.NotFound(w, r)
+	})
+
+	mux.HandleFunc("/users", auth.Require(auth.PermManageUsers, httpHandler.Users))
+	mux.HandleFunc("/users/", auth.Require(auth.PermManageUsers, httpHandler.User))
 
 	mux.HandleFunc("/device/", func(w http.ResponseWriter, r *http.Request) {
 		if strings.HasSuffix(r.URL.Path, "/reserve") {
-			httpHandler.ReserveDevice(w, r)
+			auth.Require(auth.PermControl, httpHandler.ReserveDevice)(w, r)
 			return
 		}
 
-		http.NotFound(w, r)
-	})
+		if strings.HasSuffix(r.URL.Path, "/release") {
+			auth.Require(auth.PermControl, httpHandler.ReleaseDevice)(w, r)
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/clock") {
+			auth.Require(auth.PermView, httpHandler.GetClockSync)(w, r)
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/calibrations") {
+			auth.Require(auth.PermView, httpHandler.GetCalibrations)(w, r)
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/config/history") {
+			auth.Require(auth.PermView, httpHandler.GetDeviceConfigHistory)(w, r)
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/config") {
+			if r.Method == http.MethodGet {
+				auth.Require(auth.PermView, httpHandler.DeviceConfig)(w, r)
+				return
+			}
+			auth.Require(auth.PermControl, httpHandler.DeviceConfig)(w, r)
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/debug") {
+			auth.Require(auth.PermManageDevices, httpHandler.DeviceDebug)(w, r)
+			return
+		}
+
+		if strings.HasSuffix(r.URL.Path, "/token") {
+			auth.Require(auth.PermManageDevices, httpHandler.RotateDeviceToken)(w, r)
+			return
+		}
+
+		if r.Method == http.MethodGet {
+			auth.Require(auth.PermView, httpHandler.Device)(w, r)
+			return
+		}
 
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("ok"))
+		auth.Require(auth.PermManageDevices, httpHandler.Device)(w, r)
 	})
 
-	handler := withCORS(mux)
+	mux.HandleFunc("/metrics", auth.Require(auth.PermView, metrics.Handler().ServeHTTP))
+	mux.HandleFunc("/config", auth.Require(auth.PermDebug, cfg.Handler()))
+
+	mux.HandleFunc("/livez", health.LiveHandler())
+	mux.HandleFunc("/readyz", checker.ReadyHandler())
+	// kept for existing probes
+	mux.HandleFunc("/health", health.LiveHandler())
 
-	log.Println("Server started on :8080")
-	if err := http.ListenAndServe(":8080", handler); err != nil {
-		log.Fatalf("server failed: %v", err)
+	handler := origins.CORS(authenticator.Middleware(mux, "/health", "/livez", "/readyz", "/ws/esp"))
+	handler = tracing.Handler(handler, "/health", "/livez", "/readyz", "/metrics", "/ws/esp", "/ws/frontend")
+
+	srv := &http.Server{Addr: cfg.Server.Addr, Handler: handler}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		slog.Info("server started", "addr", cfg.Server.Addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		fatal("server failed", err)
+	case <-ctx.Done():
+	}
+
+	shuttingDown.Store(true)
+	slog.Info("shutting down", "timeout", cfg.Server.ShutdownTimeout)
+
+	sctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Server.ShutdownTimeout))
+	defer cancel()
+
+	if err := shutdown(sctx, cfg, srv, hub, service); err != nil {
+		slog.Error("shutdown incomplete", "err", err)
+		os.Exit(1)
+	}
+
+	if err := shutdownTracing(sctx); err != nil {
+		slog.Error("flush traces", "err", err)
 	}
+	db.Close()
+
+	if rec != nil {
+		rec.Close()
+	}
+
+	slog.Info("shutdown complete")
 }
 
-func withCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
+// shutdown stops taking connections, tells streaming ESPs to stop, waits
+// shortly for packets already sent, then closes every socket and waits for
+// the handlers to store what they read and mark devices disconnected.
+func shutdown(ctx context.Context, cfg *config.Config, srv *http.Server, hub *ws.Hub, service *svc.Service) error {
+	// hijacked WebSockets are not touched by this, only the listener and
+	// plain HTTP requests
+	httpDone := make(chan error, 1)
+	go func() { httpDone <- srv.Shutdown(ctx) }()
 
-		if r.Method == http.MethodOptions {
-			w.WriteHeader(http.StatusOK)
-			return
+	if n := service.StopDevices(ctx); n > 0 {
+		select {
+		case <-time.After(time.Duration(cfg.Server.ShutdownDrain)):
+		case <-ctx.Done():
 		}
+	}
 
-		next.ServeHTTP(w, r)
-	})
+	hub.CloseAll()
+
+	if err := hub.Wait(ctx); err != nil {
+		return fmt.Errorf("waiting for connections: %w", err)
+	}
+
+	// devices whose handler did not get to it, and frontends are told too
+	if err := service.ReconcileDevices(ctx, nil); err != nil {
+		return fmt.Errorf("reset device statuses: %w", err)
+	}
+
+	if err := <-httpDone; err != nil {
+		return fmt.Errorf("http shutdown: %w", err)
+	}
+
+	return nil
+}
+
+func fatal(msg string, err error) {
+	slog.Error(msg, "err", err)
+	os.Exit(1)
 }
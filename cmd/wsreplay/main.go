@@ -0,0 +1,90 @@
+// Command wsreplay plays a WebSocket capture (ws.record_file) back against a
+// running backend: the ESP and frontend messages go through /ws/esp and
+// /ws/frontend again with their recorded timing, and the frontend events the
+// backend sends are compared with the recorded ones.
+//
+//	wsreplay -speed 10 -check capture.jsonl
+//
+// Replay into a backend with an empty database or with its own devices: the
+// devices enroll again under new ids, which are mapped to the recorded ones.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/capture"
+	"emg_esp32_classifier_backend/pkg/logging"
+)
+
+type options struct {
+	url         string
+	speed       float64
+	token       string
+	deviceToken string
+	enrollToken string
+	wait        time.Duration
+	check       bool
+}
+
+func main() {
+	var o options
+	var logLevel string
+
+	flag.StringVar(&o.url, "url", "ws://localhost:8080", "backend base URL")
+	flag.Float64Var(&o.speed, "speed", 1, "replay speed, 2 is twice as fast, 0 as fast as the replies allow")
+	flag.StringVar(&o.token, "token", "", "API key or JWT for the frontend sockets")
+	flag.StringVar(&o.deviceToken, "device-token", "", "ESP token, replay-<device name> when empty")
+	flag.StringVar(&o.enrollToken, "enroll-token", "", "enroll secret of the backend")
+	flag.DurationVar(&o.wait, "wait", 10*time.Second, "how long to wait for a reply the capture had before going on")
+	flag.BoolVar(&o.check, "check", false, "exit 1 when the frontend events differ from the capture")
+	flag.StringVar(&logLevel, "log-level", "info", "debug, info, warn or error")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: wsreplay [flags] capture.jsonl")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	logging.Setup(os.Stderr, "text", logging.ParseLevel(logLevel))
+
+	if flag.NArg() != 1 || o.speed < 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		slog.Error("open capture", "err", err)
+		os.Exit(1)
+	}
+	records, err := capture.Read(f)
+	f.Close()
+	if err != nil {
+		slog.Error("read capture", "err", err)
+		os.Exit(1)
+	}
+
+	scripts := buildScripts(records)
+	if len(scripts) == 0 {
+		slog.Error("capture has no messages")
+		os.Exit(1)
+	}
+	slog.Info("replaying", "connections", len(scripts), "records", len(records), "speed", o.speed)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	p := newPlayer(o)
+	results := p.run(ctx, scripts)
+
+	diffs := report(os.Stdout, results)
+	if o.check && diffs > 0 {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/capture"
+	"github.com/gorilla/websocket"
+)
+
+const writeWait = 10 * time.Second
+
+type player struct {
+	o     options
+	ids   *idMap
+	start time.Time
+
+	// connections the capture ends with stay open until every script is
+	// through, closing them early would add disconnect events
+	allSent chan struct{}
+
+	mu       sync.Mutex
+	reserved map[int]bool // live device ids
+}
+
+type result struct {
+	sc  *script
+	got map[string]int
+}
+
+func newPlayer(o options) *player {
+	return &player{
+		o:        o,
+		ids:      newIDMap(),
+		allSent:  make(chan struct{}),
+		reserved: map[int]bool{},
+	}
+}
+
+func (p *player) run(ctx context.Context, scripts []*script) []result {
+	for _, sc := range scripts {
+		if sc.deviceID != 0 {
+			p.ids.expect(sc.deviceID)
+		}
+	}
+
+	p.start = time.Now()
+	results := make([]result, len(scripts))
+
+	var sent, closed sync.WaitGroup
+	for i, sc := range scripts {
+		sent.Add(1)
+		closed.Add(1)
+		go func() {
+			defer closed.Done()
+			results[i] = p.play(ctx, sc, sent.Done)
+		}()
+	}
+
+	sent.Wait()
+	close(p.allSent)
+	closed.Wait()
+
+	return results
+}
+
+// play runs one script, sent is called once its messages are out.
+func (p *player) play(ctx context.Context, sc *script, sent func()) result {
+	res := result{sc: sc}
+
+	if !p.sleepUntil(ctx, sc.first) {
+		sent()
+		return res
+	}
+
+	lc, err := p.dial(ctx, sc)
+	if err != nil {
+		slog.Error("connect", "conn", sc.conn, "err", err)
+		sent()
+		return res
+	}
+
+	closedByScript := false
+	for _, st := range sc.steps {
+		if !p.sleepUntil(ctx, st.at) {
+			break
+		}
+		if !lc.waitUntil(p.o.wait, func() bool { return covers(lc.got, st.need) }) {
+			slog.Warn("replies missing, going on", "conn", sc.conn, "need", st.need, "got", lc.snapshot(false))
+		}
+
+		if st.dir == capture.Closed {
+			closedByScript = true
+			break
+		}
+
+		msg, ok := p.rewrite(ctx, lc, st.msg)
+		if !ok {
+			continue
+		}
+		if err := lc.send(msg); err != nil {
+			slog.Warn("send", "conn", sc.conn, "err", err)
+			break
+		}
+	}
+
+	if sc.kind == "frontend" {
+		lc.waitUntil(p.o.wait, func() bool { return covers(lc.sigs, sc.expect) })
+	}
+	sent()
+
+	if !closedByScript {
+		select {
+		case <-p.allSent:
+		case <-ctx.Done():
+		}
+	}
+
+	lc.close()
+	res.got = lc.snapshot(true)
+
+	return res
+}
+
+// sleepUntil waits for the scaled capture time at, speed 0 does not wait.
+func (p *player) sleepUntil(ctx context.Context, at time.Duration) bool {
+	if p.o.speed == 0 {
+		return ctx.Err() == nil
+	}
+
+	select {
+	case <-time.After(time.Until(p.start.Add(time.Duration(float64(at) / p.o.speed)))):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (p *player) dial(ctx context.Context, sc *script) (*liveConn, error) {
+	path := "/ws/esp"
+	header := http.Header{}
+
+	if sc.kind == "frontend" {
+		path = "/ws/frontend"
+		p.authorize(header)
+	}
+
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, p.o.url+path, header)
+	if err != nil {
+		return nil, err
+	}
+
+	lc := &liveConn{
+		p:       p,
+		sc:      sc,
+		conn:    conn,
+		got:     map[string]int{},
+		sigs:    map[string]int{},
+		changed: make(chan struct{}),
+	}
+	go lc.readLoop()
+
+	return lc, nil
+}
+
+func (p *player) authorize(h http.Header) {
+	if p.o.token != "" {
+		h.Set("Authorization", "Bearer "+p.o.token)
+	}
+	// reservations belong to the client id when auth is off
+	h.Set("X-Client-ID", "wsreplay")
+}
+
+// rewrite adapts a recorded message to this run: ESP secrets and timestamps,
+// device ids of the frontend. Housekeeping replies are dropped, the live
+// connection answers them itself.
+func (p *player) rewrite(ctx context.Context, lc *liveConn, raw json.RawMessage) ([]byte, bool) {
+	// messages that were not JSON are stored as a string
+	if len(raw) > 0 && raw[0] == '"' {
+		var s string
+		json.Unmarshal(raw, &s)
+		return []byte(s), true
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var m map[string]any
+	if err := dec.Decode(&m); err != nil {
+		return raw, true
+	}
+
+	event, _ := m["event"].(string)
+
+	if lc.sc.kind == "esp" {
+		switch event {
+		case "time_sync_reply", "config_ack":
+			return nil, false
+		case "handshake":
+			name, _ := m["device_name"].(string)
+			m["token"] = p.o.deviceToken
+			if p.o.deviceToken == "" {
+				m["token"] = "replay-" + name
+			}
+			m["enroll_token"] = p.o.enrollToken
+		}
+
+		// the live connection answers time_sync with the host clock
+		if ts, _ := m["timestamp"].(string); ts != "" {
+			m["timestamp"] = strconv.FormatInt(time.Now().UnixNano(), 10)
+		}
+	} else if n, ok := m["device_id"].(json.Number); ok {
+		rec, _ := n.Int64()
+		live := p.ids.toLive(int(rec), p.o.wait)
+		m["device_id"] = live
+
+		switch event {
+		case "start_training", "start_streaming", "start_calibration":
+			p.reserve(ctx, live)
+		}
+	}
+
+	b, _ := json.Marshal(m)
+	return b, true
+}
+
+// reserve takes the device once, the capture does not contain the REST call
+// the recorded frontend made for it.
+func (p *player) reserve(ctx context.Context, deviceID int) {
+	p.mu.Lock()
+	done := p.reserved[deviceID]
+	p.reserved[deviceID] = true
+	p.mu.Unlock()
+
+	if done {
+		return
+	}
+
+	base := strings.Replace(strings.Replace(p.o.url, "wss://", "https://", 1), "ws://", "http://", 1)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/device/%d/reserve", base, deviceID), nil)
+	if err != nil {
+		slog.Warn("reserve", "device_id", deviceID, "err", err)
+		return
+	}
+	p.authorize(req.Header)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Warn("reserve", "device_id", deviceID, "err", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		slog.Warn("reserve", "device_id", deviceID, "status", resp.StatusCode, "body", strings.TrimSpace(string(body)))
+	}
+}
+
+// liveConn is a replayed connection. Its read loop counts what arrives.
+type liveConn struct {
+	p    *player
+	sc   *script
+	conn *websocket.Conn
+	wmu  sync.Mutex // gorilla allows one writer
+
+	mu      sync.Mutex
+	got     map[string]int // events, for the steps
+	sigs    map[string]int // frontend signatures, for the comparison
+	closed  bool
+	changed chan struct{} // closed and replaced on every update
+}
+
+func (c *liveConn) readLoop() {
+	defer func() {
+		c.mu.Lock()
+		c.closed = true
+		c.notify()
+		c.mu.Unlock()
+	}()
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		received := time.Now()
+		info := parseInfo(data)
+
+		if c.sc.kind == "esp" {
+			c.housekeeping(info, received)
+		}
+
+		c.mu.Lock()
+		if !noSync[info.Event] {
+			c.got[info.Event]++
+		}
+		if c.sc.kind == "frontend" {
+			c.sigs[info.signature(c.p.ids.toRecorded(info.DeviceID))]++
+		}
+		c.notify()
+		c.mu.Unlock()
+	}
+}
+
+// housekeeping answers what the recorded ESP answered, with this run's values.
+func (c *liveConn) housekeeping(info msgInfo, received time.Time) {
+	var reply any
+
+	switch info.Event {
+	case "handshake_ok":
+		c.p.ids.set(c.sc.deviceID, info.DeviceID)
+		slog.Info("device connected", "conn", c.sc.conn, "recorded_id", c.sc.deviceID, "device_id", info.DeviceID)
+	case "time_sync":
+		reply = map[string]any{"event": "time_sync_reply", "t1": info.T1, "t2": received.UnixNano(), "t3": time.Now().UnixNano()}
+	case "set_config":
+		reply = map[string]any{"event": "config_ack", "config_version": info.ConfigVersion}
+	}
+
+	if reply != nil {
+		b, _ := json.Marshal(reply)
+		if err := c.send(b); err != nil {
+			slog.Warn("send", "conn", c.sc.conn, "err", err)
+		}
+	}
+}
+
+func (c *liveConn) send(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+func (c *liveConn) close() {
+	c.wmu.Lock()
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	c.wmu.Unlock()
+
+	c.conn.Close()
+}
+
+// notify wakes waitUntil, c.mu is held.
+func (c *liveConn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// waitUntil waits for cond (called with c.mu held). It reports false on
+// timeout or when the backend closed the connection first.
+func (c *liveConn) waitUntil(timeout time.Duration, cond func() bool) bool {
+	deadline := time.After(timeout)
+
+	for {
+		c.mu.Lock()
+		ok, closed, changed := cond(), c.closed, c.changed
+		c.mu.Unlock()
+
+		if ok {
+			return true
+		}
+		if closed {
+			return false
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// snapshot copies the signatures, or the events when sigs is false.
+func (c *liveConn) snapshot(sigs bool) map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if sigs {
+		return maps.Clone(c.sigs)
+	}
+	return maps.Clone(c.got)
+}
+
+func covers(have, need map[string]int) bool {
+	for k, n := range need {
+		if have[k] < n {
+			return false
+		}
+	}
+	return true
+}
+
+// idMap pairs recorded device ids with the ids the devices got in this run.
+type idMap struct {
+	mu       sync.Mutex
+	live     map[int]int
+	recorded map[int]int
+	pending  map[int]bool // recorded ids a replayed handshake will bring
+	changed  chan struct{}
+}
+
+func newIDMap() *idMap {
+	return &idMap{
+		live:     map[int]int{},
+		recorded: map[int]int{},
+		pending:  map[int]bool{},
+		changed:  make(chan struct{}),
+	}
+}
+
+func (m *idMap) expect(rec int) {
+	m.mu.Lock()
+	m.pending[rec] = true
+	m.mu.Unlock()
+}
+
+func (m *idMap) set(rec, live int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.live[rec] = live
+	m.recorded[live] = rec
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+// toLive waits for the handshake of a device the capture connects, devices
+// that were connected before the capture started keep their id.
+func (m *idMap) toLive(rec int, timeout time.Duration) int {
+	deadline := time.After(timeout)
+
+	for {
+		m.mu.Lock()
+		live, ok := m.live[rec]
+		pending, changed := m.pending[rec], m.changed
+		m.mu.Unlock()
+
+		if ok {
+			return live
+		}
+		if !pending {
+			return rec
+		}
+
+		select {
+		case <-changed:
+		case <-deadline:
+			return rec
+		}
+	}
+}
+
+func (m *idMap) toRecorded(live int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if rec, ok := m.recorded[live]; ok {
+		return rec
+	}
+	return live
+}
+
+// report prints the frontend events that differ from the capture and returns
+// how many differ.
+func report(w io.Writer, results []result) int {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	defer tw.Flush()
+
+	diffs, matched := 0, 0
+
+	for _, r := range results {
+		if r.sc.kind != "frontend" {
+			continue
+		}
+
+		keys := map[string]bool{}
+		for k := range r.sc.expect {
+			keys[k] = true
+		}
+		for k := range r.got {
+			keys[k] = true
+		}
+		sorted := make([]string, 0, len(keys))
+		for k := range keys {
+			sorted = append(sorted, k)
+		}
+		sort.Strings(sorted)
+
+		for _, k := range sorted {
+			want, got := r.sc.expect[k], r.got[k]
+			matched += min(want, got)
+			if want != got {
+				if diffs == 0 {
+					fmt.Fprintln(tw, "CONN\tEVENT\tRECORDED\tREPLAYED")
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%d\t%d\n", r.sc.conn, k, want, got)
+				diffs++
+			}
+		}
+	}
+
+	if diffs == 0 {
+		fmt.Fprintf(tw, "all %d frontend events match the capture\n", matched)
+	} else {
+		fmt.Fprintf(tw, "%d frontend events match, %d differ\n", matched, diffs)
+	}
+
+	return diffs
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"sort"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/capture"
+)
+
+// script is one recorded connection: what it sent, when, and what it had
+// received by then.
+type script struct {
+	conn  string
+	kind  string        // esp or frontend
+	first time.Duration // first record, since the capture started
+
+	steps []step
+
+	// esp: the id its handshake_ok carried
+	deviceID int
+	// frontend: signatures of every event the backend sent it
+	expect map[string]int
+}
+
+// step sends a message (In) or closes the connection (Closed) once the
+// events in need have arrived, so a faster replay keeps the recorded order.
+type step struct {
+	at   time.Duration
+	dir  capture.Direction
+	msg  json.RawMessage
+	need map[string]int
+}
+
+// noSync are events that say nothing about the order of the next message:
+// housekeeping answered live, and data or status pushed at a varying rate.
+var noSync = map[string]bool{
+	"time_sync":         true,
+	"set_config":        true,
+	"training_raw_data": true,
+	"streaming_data":    true,
+	"device_status":     true,
+	"control_changed":   true,
+	"error":             true,
+}
+
+func buildScripts(records []capture.Record) []*script {
+	if len(records) == 0 {
+		return nil
+	}
+
+	// several goroutines write the capture, lines can be slightly out of order
+	sort.SliceStable(records, func(i, j int) bool { return records[i].At.Before(records[j].At) })
+	start := records[0].At
+
+	var order []*script
+	byConn := map[string]*script{}
+	received := map[string]map[string]int{}
+
+	for _, r := range records {
+		at := r.At.Sub(start)
+
+		sc := byConn[r.Conn]
+		if sc == nil {
+			sc = &script{conn: r.Conn, kind: r.Kind, first: at, expect: map[string]int{}}
+			byConn[r.Conn] = sc
+			received[r.Conn] = map[string]int{}
+			order = append(order, sc)
+		}
+
+		switch r.Dir {
+		case capture.Out:
+			info := parseInfo(r.Msg)
+			if r.Kind == "esp" && info.Event == "handshake_ok" {
+				sc.deviceID = info.DeviceID
+			}
+			if r.Kind == "frontend" {
+				sc.expect[info.signature(info.DeviceID)]++
+			}
+			if !noSync[info.Event] {
+				received[r.Conn][info.Event]++
+			}
+
+		case capture.In, capture.Closed:
+			sc.steps = append(sc.steps, step{at: at, dir: r.Dir, msg: r.Msg, need: maps.Clone(received[r.Conn])})
+		}
+	}
+
+	return order
+}
+
+// msgInfo is what the replay looks at in a message, the payload itself is
+// passed through.
+type msgInfo struct {
+	Event         string `json:"event"`
+	DeviceID      int    `json:"device_id"`
+	MovementID    int    `json:"movement_id"`
+	Rep           int    `json:"rep"`
+	ClassID       int    `json:"class_id"`
+	Status        string `json:"status"`
+	T1            int64  `json:"t1"`
+	ConfigVersion int    `json:"config_version"`
+}
+
+func parseInfo(b []byte) msgInfo {
+	var m msgInfo
+	json.Unmarshal(b, &m)
+	return m
+}
+
+// signature identifies a frontend event for the comparison, deviceID is the
+// recorded id.
+func (m msgInfo) signature(deviceID int) string {
+	return fmt.Sprintf("%s device=%d movement=%d rep=%d class=%d status=%s",
+		m.Event, deviceID, m.MovementID, m.Rep, m.ClassID, m.Status)
+}
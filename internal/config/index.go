@@ -0,0 +1,307 @@
+// Package config holds every setting of the backend. Values come from, in
+// increasing priority: the defaults below, a TOML file, environment variables
+// and command line flags.
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Field tags:
+//
+//	toml   key inside its [section], the flag is -section.key
+//	env    environment variable, the names docker-compose already used
+//	secret value is shown as "***" by Redacted
+type Config struct {
+	Server   Server   `toml:"server" json:"server"`
+	DB       DB       `toml:"db" json:"db"`
+	ML       ML       `toml:"ml" json:"ml"`
+	Auth     Auth     `toml:"auth" json:"auth"`
+	Log      Log      `toml:"log" json:"log"`
+	Tracing  Tracing  `toml:"tracing" json:"tracing"`
+	Training Training `toml:"training" json:"training"`
+	Devices  Devices  `toml:"devices" json:"devices"`
+	WS       WS       `toml:"ws" json:"ws"`
+}
+
+type Server struct {
+	Addr string `toml:"addr" env:"LISTEN_ADDR" json:"addr"`
+	// the whole shutdown has to fit in ShutdownTimeout, ShutdownDrain of it
+	// is spent waiting for packets sent before the ESPs got the stop
+	ShutdownTimeout Duration `toml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" json:"shutdown_timeout"`
+	ShutdownDrain   Duration `toml:"shutdown_drain" env:"SHUTDOWN_DRAIN" json:"shutdown_drain"`
+}
+
+type DB struct {
+	Host    string `toml:"host" env:"DB_HOST" json:"host"`
+	Port    int    `toml:"port" env:"DB_PORT" json:"port"`
+	User    string `toml:"user" env:"DB_USER" json:"user"`
+	Pass    string `toml:"pass" env:"DB_PASS" secret:"true" json:"pass"`
+	Name    string `toml:"name" env:"DB_NAME" json:"name"`
+	SSLMode string `toml:"sslmode" env:"DB_SSLMODE" json:"sslmode"`
+	// how long startup waits for postgres to answer
+	WaitTimeout Duration `toml:"wait_timeout" env:"DB_WAIT_TIMEOUT" json:"wait_timeout"`
+}
+
+// DSN is the lib/pq connection string.
+func (d DB) DSN() string {
+	return fmt.Sprintf(
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
+		d.Host, d.Port, d.User, d.Pass, d.Name, d.SSLMode,
+	)
+}
+
+type ML struct {
+	// URL wins over Host and Port when set
+	URL     string   `toml:"url" env:"ML_URL" json:"url"`
+	Host    string   `toml:"host" env:"ML_HOST" json:"host"`
+	Port    int      `toml:"port" env:"ML_PORT" json:"port"`
+	Timeout Duration `toml:"timeout" env:"ML_TIMEOUT" json:"timeout"`
+}
+
+// BaseURL is where the ML service answers, without a trailing slash.
+func (m ML) BaseURL() string {
+	if m.URL != "" {
+		return m.URL
+	}
+	return fmt.Sprintf("http://%s:%d", m.Host, m.Port)
+}
+
+type Auth struct {
+	Disabled        bool     `toml:"disabled" env:"AUTH_DISABLED" json:"disabled"`
+	JWTSecret       string   `toml:"jwt_secret" env:"AUTH_JWT_SECRET" secret:"true" json:"jwt_secret"`
+	APIKeys         string   `toml:"api_keys" env:"AUTH_API_KEYS" secret:"true" json:"api_keys"` // key:subject[:role],...
+	AllowedOrigins  []string `toml:"allowed_origins" env:"ALLOWED_ORIGINS" json:"allowed_origins"`
+	ESPEnrollSecret string   `toml:"esp_enroll_secret" env:"ESP_ENROLL_SECRET" secret:"true" json:"esp_enroll_secret"`
+}
+
+type Log struct {
+	Format string `toml:"format" env:"LOG_FORMAT" json:"format"` // text or json
+	Level  string `toml:"level" env:"LOG_LEVEL" json:"level"`
+}
+
+type Tracing struct {
+	Exporter    string  `toml:"exporter" env:"TRACING_EXPORTER" json:"exporter"` // none, stdout or otlp
+	Endpoint    string  `toml:"endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" json:"endpoint"`
+	SampleRatio float64 `toml:"sample_ratio" env:"TRACING_SAMPLE_RATIO" json:"sample_ratio"`
+}
+
+type Training struct {
+	Repetitions  int      `toml:"repetitions" env:"TRAINING_REPETITIONS" json:"repetitions"`
+	RepDuration  Duration `toml:"rep_duration" env:"TRAINING_REP_DURATION" json:"rep_duration"` // whole seconds, the ESP counts in seconds
+	RestDuration Duration `toml:"calibration_rest" env:"CALIBRATION_REST_DURATION" json:"calibration_rest"`
+	MVCDuration  Duration `toml:"calibration_mvc" env:"CALIBRATION_MVC_DURATION" json:"calibration_mvc"`
+	ResumePolicy string   `toml:"resume_policy" env:"SESSION_RESUME_POLICY" json:"resume_policy"` // discard or continue
+	OnsetMethod  string   `toml:"onset_method" env:"ONSET_METHOD" json:"onset_method"`            // envelope or tkeo
+	SessionTTL   Duration `toml:"session_ttl" env:"SESSION_TTL" json:"session_ttl"`
+}
+
+type Devices struct {
+	SweepInterval     Duration `toml:"sweep_interval" env:"DEVICE_SWEEP_INTERVAL" json:"sweep_interval"`
+	DisconnectTimeout Duration `toml:"disconnect_timeout" env:"DEVICE_DISCONNECT_TIMEOUT" json:"disconnect_timeout"`
+	ControlExpiry     Duration `toml:"control_expiry_interval" env:"CONTROL_EXPIRY_INTERVAL" json:"control_expiry_interval"`
+}
+
+type WS struct {
+	ESPReadBuffer       int `toml:"esp_read_buffer" env:"WS_ESP_READ_BUFFER" json:"esp_read_buffer"`
+	ESPWriteBuffer      int `toml:"esp_write_buffer" env:"WS_ESP_WRITE_BUFFER" json:"esp_write_buffer"`
+	ESPSendQueue        int `toml:"esp_send_queue" env:"WS_ESP_SEND_QUEUE" json:"esp_send_queue"`
+	FrontendReadBuffer  int `toml:"frontend_read_buffer" env:"WS_FRONTEND_READ_BUFFER" json:"frontend_read_buffer"`
+	FrontendWriteBuffer int `toml:"frontend_write_buffer" env:"WS_FRONTEND_WRITE_BUFFER" json:"frontend_write_buffer"`
+	FrontendSendQueue   int `toml:"frontend_send_queue" env:"WS_FRONTEND_SEND_QUEUE" json:"frontend_send_queue"`
+	// every message of both sockets is appended here when set, cmd/wsreplay
+	// plays the file back
+	RecordFile string `toml:"record_file" env:"WS_RECORD_FILE" json:"record_file"`
+}
+
+// Default is what runs when nothing is configured, the values the backend
+// had hard coded before.
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Addr:            ":8080",
+			ShutdownTimeout: Duration(15 * time.Second),
+			ShutdownDrain:   Duration(time.Second),
+		},
+		DB: DB{
+			Host:        "localhost",
+			Port:        5432,
+			SSLMode:     "disable",
+			WaitTimeout: Duration(2 * time.Minute),
+		},
+		ML: ML{
+			Host:    "emg-ml",
+			Port:    8000,
+			Timeout: Duration(2 * time.Second),
+		},
+		Log: Log{Format: "text", Level: "info"},
+		Tracing: Tracing{
+			Exporter:    "none",
+			SampleRatio: 1,
+		},
+		Training: Training{
+			Repetitions:  5,
+			RepDuration:  Duration(5 * time.Second),
+			RestDuration: Duration(5 * time.Second),
+			MVCDuration:  Duration(3 * time.Second),
+			ResumePolicy: "discard",
+			OnsetMethod:  "envelope",
+			SessionTTL:   Duration(2 * time.Hour),
+		},
+		Devices: Devices{
+			SweepInterval:     Duration(10 * time.Second),
+			DisconnectTimeout: Duration(45 * time.Second),
+			ControlExpiry:     Duration(5 * time.Second),
+		},
+		WS: WS{
+			ESPReadBuffer:       2048,
+			ESPWriteBuffer:      2048,
+			ESPSendQueue:        32,
+			FrontendReadBuffer:  1024,
+			FrontendWriteBuffer: 1024,
+			FrontendSendQueue:   64,
+		},
+	}
+}
+
+// Validate reports every invalid value at once.
+func (c *Config) Validate() error {
+	var errs []string
+	bad := func(format string, args ...any) {
+		errs = append(errs, fmt.Sprintf(format, args...))
+	}
+
+	if c.Server.Addr == "" {
+		bad("server.addr is empty")
+	}
+	if c.Server.ShutdownTimeout <= 0 || c.Server.ShutdownDrain < 0 || c.Server.ShutdownDrain >= c.Server.ShutdownTimeout {
+		bad("server.shutdown_drain must be shorter than a positive server.shutdown_timeout")
+	}
+
+	if c.DB.Host == "" || c.DB.Name == "" || c.DB.User == "" {
+		bad("db.host, db.name and db.user are required")
+	}
+	if c.DB.Port <= 0 || c.DB.Port > 65535 {
+		bad("db.port %d out of range", c.DB.Port)
+	}
+	if c.DB.WaitTimeout <= 0 {
+		bad("db.wait_timeout must be positive")
+	}
+
+	if c.ML.URL != "" {
+		if u, err := url.Parse(c.ML.URL); err != nil || u.Scheme == "" || u.Host == "" {
+			bad("ml.url %q is not an absolute URL", c.ML.URL)
+		}
+	} else if c.ML.Host == "" || c.ML.Port <= 0 || c.ML.Port > 65535 {
+		bad("ml.url or ml.host and ml.port are required")
+	}
+	if c.ML.Timeout <= 0 {
+		bad("ml.timeout must be positive")
+	}
+
+	switch c.Log.Format {
+	case "text", "json":
+	default:
+		bad("log.format %q, want text or json", c.Log.Format)
+	}
+	switch c.Log.Level {
+	case "debug", "info", "warn", "error":
+	default:
+		bad("log.level %q, want debug, info, warn or error", c.Log.Level)
+	}
+
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "otlp":
+		if c.Tracing.Endpoint == "" {
+			bad("tracing.endpoint is required for the otlp exporter")
+		}
+	default:
+		bad("tracing.exporter %q, want none, stdout or otlp", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		bad("tracing.sample_ratio %v out of [0, 1]", c.Tracing.SampleRatio)
+	}
+
+	t := c.Training
+	if t.Repetitions < 1 {
+		bad("training.repetitions must be at least 1")
+	}
+	for name, d := range map[string]Duration{
+		"training.rep_duration":     t.RepDuration,
+		"training.calibration_rest": t.RestDuration,
+		"training.calibration_mvc":  t.MVCDuration,
+	} {
+		if d < Duration(time.Second) || time.Duration(d)%time.Second != 0 {
+			bad("%s must be whole seconds, at least 1s", name)
+		}
+	}
+	switch t.ResumePolicy {
+	case "discard", "continue":
+	default:
+		bad("training.resume_policy %q, want discard or continue", t.ResumePolicy)
+	}
+	switch t.OnsetMethod {
+	case "envelope", "tkeo":
+	default:
+		bad("training.onset_method %q, want envelope or tkeo", t.OnsetMethod)
+	}
+	if t.SessionTTL <= 0 {
+		bad("training.session_ttl must be positive")
+	}
+
+	d := c.Devices
+	if d.SweepInterval <= 0 || d.DisconnectTimeout <= 0 || d.ControlExpiry <= 0 {
+		bad("devices intervals must be positive")
+	}
+	if d.DisconnectTimeout < d.SweepInterval {
+		bad("devices.disconnect_timeout must not be shorter than devices.sweep_interval")
+	}
+
+	w := c.WS
+	for name, n := range map[string]int{
+		"ws.esp_read_buffer":       w.ESPReadBuffer,
+		"ws.esp_write_buffer":      w.ESPWriteBuffer,
+		"ws.esp_send_queue":        w.ESPSendQueue,
+		"ws.frontend_read_buffer":  w.FrontendReadBuffer,
+		"ws.frontend_write_buffer": w.FrontendWriteBuffer,
+		"ws.frontend_send_queue":   w.FrontendSendQueue,
+	} {
+		if n <= 0 {
+			bad("%s must be positive", name)
+		}
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+
+	sort.Strings(errs)
+	return fmt.Errorf("invalid config:\n  %s", strings.Join(errs, "\n  "))
+}
+
+// ValidateAuth is the part of the validation that needs the database: with
+// auth on, somebody has to be able to log in. users is the number of rows in
+// the users table.
+func (c *Config) ValidateAuth(users int) error {
+	a := c.Auth
+	if a.Disabled || a.APIKeys != "" || a.JWTSecret != "" || users > 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid config: auth is enabled but auth.api_keys, auth.jwt_secret and the users table are empty, nobody can log in")
+}
+
+// Handler serves the redacted config as JSON.
+func (c *Config) Handler() http.HandlerFunc {
+	red := c.Redacted()
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(red)
+	}
+}
@@ -0,0 +1,223 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration written as "5s" or "2m" in files, env, flags
+// and the /config output.
+type Duration time.Duration
+
+func (d Duration) String() string { return time.Duration(d).String() }
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalText(b []byte) error {
+	v, err := time.ParseDuration(string(b))
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Load builds the config from defaults, the file given by -config or
+// CONFIG_FILE, the environment and args (without the program name), then
+// validates it.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("emg-backend", flag.ContinueOnError)
+	path := fs.String("config", getenv("CONFIG_FILE"), "TOML config file")
+
+	fields := leaves(cfg)
+	given := map[string]string{}
+	for _, f := range fields {
+		fs.Var(flagValue{f: f, given: given}, f.key, f.usage())
+	}
+
+	// flags are parsed now to know the file, they are applied last
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		f, err := os.Open(*path)
+		if err != nil {
+			return nil, err
+		}
+		err = applyTOML(f, cfg)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", *path, err)
+		}
+	}
+
+	for _, f := range fields {
+		if f.env == "" {
+			continue
+		}
+		if v := getenv(f.env); v != "" {
+			if err := f.set(v); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.env, err)
+			}
+		}
+	}
+
+	for _, f := range fields {
+		if v, ok := given[f.key]; ok {
+			if err := f.set(v); err != nil {
+				return nil, fmt.Errorf("-%s: %w", f.key, err)
+			}
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// field is one settable value, key is "section.name".
+type field struct {
+	key    string
+	env    string
+	secret bool
+	v      reflect.Value
+}
+
+func (f field) usage() string {
+	if f.env == "" {
+		return f.key
+	}
+	return f.key + ", env " + f.env
+}
+
+func leaves(cfg *Config) []field {
+	var out []field
+
+	root := reflect.ValueOf(cfg).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Type().Field(i).Tag.Get("toml")
+		sv := root.Field(i)
+
+		for j := 0; j < sv.NumField(); j++ {
+			sf := sv.Type().Field(j)
+			out = append(out, field{
+				key:    section + "." + sf.Tag.Get("toml"),
+				env:    sf.Tag.Get("env"),
+				secret: sf.Tag.Get("secret") == "true",
+				v:      sv.Field(j),
+			})
+		}
+	}
+
+	return out
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+func (f field) set(s string) error {
+	s = strings.TrimSpace(s)
+
+	if f.v.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetInt(int64(d))
+		return nil
+	}
+
+	switch f.v.Kind() {
+	case reflect.String:
+		f.v.SetString(s)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetInt(int64(n))
+	case reflect.Float64:
+		x, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		f.v.SetFloat(x)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		f.v.SetBool(b)
+	case reflect.Slice:
+		var items []string
+		for _, it := range strings.Split(s, ",") {
+			if it = strings.TrimSpace(it); it != "" {
+				items = append(items, it)
+			}
+		}
+		f.v.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("unsupported type %s", f.v.Type())
+	}
+
+	return nil
+}
+
+func (f field) String() string {
+	if !f.v.IsValid() {
+		return ""
+	}
+	if f.v.Type() == durationType {
+		return Duration(f.v.Int()).String()
+	}
+	if f.v.Kind() == reflect.Slice {
+		return strings.Join(f.v.Interface().([]string), ",")
+	}
+	return fmt.Sprint(f.v.Interface())
+}
+
+// flagValue keeps what was given on the command line so it can be applied
+// after the file and the environment. Set only checks that it parses.
+type flagValue struct {
+	f     field
+	given map[string]string
+}
+
+func (fv flagValue) String() string { return fv.f.String() }
+
+func (fv flagValue) Set(s string) error {
+	scratch := fv.f
+	scratch.v = reflect.New(fv.f.v.Type()).Elem()
+	if err := scratch.set(s); err != nil {
+		return err
+	}
+	fv.given[fv.f.key] = s
+	return nil
+}
+
+// Redacted is the config with every secret that is set replaced by "***",
+// for /config.
+func (c *Config) Redacted() *Config {
+	cp := *c
+	cp.Auth.AllowedOrigins = append([]string(nil), c.Auth.AllowedOrigins...)
+
+	for _, f := range leaves(&cp) {
+		if f.secret && f.v.String() != "" {
+			f.v.SetString("***")
+		}
+	}
+
+	return &cp
+}
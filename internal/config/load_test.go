@@ -0,0 +1,183 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoad(t *testing.T) {
+	// db.user and db.name have no default, every case gives them
+	required := map[string]string{"DB_USER": "emg", "DB_NAME": "emg"}
+
+	tests := []struct {
+		name    string
+		file    string // written to a temp file and passed with -config
+		env     map[string]string
+		args    []string
+		want    func(*Config) // edits Default() into the expected config
+		wantErr string
+	}{
+		{
+			name: "defaults",
+			want: func(c *Config) {},
+		},
+		{
+			name: "file over defaults",
+			file: `
+[db]
+host = "file-host"  # comment
+port = 6543
+
+[auth]
+allowed_origins = ["http://a", "http://b"]
+api_keys = "k#1:ci:viewer"
+
+[training]
+session_ttl = "30m"
+`,
+			want: func(c *Config) {
+				c.DB.Host = "file-host"
+				c.DB.Port = 6543
+				c.Auth.AllowedOrigins = []string{"http://a", "http://b"}
+				c.Auth.APIKeys = "k#1:ci:viewer"
+				c.Training.SessionTTL = Duration(30 * time.Minute)
+			},
+		},
+		{
+			name: "env over file",
+			file: "[db]\nhost = \"file-host\"\nport = 6543\n",
+			env:  map[string]string{"DB_HOST": "env-host", "ALLOWED_ORIGINS": "http://a, http://b"},
+			want: func(c *Config) {
+				c.DB.Host = "env-host"
+				c.DB.Port = 6543
+				c.Auth.AllowedOrigins = []string{"http://a", "http://b"}
+			},
+		},
+		{
+			name: "flag over env",
+			file: "[db]\nhost = \"file-host\"\n",
+			env:  map[string]string{"DB_HOST": "env-host", "SESSION_TTL": "1h"},
+			args: []string{"-db.host", "flag-host", "-training.session_ttl", "10m"},
+			want: func(c *Config) {
+				c.DB.Host = "flag-host"
+				c.Training.SessionTTL = Duration(10 * time.Minute)
+			},
+		},
+		{
+			name:    "unknown key",
+			file:    "[db]\nhots = \"x\"\n",
+			wantErr: "unknown keys db.hots",
+		},
+		{
+			name:    "unknown section",
+			file:    "[database]\nhost = \"x\"\n",
+			wantErr: "unknown keys database",
+		},
+		{
+			name:    "wrong type in file",
+			file:    "[db]\nport = \"5432\"\n",
+			wantErr: "db.port",
+		},
+		{
+			name:    "bad duration in file",
+			file:    "[training]\nsession_ttl = \"2 hours\"\n",
+			wantErr: "session_ttl",
+		},
+		{
+			name:    "syntax error",
+			file:    "[db\nhost = \"x\"\n",
+			wantErr: "toml: line",
+		},
+		{
+			name:    "bad env",
+			env:     map[string]string{"DB_PORT": "postgres"},
+			wantErr: "DB_PORT",
+		},
+		{
+			name:    "bad flag",
+			args:    []string{"-ml.timeout", "soon"},
+			wantErr: "ml.timeout",
+		},
+		{
+			name:    "invalid after merging",
+			file:    "[tracing]\nexporter = \"otlp\"\n",
+			wantErr: "tracing.endpoint is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := map[string]string{}
+			for k, v := range required {
+				env[k] = v
+			}
+			for k, v := range tt.env {
+				env[k] = v
+			}
+
+			args := tt.args
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "config.toml")
+				if err := os.WriteFile(path, []byte(tt.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				args = append([]string{"-config", path}, args...)
+			}
+
+			got, err := Load(args, func(k string) string { return env[k] })
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := Default()
+			want.DB.User, want.DB.Name = "emg", "emg"
+			tt.want(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got  %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFileEnv(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	if err := os.WriteFile(path, []byte("[server]\naddr = \":9000\"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{"CONFIG_FILE": path, "DB_USER": "emg", "DB_NAME": "emg"}
+
+	cfg, err := Load(nil, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Addr != ":9000" {
+		t.Errorf("server.addr %q, want :9000 from CONFIG_FILE", cfg.Server.Addr)
+	}
+}
+
+// the example documents every key with its default
+func TestExampleFile(t *testing.T) {
+	env := map[string]string{"DB_USER": "emg", "DB_NAME": "emg"}
+
+	cfg, err := Load([]string{"-config", "../../config.example.toml"}, func(k string) string { return env[k] })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Default()
+	want.DB.User, want.DB.Name = "emg", "emg"
+	want.Auth.AllowedOrigins = []string{}
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("example differs from the defaults\ngot  %+v\nwant %+v", cfg, want)
+	}
+}
@@ -0,0 +1,28 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// applyTOML decodes a TOML file over the values cfg already has, keys it
+// leaves out keep them. Unknown keys are errors so typos don't go unnoticed.
+func applyTOML(r io.Reader, cfg *Config) error {
+	md, err := toml.NewDecoder(r).Decode(cfg)
+	if err != nil {
+		return err
+	}
+
+	if keys := md.Undecoded(); len(keys) > 0 {
+		names := make([]string, len(keys))
+		for i, k := range keys {
+			names[i] = k.String()
+		}
+		return fmt.Errorf("unknown keys %s", strings.Join(names, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package httpH
+
+import (
+	"emg_esp32_classifier_backend/pkg/auth"
+	"emg_esp32_classifier_backend/pkg/models"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DeviceConfig serves GET and PUT /device/{id}/config.
+func (h *HTTPHandler) DeviceConfig(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/device/")
+	id = strings.TrimSuffix(id, "/config")
+
+	deviceID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		v, err := h.svc.GetDeviceConfig(r.Context(), deviceID)
+		if err != nil {
+			http.Error(w, "failed to get device config: "+err.Error(), errorStatus(err))
+			return
+		}
+		jsonResponse(w, v)
+
+	case http.MethodPut:
+		var cfg models.DeviceConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		v, pushed, err := h.svc.SetDeviceConfig(r.Context(), deviceID, cfg, auth.ClientID(r))
+		if err != nil {
+			http.Error(w, "failed to set device config: "+err.Error(), errorStatus(err))
+			return
+		}
+
+		jsonResponse(w, map[string]any{
+			"config": v,
+			"pushed": pushed,
+		})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *HTTPHandler) GetDeviceConfigHistory(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/device/")
+	id = strings.TrimSuffix(id, "/config/history")
+
+	deviceID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	history, err := h.svc.GetDeviceConfigHistory(r.Context(), deviceID)
+	if err != nil {
+		http.Error(w, "failed to get config history: "+err.Error(), errorStatus(err))
+		return
+	}
+
+	jsonResponse(w, history)
+}
@@ -0,0 +1,146 @@
+package httpH
+
+import (
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/logging"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type provisionRequest struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+// ProvisionDevice serves POST /devices. The token is shown only once.
+func (h *HTTPHandler) ProvisionDevice(w http.ResponseWriter, r *http.Request) {
+	var req provisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	dev, token, err := h.svc.ProvisionDevice(r.Context(), req.Name, req.Tags)
+	if err != nil {
+		http.Error(w, "failed to provision device: "+err.Error(), errorStatus(err))
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	jsonResponse(w, map[string]any{
+		"device": dev,
+		"token":  token,
+	})
+}
+
+// Device serves GET, PATCH and DELETE /device/{id}.
+func (h *HTTPHandler) Device(w http.ResponseWriter, r *http.Request) {
+	deviceID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/device/"))
+	if err != nil {
+		http.Error(w, "invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		dev, err := h.svc.GetDevice(r.Context(), deviceID)
+		if err != nil {
+			http.Error(w, "failed to get device: "+err.Error(), errorStatus(err))
+			return
+		}
+		jsonResponse(w, dev)
+
+	case http.MethodPatch:
+		var req dto.DeviceUpdate
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		dev, err := h.svc.UpdateDevice(r.Context(), deviceID, req)
+		if err != nil {
+			http.Error(w, "failed to update device: "+err.Error(), errorStatus(err))
+			return
+		}
+		jsonResponse(w, dev)
+
+	case http.MethodDelete:
+		if err := h.svc.DeleteDevice(r.Context(), deviceID); err != nil {
+			http.Error(w, "failed to delete device: "+err.Error(), errorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// RotateDeviceToken serves POST /device/{id}/token.
+func (h *HTTPHandler) RotateDeviceToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/device/")
+	id = strings.TrimSuffix(id, "/token")
+
+	deviceID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	token, err := h.svc.RotateDeviceToken(r.Context(), deviceID)
+	if err != nil {
+		http.Error(w, "failed to rotate token: "+err.Error(), errorStatus(err))
+		return
+	}
+
+	jsonResponse(w, map[string]any{
+		"device_id": deviceID,
+		"token":     token,
+	})
+}
+
+// DeviceDebug serves GET and PUT /device/{id}/debug, PUT takes {"enabled": true}.
+func (h *HTTPHandler) DeviceDebug(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/device/")
+	id = strings.TrimSuffix(id, "/debug")
+
+	deviceID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+
+	case http.MethodPut:
+		var req struct {
+			Enabled bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := h.svc.SetDeviceDebug(r.Context(), deviceID, req.Enabled); err != nil {
+			http.Error(w, "failed to set debug logging: "+err.Error(), errorStatus(err))
+			return
+		}
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jsonResponse(w, map[string]any{
+		"device_id": deviceID,
+		"enabled":   logging.DeviceDebug(deviceID),
+	})
+}
@@ -2,10 +2,14 @@ package httpH
 
 import (
 	"emg_esp32_classifier_backend/internal/svc"
+	"emg_esp32_classifier_backend/pkg/auth"
+	"emg_esp32_classifier_backend/pkg/cerrors"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type HTTPHandler struct {
@@ -37,7 +41,9 @@ func (h *HTTPHandler) GetMovements(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *HTTPHandler) GetTrainingRawCSV(w http.ResponseWriter, r *http.Request) {
-	data, err := h.svc.GetTrainingRawCSV(r.Context())
+	query := r.URL.Query()
+
+	data, err := h.svc.GetTrainingRawCSV(r.Context(), query.Get("normalize") == "true", query.Get("active_only") == "true")
 	if err != nil {
 		http.Error(w, "failed to generate CSV: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -58,18 +64,146 @@ func (h *HTTPHandler) ReserveDevice(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ttl := svc.DefaultReservationTTL
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec <= 0 || time.Duration(sec)*time.Second > svc.MaxReservationTTL {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+		ttl = time.Duration(sec) * time.Second
+	}
+
 	// вызываем сервис
-	if err := h.svc.ReserveDevice(r.Context(), deviceID); err != nil {
-		http.Error(w, "failed to reserve device: "+err.Error(), http.StatusInternalServerError)
+	res, err := h.svc.ReserveDevice(r.Context(), deviceID, auth.ClientID(r), ttl)
+	if err != nil {
+		http.Error(w, "failed to reserve device: "+err.Error(), errorStatus(err))
+		return
+	}
+
+	jsonResponse(w, map[string]any{
+		"status":      "reserved",
+		"device_id":   deviceID,
+		"owner":       res.Owner,
+		"expires_at":  res.ExpiresAt,
+		"ttl_seconds": int(time.Until(res.ExpiresAt).Seconds()),
+	})
+}
+
+func (h *HTTPHandler) ReleaseDevice(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/device/")
+	id = strings.TrimSuffix(id, "/release")
+
+	deviceID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	if err := h.svc.ReleaseDevice(r.Context(), deviceID, auth.ClientID(r)); err != nil {
+		http.Error(w, "failed to release device: "+err.Error(), errorStatus(err))
 		return
 	}
 
 	jsonResponse(w, map[string]any{
-		"status":    "reserved",
+		"status":    "released",
 		"device_id": deviceID,
 	})
 }
 
+func (h *HTTPHandler) GetClockSync(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/device/")
+	id = strings.TrimSuffix(id, "/clock")
+
+	deviceID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	res, err := h.svc.GetClockSync(r.Context(), deviceID)
+	if err != nil {
+		http.Error(w, "failed to get clock sync: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	jsonResponse(w, res)
+}
+
+func (h *HTTPHandler) GetTrainingQuality(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/training/")
+	id = strings.TrimSuffix(id, "/quality")
+
+	trainingID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "invalid training ID", http.StatusBadRequest)
+		return
+	}
+
+	reps, err := h.svc.GetTrainingQuality(r.Context(), trainingID)
+	if err != nil {
+		http.Error(w, "failed to get training quality: "+err.Error(), errorStatus(err))
+		return
+	}
+
+	jsonResponse(w, reps)
+}
+
+func (h *HTTPHandler) GetTrainingSegments(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/training/")
+	id = strings.TrimSuffix(id, "/segments")
+
+	trainingID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "invalid training ID", http.StatusBadRequest)
+		return
+	}
+
+	segs, err := h.svc.GetTrainingSegments(r.Context(), trainingID)
+	if err != nil {
+		http.Error(w, "failed to get training segments: "+err.Error(), errorStatus(err))
+		return
+	}
+
+	jsonResponse(w, segs)
+}
+
+func (h *HTTPHandler) GetCalibrations(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/device/")
+	id = strings.TrimSuffix(id, "/calibrations")
+
+	deviceID, err := strconv.Atoi(id)
+	if err != nil {
+		http.Error(w, "invalid device ID", http.StatusBadRequest)
+		return
+	}
+
+	list, err := h.svc.ListCalibrations(r.Context(), deviceID)
+	if err != nil {
+		http.Error(w, "failed to get calibrations: "+err.Error(), errorStatus(err))
+		return
+	}
+
+	jsonResponse(w, list)
+}
+
+// errorStatus maps service errors to HTTP status codes.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, cerrors.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, cerrors.ErrReservationConflict), errors.Is(err, cerrors.ErrDeviceBusy):
+		return http.StatusConflict
+	case errors.Is(err, cerrors.ErrAlreadyExists), errors.Is(err, cerrors.ErrDeviceHasData), errors.Is(err, cerrors.ErrDeviceDisabled):
+		return http.StatusConflict
+	case errors.Is(err, cerrors.ErrNoClientID), errors.Is(err, cerrors.ErrInvalidRole), errors.Is(err, cerrors.ErrInvalidName),
+		errors.Is(err, cerrors.ErrInvalidConfig), errors.Is(err, cerrors.ErrInvalidCalibration):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func jsonResponse(w http.ResponseWriter, data any) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(data)
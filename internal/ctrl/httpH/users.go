@@ -0,0 +1,83 @@
+package httpH
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type userRequest struct {
+	Name string `json:"name"`
+	Role string `json:"role"`
+}
+
+// Users serves GET and POST /users.
+func (h *HTTPHandler) Users(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		users, err := h.svc.ListUsers(r.Context())
+		if err != nil {
+			http.Error(w, "failed to list users: "+err.Error(), errorStatus(err))
+			return
+		}
+		jsonResponse(w, users)
+
+	case http.MethodPost:
+		var req userRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		u, key, err := h.svc.CreateUser(r.Context(), req.Name, req.Role)
+		if err != nil {
+			http.Error(w, "failed to create user: "+err.Error(), errorStatus(err))
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		jsonResponse(w, map[string]any{
+			"user":    u,
+			"api_key": key,
+		})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// User serves PATCH and DELETE /users/{id}.
+func (h *HTTPHandler) User(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/users/"))
+	if err != nil {
+		http.Error(w, "invalid user ID", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPatch:
+		var req userRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		u, err := h.svc.UpdateUserRole(r.Context(), userID, req.Role)
+		if err != nil {
+			http.Error(w, "failed to update user: "+err.Error(), errorStatus(err))
+			return
+		}
+		jsonResponse(w, u)
+
+	case http.MethodDelete:
+		if err := h.svc.DeleteUser(r.Context(), userID); err != nil {
+			http.Error(w, "failed to delete user: "+err.Error(), errorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
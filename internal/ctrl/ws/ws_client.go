@@ -0,0 +1,184 @@
+package ws
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/capture"
+
+	"github.com/gorilla/websocket"
+)
+
+// SlowConsumerPolicy says what happens when a client's send queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// DropOldest throws away the oldest queued message, fine for frontends
+	// where a newer raw/prediction packet replaces the old one anyway.
+	DropOldest SlowConsumerPolicy = iota
+	// Disconnect closes the connection, used for ESPs where a lost command
+	// would leave the device in the wrong state.
+	Disconnect
+)
+
+// set by Configure
+var (
+	frontendSendQueue = 64
+	espSendQueue      = 32
+)
+
+var clientSeq atomic.Int64
+
+// Client owns all writes to a connection. gorilla connections allow only one
+// concurrent writer, so everything goes through send and writePump.
+type Client struct {
+	conn   *websocket.Conn
+	id     string
+	name   string
+	send   chan []byte
+	policy SlowConsumerPolicy
+
+	// canControl: frontend whose role allows driving devices, only these are
+	// promoted to master
+	canControl bool
+
+	mu        sync.Mutex // serialises Send so drop-oldest can't race itself
+	done      chan struct{}
+	closeOnce sync.Once
+	closeCode int // sent in the close frame, set before done is closed
+	closeText string
+}
+
+func newClient(conn *websocket.Conn, name string, queue int, policy SlowConsumerPolicy) *Client {
+	c := &Client{
+		conn:   conn,
+		id:     fmt.Sprintf("%s-%d", strings.ToLower(name), clientSeq.Add(1)),
+		name:   name,
+		send:   make(chan []byte, queue),
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+
+	go c.writePump()
+
+	return c
+}
+
+// Send never blocks. It reports false when the message was not queued or an
+// older one had to be dropped for it.
+func (c *Client) Send(data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- data:
+		return true
+	default:
+	}
+
+	droppedMessages.WithLabelValues(strings.ToLower(c.name)).Inc()
+
+	if c.policy == Disconnect {
+		slog.Warn("send queue full, disconnecting", "conn_id", c.id)
+		c.Close()
+		return false
+	}
+
+	select {
+	case <-c.send:
+	default:
+	}
+
+	select {
+	case c.send <- data:
+	default:
+	}
+
+	return false
+}
+
+// Close stops the writer and closes the socket, the read loop then fails and
+// runs the handler's cleanup. Safe to call more than once.
+func (c *Client) Close() {
+	c.CloseWith(websocket.CloseNormalClosure, "")
+}
+
+// CloseWith is Close with a close code and reason, only the first call of
+// either counts.
+func (c *Client) CloseWith(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeText = text
+		close(c.done)
+	})
+}
+
+// Done is closed once the client is closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) writePump() {
+	t := time.NewTicker(pingPeriod)
+	defer func() {
+		t.Stop()
+		c.conn.Close()
+		record(c, capture.Closed, time.Now(), nil)
+	}()
+
+	for {
+		select {
+		case <-c.done:
+			c.flush()
+			c.conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(c.closeCode, c.closeText),
+				time.Now().Add(writeWait),
+			)
+			return
+
+		case data := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				slog.Info("write failed", "conn_id", c.id, "err", err)
+				c.Close()
+				return
+			}
+			record(c, capture.Out, time.Now(), data)
+
+		case <-t.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// flush writes what is still queued, e.g. the stop command sent right before
+// a shutdown closes the socket. It gives up with the first failed write.
+func (c *Client) flush() {
+	c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	for {
+		select {
+		case data := <-c.send:
+			if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+				return
+			}
+			record(c, capture.Out, time.Now(), data)
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package ws
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/models"
+)
+
+// controlLeaseTTL is how long control is kept without control_heartbeat or a
+// command from the master.
+const controlLeaseTTL = 30 * time.Second
+
+type controlLease struct {
+	client  *Client
+	expires time.Time
+}
+
+func (l *controlLease) expired(now time.Time) bool {
+	return now.After(l.expires)
+}
+
+// AcquireControl makes c the master of the device if nobody holds a valid
+// lease, a master acquiring again just renews. It reports whether c is the
+// master afterwards.
+func (h *Hub) AcquireControl(deviceID int, c *Client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+
+	if l := h.masterFrontend[deviceID]; l != nil && !l.expired(now) && l.client != c {
+		return false
+	}
+
+	h.setMasterLocked(deviceID, c, now)
+	return true
+}
+
+// RenewControl extends the lease, false when c is not the master.
+func (h *Hub) RenewControl(deviceID int, c *Client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l := h.masterFrontend[deviceID]
+	if l == nil || l.client != c || l.expired(time.Now()) {
+		return false
+	}
+
+	l.expires = time.Now().Add(controlLeaseTTL)
+	return true
+}
+
+// ReleaseControl gives control up, nobody is promoted.
+func (h *Hub) ReleaseControl(deviceID int, c *Client) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	l := h.masterFrontend[deviceID]
+	if l == nil || l.client != c {
+		return false
+	}
+
+	delete(h.masterFrontend, deviceID)
+	h.controlChangedLocked(deviceID)
+	return true
+}
+
+// TakeoverControl makes c the master regardless of the current lease, the
+// caller must check that c is allowed to.
+func (h *Hub) TakeoverControl(deviceID int, c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.setMasterLocked(deviceID, c, time.Now())
+}
+
+// IsMaster reports whether c holds a valid lease on the device.
+func (h *Hub) IsMaster(deviceID int, c *Client) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	l := h.masterFrontend[deviceID]
+	return l != nil && l.client == c && !l.expired(time.Now())
+}
+
+// ExpireControl drops leases that were not renewed in time.
+func (h *Hub) ExpireControl() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	for deviceID, l := range h.masterFrontend {
+		if !l.expired(now) {
+			continue
+		}
+
+		slog.Info("control lease expired", "device_id", deviceID, "conn_id", l.client.id)
+		delete(h.masterFrontend, deviceID)
+		h.controlChangedLocked(deviceID)
+	}
+}
+
+// RunControlExpiry blocks until ctx is done.
+func (h *Hub) RunControlExpiry(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			h.ExpireControl()
+		}
+	}
+}
+
+func (h *Hub) setMasterLocked(deviceID int, c *Client, now time.Time) {
+	prev := h.masterFrontend[deviceID]
+	h.masterFrontend[deviceID] = &controlLease{client: c, expires: now.Add(controlLeaseTTL)}
+
+	// the master always sees what it drives
+	subs, ok := h.frontend[deviceID]
+	if !ok {
+		subs = make(map[*Client]time.Time)
+		h.frontend[deviceID] = subs
+	}
+	if _, ok := subs[c]; !ok {
+		subs[c] = now
+	}
+
+	if prev == nil || prev.client != c {
+		h.controlChangedLocked(deviceID)
+	}
+}
+
+// promoteLocked hands control to the longest subscribed client that may
+// control devices, or frees it when there is none.
+func (h *Hub) promoteLocked(deviceID int) {
+	var (
+		next  *Client
+		since time.Time
+	)
+	for c, at := range h.frontend[deviceID] {
+		if !c.canControl {
+			continue
+		}
+		if next == nil || at.Before(since) {
+			next, since = c, at
+		}
+	}
+
+	if next == nil {
+		delete(h.masterFrontend, deviceID)
+		h.controlChangedLocked(deviceID)
+		return
+	}
+
+	slog.Info("control promoted", "device_id", deviceID, "conn_id", next.id)
+	h.setMasterLocked(deviceID, next, time.Now())
+}
+
+// controlChangedLocked tells every subscriber of the device who is in control
+// now, each one learns whether it is itself.
+func (h *Hub) controlChangedLocked(deviceID int) {
+	var holder *Client
+	if l := h.masterFrontend[deviceID]; l != nil {
+		holder = l.client
+	}
+
+	for c := range h.frontend[deviceID] {
+		msg := models.WsBackendToFrontend{
+			Event:     models.EventControlChanged,
+			DeviceID:  deviceID,
+			InControl: holder == c,
+		}
+		if holder != nil {
+			msg.Controller = holder.id
+		}
+
+		b, _ := json.Marshal(msg)
+		c.Send(b)
+	}
+}
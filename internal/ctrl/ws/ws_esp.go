@@ -3,13 +3,22 @@ package ws
 import (
 	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
+	"strconv"
+	"time"
 
 	"emg_esp32_classifier_backend/internal/svc"
+	"emg_esp32_classifier_backend/pkg/capture"
+	"emg_esp32_classifier_backend/pkg/cerrors"
+	"emg_esp32_classifier_backend/pkg/logging"
 	"emg_esp32_classifier_backend/pkg/models"
+	"emg_esp32_classifier_backend/pkg/tracing"
 
 	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type EspWSHandler struct {
@@ -21,79 +30,254 @@ func NewEspWSHandler(s *svc.Service, hub *Hub) *EspWSHandler {
 	return &EspWSHandler{svc: s, hub: hub}
 }
 
+const (
+	// first few pings go out quickly so timestamps are corrected early
+	timeSyncBurst         = 4
+	timeSyncBurstInterval = 250 * time.Millisecond
+	timeSyncInterval      = 15 * time.Second
+)
+
 var espUpgrader = websocket.Upgrader{
 	ReadBufferSize:  2048,
 	WriteBufferSize: 2048,
 	CheckOrigin:     func(r *http.Request) bool { return true },
 }
 
+// espConn is the state of one ESP socket, only touched by its read loop.
+type espConn struct {
+	client   *Client
+	ctx      context.Context // log fields of the connection, device_id after the handshake
+	deviceID int
+	syncing  bool
+}
+
 func (h *EspWSHandler) HandleEspWS(w http.ResponseWriter, r *http.Request) {
 	conn, err := espUpgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("[WS ESP] upgrade error: %v", err)
+		slog.Warn("esp upgrade", "err", err)
+		return
+	}
+	client := newClient(conn, "ESP", espSendQueue, Disconnect)
+	defer client.Close()
+
+	if !h.hub.track() {
+		client.CloseWith(websocket.CloseServiceRestart, shutdownReason)
 		return
 	}
-	defer conn.Close()
+	defer h.hub.untrack()
 
-	log.Println("[WS ESP] connected")
+	ec := &espConn{
+		client: client,
+		ctx:    logging.WithConn(context.Background(), client.id),
+	}
 
-	var deviceID int
+	slog.InfoContext(ec.ctx, "esp connected", "remote", r.RemoteAddr)
+
+	keepAlive(conn, func() {
+		if ec.deviceID == 0 {
+			return
+		}
+		if err := h.svc.DeviceSeen(ec.ctx, ec.deviceID); err != nil {
+			slog.ErrorContext(ec.ctx, "touch device", "err", err)
+		}
+	})
 
 	for {
 		_, data, err := conn.ReadMessage()
+		received := time.Now()
 		if err != nil {
-			log.Printf("[WS ESP] read error: %v", err)
+			slog.InfoContext(ec.ctx, "esp disconnected", "err", err)
 
-			if deviceID != 0 {
-				h.hub.RemoveESP(deviceID)
+			// a newer connection of the same device already took over
+			if ec.deviceID != 0 && h.hub.RemoveESP(ec.deviceID, client) {
+				if err := h.svc.DeviceDisconnected(ec.ctx, ec.deviceID); err != nil {
+					slog.ErrorContext(ec.ctx, "mark disconnected", "err", err)
+				}
 			}
 
-			conn.Close() // VERY IMPORTANT
 			return
 		}
 
-		var msg models.WsEspToBackend
-		if err := json.Unmarshal(data, &msg); err != nil {
-			h.writeError(conn, "invalid json: "+err.Error())
-			continue
+		// any traffic counts as alive, not only pongs
+		conn.SetReadDeadline(received.Add(pongWait))
+
+		record(client, capture.In, received, data)
+
+		if !h.handleMessage(ec, data, received) {
+			return
 		}
+	}
+}
 
-		ctx := context.Background()
+// handleMessage handles one message inside its own trace. It returns false
+// when the connection has to be closed.
+func (h *EspWSHandler) handleMessage(ec *espConn, data []byte, received time.Time) bool {
+	ctx, span := tracing.Start(ec.ctx, "esp.message", attribute.Int("bytes", len(data)))
+	defer span.End()
 
-		if msg.Event == models.HandShake {
-			deviceID, err = h.svc.RegisterDevice(ctx, msg.DeviceName)
-			if err != nil {
-				h.writeError(conn, "device registration failed: "+err.Error())
-				continue
-			}
+	_, decode := tracing.Start(ctx, "decode")
+	var msg models.WsEspToBackend
+	err := json.Unmarshal(data, &msg)
+	tracing.EndErr(decode, err)
+	if err != nil {
+		tracing.SetError(span, err)
+		h.writeError(ec.client, "invalid json: "+err.Error())
+		return true
+	}
 
-			h.hub.RegisterESP(deviceID, conn)
+	span.SetAttributes(attribute.String("event", string(msg.Event)))
+	ctx = logging.WithEvent(ctx, string(msg.Event))
 
-			log.Printf("[WS ESP] registered device %s → ID=%d", msg.DeviceName, deviceID)
+	if msg.Event == models.HandShake {
+		return h.handshake(ctx, ec, msg)
+	}
 
-			resp := map[string]any{"event": "handshake_ok", "device_id": deviceID}
-			b, _ := json.Marshal(resp)
-			conn.WriteMessage(websocket.TextMessage, b)
-			continue
-		}
+	if ec.deviceID == 0 {
+		return true
+	}
+
+	deviceID := ec.deviceID
 
-		if deviceID == 0 {
-			continue
+	span.SetAttributes(attribute.Int("device_id", deviceID))
+	espPackets.WithLabelValues(strconv.Itoa(deviceID)).Inc()
+
+	slog.DebugContext(ctx, "esp packet", "samples", len(msg.Raw), "bytes", len(data))
+
+	if msg.Event == models.EventTimeSyncReply {
+		if err := h.svc.WSTimeSyncReply(msg, deviceID, received); err != nil {
+			slog.WarnContext(ctx, "time sync", "err", err)
 		}
+		return true
+	}
 
-		resp, err := h.svc.WSRawStream(ctx, msg, deviceID)
+	if msg.Event == models.EventConfigAck {
+		resp, err := h.svc.WSConfigAck(ctx, msg, deviceID)
 		if err != nil {
-			h.writeError(conn, err.Error())
-			continue
+			tracing.SetError(span, err)
+			slog.ErrorContext(ctx, "config ack", "err", err)
+			return true
 		}
+		slog.InfoContext(ctx, resp.Message, "config_version", msg.ConfigVersion)
+		h.fanOut(ctx, deviceID, resp)
+		return true
+	}
+
+	resp, err := h.svc.WSRawStream(ctx, msg, deviceID)
+	if err != nil {
+		tracing.SetError(span, err)
+		slog.WarnContext(ctx, "esp packet rejected", "err", err)
+		h.writeError(ec.client, err.Error())
+		return true
+	}
+
+	h.fanOut(ctx, deviceID, resp)
+	return true
+}
+
+func (h *EspWSHandler) handshake(ctx context.Context, ec *espConn, msg models.WsEspToBackend) bool {
+	deviceID, err := h.svc.RegisterDevice(ctx, msg)
+	if errors.Is(err, cerrors.ErrDeviceUnauthorized) || errors.Is(err, cerrors.ErrDeviceDisabled) {
+		tracing.SetError(trace.SpanFromContext(ctx), err)
+		slog.WarnContext(ctx, "handshake rejected", "device_name", msg.DeviceName, "err", err)
+		h.writeError(ec.client, err.Error())
+		return false
+	}
+	if err != nil {
+		tracing.SetError(trace.SpanFromContext(ctx), err)
+		h.writeError(ec.client, "device registration failed: "+err.Error())
+		return true
+	}
 
-		b, _ := json.Marshal(resp)
-		h.hub.SendToFrontend(deviceID, b)
+	ec.deviceID = deviceID
+	ec.ctx = logging.WithDevice(ec.ctx, deviceID)
+	ctx = logging.WithDevice(ctx, deviceID)
+
+	if !ec.syncing {
+		ec.syncing = true
+		go h.syncClock(ec.ctx, deviceID, ec.client.Done())
+	}
+
+	h.hub.RegisterESP(deviceID, ec.client)
+
+	slog.InfoContext(ctx, "esp registered", "device_name", msg.DeviceName, "firmware", msg.FirmwareVersion)
+
+	resp := map[string]any{"event": "handshake_ok", "device_id": deviceID}
+	b, _ := json.Marshal(resp)
+	ec.client.Send(b)
+
+	h.pushConfig(ctx, deviceID)
+	h.resumeSession(ctx, deviceID)
+	return true
+}
+
+// fanOut sends resp to every frontend subscribed to the device.
+func (h *EspWSHandler) fanOut(ctx context.Context, deviceID int, resp *models.WsBackendToFrontend) {
+	_, span := tracing.Start(ctx, "hub.fanout")
+	defer span.End()
+
+	b, _ := json.Marshal(resp)
+	span.SetAttributes(attribute.Int("bytes", len(b)), attribute.Int("sent", h.hub.SendToFrontend(deviceID, b)))
+}
+
+// pushConfig re-sends the stored config, it is applied before any stream
+// command of resumeSession.
+func (h *EspWSHandler) pushConfig(ctx context.Context, deviceID int) {
+	cmd, err := h.svc.PendingConfig(ctx, deviceID)
+	if errors.Is(err, cerrors.ErrNotFound) {
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "load config", "err", err)
+		return
+	}
+
+	b, _ := json.Marshal(cmd)
+	h.hub.SendToESP(deviceID, b)
+}
+
+func (h *EspWSHandler) resumeSession(ctx context.Context, deviceID int) {
+	toEsp, toMaster, err := h.svc.ResumeSession(ctx, deviceID)
+	if err != nil {
+		slog.ErrorContext(ctx, "resume session", "err", err)
+		return
+	}
+
+	if toEsp != nil {
+		b, _ := json.Marshal(toEsp)
+		h.hub.SendToESP(deviceID, b)
+	}
+
+	if toMaster != nil {
+		slog.InfoContext(ctx, toMaster.Message)
+		b, _ := json.Marshal(toMaster)
+		h.hub.SendToMaster(deviceID, b)
+	}
+}
+
+// syncClock pings the ESP until the connection is gone, replies are handled
+// in the read loop.
+func (h *EspWSHandler) syncClock(ctx context.Context, deviceID int, done <-chan struct{}) {
+	for i := 0; ; i++ {
+		wait := timeSyncInterval
+		if i < timeSyncBurst {
+			wait = timeSyncBurstInterval
+		}
+
+		select {
+		case <-done:
+			return
+		case <-time.After(wait):
+		}
+
+		b, _ := json.Marshal(h.svc.WSTimeSyncRequest())
+		if !h.hub.SendToESP(deviceID, b) {
+			slog.WarnContext(ctx, "time sync not sent")
+		}
 	}
 }
 
-func (h *EspWSHandler) writeError(conn *websocket.Conn, msg string) {
+func (h *EspWSHandler) writeError(c *Client, msg string) {
 	resp := map[string]any{"event": "error", "error": msg}
 	b, _ := json.Marshal(resp)
-	conn.WriteMessage(websocket.TextMessage, b)
+	c.Send(b)
 }
@@ -3,11 +3,18 @@ package ws
 import (
 	"context"
 	"emg_esp32_classifier_backend/internal/svc"
+	"emg_esp32_classifier_backend/pkg/auth"
+	"emg_esp32_classifier_backend/pkg/capture"
+	"emg_esp32_classifier_backend/pkg/cerrors"
+	"emg_esp32_classifier_backend/pkg/logging"
 	"emg_esp32_classifier_backend/pkg/models"
+	"emg_esp32_classifier_backend/pkg/tracing"
 	"encoding/json"
 	"github.com/gorilla/websocket"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"log/slog"
 	"net/http"
+	"time"
 )
 
 type FrontendWSHandler struct {
@@ -28,78 +35,158 @@ var frontendUpgrader = websocket.Upgrader{
 func (h *FrontendWSHandler) HandleFrontendWS(w http.ResponseWriter, r *http.Request) {
 	conn, err := frontendUpgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("[WS FRONTEND] upgrade error: %v", err)
+		slog.Warn("frontend upgrade", "err", err)
 		return
 	}
-	defer conn.Close()
+	// the auth middleware already ran, the principal decides what the
+	// socket may do for its whole lifetime
+	principal, _ := auth.FromContext(r.Context())
 
-	log.Println("[WS FRONTEND] connected")
+	owner := auth.ClientID(r)
 
-	var deviceID int
+	client := newClient(conn, "FRONTEND", frontendSendQueue, DropOldest)
+	client.canControl = principal.Can(auth.PermControl)
+	defer client.Close()
+
+	if !h.hub.track() {
+		client.CloseWith(websocket.CloseServiceRestart, shutdownReason)
+		return
+	}
+	defer h.hub.untrack()
+
+	h.hub.AddFrontend(client)
+	defer h.hub.RemoveFrontend(client)
+
+	connCtx := logging.With(logging.WithConn(context.Background(), client.id), slog.String("owner", owner))
+
+	slog.InfoContext(connCtx, "frontend connected", "remote", r.RemoteAddr)
+
+	keepAlive(conn, nil)
 
 	for {
 		_, data, err := conn.ReadMessage()
 		if err != nil {
-			log.Printf("[WS FRONTEND] read error: %v", err)
+			slog.InfoContext(connCtx, "frontend disconnected", "err", err)
 			return
 		}
 
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+
+		record(client, capture.In, time.Now(), data)
+
 		var msg models.WsFrontendToBackend
 		if err := json.Unmarshal(data, &msg); err != nil {
-			h.writeError(conn, "invalid json: "+err.Error())
+			h.writeError(client, "invalid json: "+err.Error())
 			continue
 		}
 
-		deviceID = msg.DeviceID
+		deviceID := msg.DeviceID
 
-		h.hub.RegisterFrontend(deviceID, conn)
+		ctx := logging.WithEvent(logging.WithDevice(connCtx, deviceID), string(msg.Event))
+		slog.DebugContext(ctx, "frontend event")
 
-		h.hub.RegisterMasterFrontend(deviceID, conn)
+		switch msg.Event {
+		case models.EventSubscribe:
+			if !principal.Can(auth.PermView) {
+				h.writeError(client, cerrors.ErrForbidden.Error())
+				continue
+			}
 
-		if h.hub.GetMasterFrontend(deviceID) != conn {
-			log.Printf("[WS FRONTEND] client is not MASTER for deviceID=%d", deviceID)
+			h.hub.Subscribe(deviceID, client)
+			h.reply(client, models.EventSubscribed, deviceID)
 			continue
-		}
 
-		ctx := context.Background()
+		case models.EventUnsubscribe:
+			h.hub.Unsubscribe(deviceID, client)
+			h.reply(client, models.EventUnsubscribed, deviceID)
+			continue
 
-		switch msg.Event {
+		case models.EventAcquireControl:
+			if !principal.Can(auth.PermControl) {
+				h.writeError(client, cerrors.ErrForbidden.Error())
+				continue
+			}
 
-		case models.EventStartTraining:
-			resp, err := h.svc.WSStartTraining(ctx, msg)
-			if err != nil {
-				h.writeError(conn, err.Error())
+			if !h.hub.AcquireControl(deviceID, client) {
+				h.writeError(client, cerrors.ErrNotInControl.Error())
 				continue
 			}
 
-			b, _ := json.Marshal(resp)
-			h.hub.SendToESP(deviceID, b)
+			h.reply(client, models.EventControlAcquired, deviceID)
+			continue
 
-		case models.EventStartStreaming:
-			resp, err := h.svc.WSStartStreaming(ctx, msg)
-			if err != nil {
-				h.writeError(conn, err.Error())
+		case models.EventTakeoverControl:
+			if !principal.Can(auth.PermTakeover) {
+				h.writeError(client, cerrors.ErrForbidden.Error())
 				continue
 			}
 
-			b, _ := json.Marshal(resp)
-			h.hub.SendToESP(deviceID, b)
+			slog.InfoContext(ctx, "control taken over")
+			h.hub.TakeoverControl(deviceID, client)
+			h.reply(client, models.EventControlAcquired, deviceID)
+			continue
 
-		case models.EventStopTraining:
-			resp, err := h.svc.WSStopStreaming(ctx, deviceID)
-			if err != nil {
-				h.writeError(conn, err.Error())
-				continue
+		case models.EventReleaseControl:
+			if !h.hub.ReleaseControl(deviceID, client) {
+				h.writeError(client, cerrors.ErrNotInControl.Error())
 			}
+			continue
+		}
 
+		// every command from the master renews its lease
+		if !h.hub.RenewControl(deviceID, client) {
+			slog.DebugContext(ctx, "command from a client not in control")
+			h.writeError(client, cerrors.ErrNotInControl.Error())
+			continue
+		}
+
+		ctx, span := tracing.Start(ctx, "frontend.command",
+			attribute.String("event", string(msg.Event)), attribute.Int("device_id", deviceID))
+
+		resp, err := h.command(ctx, msg, owner, principal.Can(auth.PermTakeover))
+		if err != nil {
+			tracing.EndErr(span, err)
+			h.writeError(client, err.Error())
+			continue
+		}
+
+		if resp != nil {
+			_, send := tracing.Start(ctx, "hub.send_to_esp")
 			b, _ := json.Marshal(resp)
-			h.hub.SendToESP(deviceID, b)
+			send.SetAttributes(attribute.Bool("sent", h.hub.SendToESP(deviceID, b)))
+			send.End()
 		}
+
+		span.End()
 	}
 }
 
-func (h *FrontendWSHandler) writeError(conn *websocket.Conn, msg string) {
+// command runs a command of the master, the returned message goes to the ESP.
+// takeover lets the client stop a device reserved by someone else.
+func (h *FrontendWSHandler) command(ctx context.Context, msg models.WsFrontendToBackend, owner string, takeover bool) (*models.WsBackendToEsp, error) {
+	switch msg.Event {
+	case models.EventControlHeartbeat:
+		// lease already renewed by the caller
+		return nil, nil
+	case models.EventStartTraining:
+		return h.svc.WSStartTraining(ctx, msg, owner)
+	case models.EventStartStreaming:
+		return h.svc.WSStartStreaming(ctx, msg, owner)
+	case models.EventStartCalibration:
+		return h.svc.WSStartCalibration(ctx, msg, owner)
+	case models.EventStopTraining:
+		return h.svc.WSStopStreaming(ctx, msg.DeviceID, owner, takeover)
+	}
+	return nil, nil
+}
+
+func (h *FrontendWSHandler) reply(c *Client, event models.Event, deviceID int) {
+	b, _ := json.Marshal(models.WsBackendToFrontend{Event: event, DeviceID: deviceID})
+	c.Send(b)
+}
+
+func (h *FrontendWSHandler) writeError(c *Client, msg string) {
 	resp := map[string]any{"event": "error", "error": msg}
 	b, _ := json.Marshal(resp)
-	conn.WriteMessage(websocket.TextMessage, b)
+	c.Send(b)
 }
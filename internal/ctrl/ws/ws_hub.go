@@ -1,76 +1,258 @@
 package ws
 
 import (
-	"github.com/gorilla/websocket"
+	"context"
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/models"
+	"encoding/json"
 	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 type Hub struct {
-	esp            map[int]*websocket.Conn   // deviceID → ESP conn
-	frontend       map[int][]*websocket.Conn // deviceID → all clients
-	masterFrontend map[int]*websocket.Conn   // deviceID → MASTER client
+	esp            map[int]*Client               // deviceID → ESP conn
+	frontends      map[*Client]struct{}          // every connected frontend
+	frontend       map[int]map[*Client]time.Time // deviceID → subscribed clients, subscribed at
+	masterFrontend map[int]*controlLease         // deviceID → MASTER client
 	mu             sync.RWMutex
+
+	// running connection handlers, waited for on shutdown
+	handlers sync.WaitGroup
+	closing  bool
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		esp:            make(map[int]*websocket.Conn),
-		frontend:       make(map[int][]*websocket.Conn),
-		masterFrontend: make(map[int]*websocket.Conn),
+		esp:            make(map[int]*Client),
+		frontends:      make(map[*Client]struct{}),
+		frontend:       make(map[int]map[*Client]time.Time),
+		masterFrontend: make(map[int]*controlLease),
+	}
+}
+
+// RegisterESP replaces an older connection of the same device, the old one
+// is closed.
+func (h *Hub) RegisterESP(deviceID int, c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if old := h.esp[deviceID]; old != nil && old != c {
+		old.Close()
 	}
+	h.esp[deviceID] = c
 }
 
-func (h *Hub) RegisterESP(deviceID int, conn *websocket.Conn) {
+// ConnectedESPs returns the IDs of devices with a live socket.
+func (h *Hub) ConnectedESPs() []int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	ids := make([]int, 0, len(h.esp))
+	for id := range h.esp {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// AddFrontend registers a connected frontend for broadcasts, it receives
+// device data only after Subscribe.
+func (h *Hub) AddFrontend(c *Client) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
-	h.esp[deviceID] = conn
+	h.frontends[c] = struct{}{}
 }
 
-func (h *Hub) RegisterFrontend(deviceID int, conn *websocket.Conn) {
+// RemoveFrontend drops c from every subscription, devices it controlled go
+// to the longest subscribed client left that may control them.
+func (h *Hub) RemoveFrontend(c *Client) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	h.frontend[deviceID] = append(h.frontend[deviceID], conn)
+	delete(h.frontends, c)
+
+	for deviceID, subs := range h.frontend {
+		delete(subs, c)
+		if len(subs) == 0 {
+			delete(h.frontend, deviceID)
+		}
+	}
+
+	for deviceID, l := range h.masterFrontend {
+		if l.client == c {
+			h.promoteLocked(deviceID)
+		}
+	}
+}
+
+// Subscribe is idempotent, a client is registered once per device.
+func (h *Hub) Subscribe(deviceID int, c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs, ok := h.frontend[deviceID]
+	if !ok {
+		subs = make(map[*Client]time.Time)
+		h.frontend[deviceID] = subs
+	}
+	if _, ok := subs[c]; !ok {
+		subs[c] = time.Now()
+	}
 }
 
-func (h *Hub) RegisterMasterFrontend(deviceID int, conn *websocket.Conn) {
+func (h *Hub) Unsubscribe(deviceID int, c *Client) {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
-	if _, exists := h.masterFrontend[deviceID]; !exists {
-		h.masterFrontend[deviceID] = conn
+	subs := h.frontend[deviceID]
+	delete(subs, c)
+	if len(subs) == 0 {
+		delete(h.frontend, deviceID)
 	}
 }
 
-func (h *Hub) GetMasterFrontend(deviceID int) *websocket.Conn {
+// SendToESP reports false when the device is not connected or the message
+// could not be queued.
+func (h *Hub) SendToESP(deviceID int, data []byte) bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
-	return h.masterFrontend[deviceID]
+
+	c := h.esp[deviceID]
+	if c == nil {
+		return false
+	}
+	return c.Send(data)
+}
+
+// SendCommandToESP is SendToESP for callers outside the ESP read loop.
+func (h *Hub) SendCommandToESP(deviceID int, msg *models.WsBackendToEsp) bool {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return false
+	}
+	return h.SendToESP(deviceID, b)
 }
 
-func (h *Hub) SendToESP(deviceID int, data []byte) error {
+// SendToFrontend queues data for every subscriber of the device and returns
+// how many got it without dropping anything.
+func (h *Hub) SendToFrontend(deviceID int, data []byte) int {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	conn := h.esp[deviceID]
-	if conn == nil {
-		return nil
+	sent := 0
+	for c := range h.frontend[deviceID] {
+		if c.Send(data) {
+			sent++
+		}
+	}
+	return sent
+}
+
+func (h *Hub) SendToMaster(deviceID int, data []byte) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	l := h.masterFrontend[deviceID]
+	if l == nil {
+		return false
+	}
+	return l.client.Send(data)
+}
+
+// BroadcastToFrontends sends to every frontend regardless of device.
+func (h *Hub) BroadcastToFrontends(data []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range h.frontends {
+		c.Send(data)
 	}
-	return conn.WriteMessage(websocket.TextMessage, data)
 }
 
-func (h *Hub) SendToFrontend(deviceID int, data []byte) {
+func (h *Hub) BroadcastDeviceStatus(deviceID int, status dto.DeviceStatus) {
+	b, _ := json.Marshal(models.WsBackendToFrontend{
+		Event:    models.EventDeviceStatus,
+		DeviceID: deviceID,
+		Status:   string(status),
+	})
+	h.BroadcastToFrontends(b)
+}
+
+// DisconnectESP closes the device's ESP socket with 1008 (policy
+// violation), the handler runs its usual disconnect cleanup. It reports false
+// when the device is not connected.
+func (h *Hub) DisconnectESP(deviceID int) bool {
 	h.mu.RLock()
 	defer h.mu.RUnlock()
 
-	conns := h.frontend[deviceID]
-	for _, c := range conns {
-		c.WriteMessage(websocket.TextMessage, data)
+	c := h.esp[deviceID]
+	if c == nil {
+		return false
 	}
+	c.CloseWith(websocket.ClosePolicyViolation, disabledReason)
+	return true
 }
 
-func (h *Hub) RemoveESP(deviceID int) {
+// RemoveESP reports false when c was already replaced by a newer connection
+// of the same device.
+func (h *Hub) RemoveESP(deviceID int, c *Client) bool {
 	h.mu.Lock()
 	defer h.mu.Unlock()
+
+	if h.esp[deviceID] != c {
+		return false
+	}
 	delete(h.esp, deviceID)
+	return true
+}
+
+// track counts a connection handler until untrack. It fails once CloseAll
+// ran, the handler then closes the socket right away.
+func (h *Hub) track() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closing {
+		return false
+	}
+	h.handlers.Add(1)
+	return true
+}
+
+func (h *Hub) untrack() {
+	h.handlers.Done()
+}
+
+// CloseAll closes every ESP and frontend socket with 1012 (service restart)
+// so clients reconnect, and refuses new ones. The handlers then run their
+// usual disconnect cleanup.
+func (h *Hub) CloseAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closing = true
+
+	for _, c := range h.esp {
+		c.CloseWith(websocket.CloseServiceRestart, shutdownReason)
+	}
+	for c := range h.frontends {
+		c.CloseWith(websocket.CloseServiceRestart, shutdownReason)
+	}
+}
+
+// Wait blocks until every connection handler returned or ctx is done.
+func (h *Hub) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -0,0 +1,53 @@
+package ws
+
+import (
+	"net/http"
+	"time"
+
+	"emg_esp32_classifier_backend/internal/config"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// pongWait is how long a connection may stay silent before it is
+	// considered dead, the writer pings a bit more often than that.
+	pongWait   = 20 * time.Second
+	pingPeriod = pongWait * 9 / 10
+	writeWait  = 5 * time.Second
+)
+
+// shutdownReason goes with CloseServiceRestart, clients should reconnect.
+const shutdownReason = "server restarting"
+
+// disabledReason goes with ClosePolicyViolation when a device is disabled.
+const disabledReason = "device disabled"
+
+// keepAlive arms the read deadline and extends it on every pong. onPong may
+// be nil. Pings are sent by Client.writePump.
+func keepAlive(conn *websocket.Conn, onPong func()) {
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		if onPong != nil {
+			onPong()
+		}
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+}
+
+// Configure sets buffer and queue sizes, call it before serving.
+func Configure(cfg config.WS) {
+	espUpgrader.ReadBufferSize = cfg.ESPReadBuffer
+	espUpgrader.WriteBufferSize = cfg.ESPWriteBuffer
+	espSendQueue = cfg.ESPSendQueue
+
+	frontendUpgrader.ReadBufferSize = cfg.FrontendReadBuffer
+	frontendUpgrader.WriteBufferSize = cfg.FrontendWriteBuffer
+	frontendSendQueue = cfg.FrontendSendQueue
+}
+
+// SetCheckOrigin replaces the origin check of both upgraders.
+func SetCheckOrigin(fn func(r *http.Request) bool) {
+	espUpgrader.CheckOrigin = fn
+	frontendUpgrader.CheckOrigin = fn
+}
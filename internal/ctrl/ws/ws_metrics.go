@@ -0,0 +1,48 @@
+package ws
+
+import (
+	"strconv"
+
+	"emg_esp32_classifier_backend/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// device ids are bounded by the registry, handshakes of unknown devices
+	// are rejected before anything is counted
+	espPackets = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "emg_esp_packets_total",
+		Help: "Messages received from registered ESPs, rate() gives packets per second.",
+	}, []string{"device_id"})
+	droppedMessages = metrics.Factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "emg_ws_dropped_messages_total",
+		Help: "Messages not delivered because a client's send queue was full.",
+	}, []string{"client"})
+)
+
+// ForgetDevice drops the series of a deleted device.
+func ForgetDevice(deviceID int) {
+	espPackets.DeleteLabelValues(strconv.Itoa(deviceID))
+}
+
+// RegisterMetrics exposes the connection counts of h.
+func (h *Hub) RegisterMetrics(r prometheus.Registerer) {
+	r.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "emg_esp_connected",
+		Help: "ESPs with a live socket.",
+	}, func() float64 {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		return float64(len(h.esp))
+	}))
+
+	r.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "emg_frontends_connected",
+		Help: "Connected frontend sockets.",
+	}, func() float64 {
+		h.mu.RLock()
+		defer h.mu.RUnlock()
+		return float64(len(h.frontends))
+	}))
+}
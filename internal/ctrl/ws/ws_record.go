@@ -0,0 +1,56 @@
+package ws
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/capture"
+)
+
+// recorder gets every message of both sockets when set, see SetRecorder.
+var recorder *capture.Writer
+
+// SetRecorder starts capturing, call it before serving.
+func SetRecorder(w *capture.Writer) {
+	recorder = w
+}
+
+func record(c *Client, dir capture.Direction, at time.Time, data []byte) {
+	if recorder == nil {
+		return
+	}
+
+	kind := strings.ToLower(c.name)
+	if kind == "esp" && dir == capture.In {
+		data = redactHandshake(data)
+	}
+
+	err := recorder.Write(capture.Record{At: at, Conn: c.id, Kind: kind, Dir: dir, Msg: data})
+	if err != nil {
+		slog.Warn("record message", "conn_id", c.id, "err", err)
+	}
+}
+
+// redactHandshake keeps device secrets out of the capture, the replay
+// authenticates with its own.
+func redactHandshake(data []byte) []byte {
+	if !bytes.Contains(data, []byte(`"token"`)) && !bytes.Contains(data, []byte(`"enroll_token"`)) {
+		return data
+	}
+
+	var m map[string]any
+	if err := json.Unmarshal(data, &m); err != nil {
+		return data
+	}
+	for _, k := range []string{"token", "enroll_token"} {
+		if _, ok := m[k]; ok {
+			m[k] = "***"
+		}
+	}
+
+	b, _ := json.Marshal(m)
+	return b
+}
@@ -2,9 +2,16 @@ package mlclient
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"time"
+
+	"emg_esp32_classifier_backend/pkg/tracing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type PredictRequest struct {
@@ -22,16 +29,31 @@ type Client struct {
 	HTTPClient *http.Client
 }
 
-func New(url string) *Client {
+func New(url string, timeout time.Duration) *Client {
 	return &Client{
 		URL: url,
 		HTTPClient: &http.Client{
-			Timeout: 2 * time.Second,
+			Timeout:   timeout,
+			Transport: tracing.Transport(nil),
 		},
 	}
 }
 
-func (c *Client) Predict(features []float64) (*PredictResponse, error) {
+func (c *Client) Predict(ctx context.Context, features []float64) (*PredictResponse, error) {
+	defer prometheus.NewTimer(predictLatency).ObserveDuration()
+
+	ctx, span := tracing.Start(ctx, "ml.predict", attribute.Int("features", len(features)))
+	defer span.End()
+
+	out, err := c.predict(ctx, features)
+	if err != nil {
+		predictErrors.Inc()
+		tracing.SetError(span, err)
+	}
+	return out, err
+}
+
+func (c *Client) predict(ctx context.Context, features []float64) (*PredictResponse, error) {
 	reqPayload := PredictRequest{Features: features}
 
 	body, err := json.Marshal(reqPayload)
@@ -39,12 +61,22 @@ func (c *Client) Predict(features []float64) (*PredictResponse, error) {
 		return nil, err
 	}
 
-	resp, err := c.HTTPClient.Post(c.URL+"/predict", "application/json", bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL+"/predict", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("ml predict: %s", resp.Status)
+	}
+
 	var out PredictResponse
 	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
 		return nil, err
@@ -52,3 +84,23 @@ func (c *Client) Predict(features []float64) (*PredictResponse, error) {
 
 	return &out, nil
 }
+
+// Health asks the ML service whether it is up, any non-200 is an error.
+func (c *Client) Health(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.URL+"/health", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ml health: %s", resp.Status)
+	}
+
+	return nil
+}
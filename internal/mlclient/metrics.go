@@ -0,0 +1,19 @@
+package mlclient
+
+import (
+	"emg_esp32_classifier_backend/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	predictLatency = metrics.Factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "emg_ml_predict_seconds",
+		Help:    "Round trip of a predict call to the ML service.",
+		Buckets: metrics.LatencyBuckets,
+	})
+	predictErrors = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Name: "emg_ml_predict_errors_total",
+		Help: "Predict calls that failed or returned a non-200 status.",
+	})
+)
@@ -1,24 +1,45 @@
 package repo
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
-	"os"
+	"log/slog"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
-func NewPostgresConnection() (*sql.DB, error) {
-	host := os.Getenv("DB_HOST")
-	port := os.Getenv("DB_PORT")
-	user := os.Getenv("DB_USER")
-	pass := os.Getenv("DB_PASS")
-	name := os.Getenv("DB_NAME")
+// NewPostgresConnection only opens the pool, use WaitForDB to know the
+// database is there.
+func NewPostgresConnection(dsn string) (*sql.DB, error) {
+	return sql.Open("postgres", dsn)
+}
 
-	dsn := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		host, port, user, pass, name,
-	)
+// WaitForDB pings until the database answers, backing off from 500ms up to
+// 10s between attempts. Gives up when ctx is done.
+func WaitForDB(ctx context.Context, db *sql.DB) error {
+	backoff := 500 * time.Millisecond
 
-	return sql.Open("postgres", dsn)
+	for attempt := 1; ; attempt++ {
+		pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		err := db.PingContext(pingCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+
+		slog.WarnContext(ctx, "database not reachable", "attempt", attempt, "retry_in", backoff, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("database not reachable: %w", err)
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > 10*time.Second {
+			backoff = 10 * time.Second
+		}
+	}
 }
@@ -5,10 +5,18 @@ import (
 	"database/sql"
 	"emg_esp32_classifier_backend/pkg/cerrors"
 	"emg_esp32_classifier_backend/pkg/models"
+	"emg_esp32_classifier_backend/pkg/quality"
+	"emg_esp32_classifier_backend/pkg/sessions"
+	"emg_esp32_classifier_backend/pkg/tracing"
 	"emg_esp32_classifier_backend/pkg/utils"
+	"encoding/json"
 	"errors"
 	"time"
 
+	"github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+
 	"emg_esp32_classifier_backend/pkg/dto"
 )
 
@@ -17,21 +25,63 @@ var ErrNotIdle = errors.New("device is not idle")
 type Repository interface {
 	GetMovements(ctx context.Context) ([]dto.Movements, error)
 	GetMovementsById(ctx context.Context, MovementID int) (*dto.Movements, error)
+	InsertMovement(ctx context.Context, name, description string) (*dto.Movements, error)
 
 	ListDevices(ctx context.Context) ([]dto.Device, error)
 	GetDeviceById(ctx context.Context, DeviceID int) (*dto.Device, error)
 	GetDeviceByName(ctx context.Context, deviceName string) (*dto.Device, error)
 	UpdateDeviceStatus(ctx context.Context, deviceID int, status dto.DeviceStatus) error
-	InsertDevice(ctx context.Context, name string) (*dto.Device, error)
+	InsertDevice(ctx context.Context, name string, tags []string) (*dto.Device, error)
+	UpdateDevice(ctx context.Context, deviceID int, upd dto.DeviceUpdate) (*dto.Device, error)
+	UpdateDeviceMetadata(ctx context.Context, deviceID int, firmware string, channels, sampleRate, adcBits int) error
+	DeleteDevice(ctx context.Context, deviceID int) error
+	TouchDevice(ctx context.Context, deviceID int) error
+	GetDeviceSecretHash(ctx context.Context, deviceID int) (string, error)
+	SetDeviceSecretHash(ctx context.Context, deviceID int, hash string) error
+	MarkStaleDevicesDisconnected(ctx context.Context, before time.Time) ([]int, error)
 
-	CreateTraining(ctx context.Context, deviceID, movementID, rep int) (int, error)
+	CreateTraining(ctx context.Context, deviceID, movementID, rep int, subject string) (int, error)
 	UpdateTrainingRepetition(ctx context.Context, trainingID, rep int) error
 	MarkTrainingFinished(ctx context.Context, trainingID int) error
 	DeleteTraining(ctx context.Context, trainingID int) error
+	ListTrainings(ctx context.Context, f dto.TrainingFilter) ([]dto.Training, error)
 
 	InsertTrainingRaw(ctx context.Context, tr *dto.TrainingRaw) error
+	DeleteTrainingRawRepetition(ctx context.Context, trainingID, rep int) error
 	SelectTrainingRawSamples(ctx context.Context, trainingID, deviceID int) ([]models.RawSample, error)
 	GetAllRawData(ctx context.Context) ([]dto.TrainingRaw, error)
+
+	SelectRepetitionRaw(ctx context.Context, trainingID, rep int) ([]dto.TrainingRaw, error)
+	ReplaceRepetitionSegments(ctx context.Context, trainingID, rep int, segs []dto.Segment) error
+	ListSegments(ctx context.Context, trainingID int) ([]dto.Segment, error)
+	ListAllSegments(ctx context.Context) ([]dto.Segment, error)
+
+	UpsertRepetitionQuality(ctx context.Context, trainingID, rep int, m quality.Metrics) error
+	ListRepetitionQuality(ctx context.Context, trainingID int) ([]dto.RepetitionQuality, error)
+
+	GetReservation(ctx context.Context, deviceID int) (*dto.Reservation, error)
+	UpsertReservation(ctx context.Context, deviceID int, owner string, expiresAt time.Time) (*dto.Reservation, error)
+	DeleteReservation(ctx context.Context, deviceID int, owner string) error
+	DeleteExpiredReservations(ctx context.Context) ([]int, error)
+
+	InsertDeviceConfig(ctx context.Context, deviceID int, cfg models.DeviceConfig, createdBy string) (*dto.DeviceConfigVersion, error)
+	GetLatestDeviceConfig(ctx context.Context, deviceID int) (*dto.DeviceConfigVersion, error)
+	ListDeviceConfigs(ctx context.Context, deviceID int) ([]dto.DeviceConfigVersion, error)
+	AckDeviceConfig(ctx context.Context, deviceID, version int, ackErr string) error
+
+	GetCalibration(ctx context.Context, deviceID int, subject string) (*dto.Calibration, error)
+	ListCalibrations(ctx context.Context, deviceID int) ([]dto.Calibration, error)
+	UpsertCalibration(ctx context.Context, c *dto.Calibration) error
+
+	ListUsers(ctx context.Context) ([]dto.User, error)
+	InsertUser(ctx context.Context, name, role, keyHash string) (*dto.User, error)
+	UpdateUserRole(ctx context.Context, userID int, role string) (*dto.User, error)
+	DeleteUser(ctx context.Context, userID int) error
+	LookupAPIKey(ctx context.Context, keyHash string) (subject string, role string, err error)
+
+	SaveSession(ctx context.Context, sess *sessions.Session) error
+	DeleteSession(ctx context.Context, deviceID int) error
+	LoadSessions(ctx context.Context) ([]*sessions.Session, error)
 }
 
 type pgRepository struct {
@@ -85,11 +135,62 @@ func (r *pgRepository) GetMovementsById(ctx context.Context, MovementID int) (*d
 	return &movement, nil
 }
 
+func (r *pgRepository) InsertMovement(ctx context.Context, name, description string) (*dto.Movements, error) {
+	const q = `
+	INSERT INTO movements (name, description)
+	VALUES ($1, $2)
+	RETURNING movement_id, name, COALESCE(description, '');
+	`
+
+	var m dto.Movements
+	if err := r.db.QueryRowContext(ctx, q, name, description).Scan(&m.Movement_id, &m.Name, &m.Description); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
 // ---- Devices ----
 
+const deviceColumns = `id, name, status, last_seen, tags, disabled,
+	COALESCE(firmware_version, ''), COALESCE(channel_count, 0), COALESCE(sample_rate, 0), COALESCE(adc_bits, 0), created_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanDevice(row rowScanner) (*dto.Device, error) {
+	var d dto.Device
+
+	err := row.Scan(
+		&d.ID,
+		&d.Name,
+		&d.Status,
+		&d.LastSeen,
+		pq.Array(&d.Tags),
+		&d.Disabled,
+		&d.FirmwareVersion,
+		&d.ChannelCount,
+		&d.SampleRate,
+		&d.ADCBits,
+		&d.CreatedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, cerrors.ErrNotFound
+		}
+		return nil, err
+	}
+
+	if d.Tags == nil {
+		d.Tags = []string{}
+	}
+
+	return &d, nil
+}
+
 func (r *pgRepository) ListDevices(ctx context.Context) ([]dto.Device, error) {
 	const q = `
-	SELECT id, name, status, last_seen
+	SELECT ` + deviceColumns + `
 	FROM devices
 	ORDER BY id;`
 	rows, err := r.db.QueryContext(ctx, q)
@@ -100,51 +201,26 @@ func (r *pgRepository) ListDevices(ctx context.Context) ([]dto.Device, error) {
 
 	var res []dto.Device
 	for rows.Next() {
-		var d dto.Device
-		if err := rows.Scan(&d.ID, &d.Name, &d.Status, &d.LastSeen); err != nil {
+		d, err := scanDevice(rows)
+		if err != nil {
 			return nil, err
 		}
 
-		res = append(res, d)
+		res = append(res, *d)
 	}
 	return res, rows.Err()
 }
 
 func (r *pgRepository) GetDeviceById(ctx context.Context, DeviceID int) (*dto.Device, error) {
-	const q = `SELECT id, name, status, last_seen FROM devices WHERE id = $1`
-
-	var d dto.Device
-
-	err := r.db.QueryRowContext(ctx, q, DeviceID).Scan(&d.ID, &d.Name, &d.Status, &d.LastSeen)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, cerrors.ErrNotFound
-		}
-		return nil, err
-	}
+	const q = `SELECT ` + deviceColumns + ` FROM devices WHERE id = $1`
 
-	return &d, nil
+	return scanDevice(r.db.QueryRowContext(ctx, q, DeviceID))
 }
 
 func (r *pgRepository) GetDeviceByName(ctx context.Context, deviceName string) (*dto.Device, error) {
-	const q = `SELECT id, name, status, last_seen FROM devices WHERE name = $1`
-
-	var d dto.Device
-
-	err := r.db.QueryRowContext(ctx, q, deviceName).Scan(
-		&d.ID,
-		&d.Name,
-		&d.Status,
-		&d.LastSeen,
-	)
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, cerrors.ErrNotFound
-		}
-		return nil, err
-	}
+	const q = `SELECT ` + deviceColumns + ` FROM devices WHERE name = $1`
 
-	return &d, nil
+	return scanDevice(r.db.QueryRowContext(ctx, q, deviceName))
 }
 
 func (r *pgRepository) UpdateDeviceStatus(ctx context.Context, deviceID int, status dto.DeviceStatus) error {
@@ -175,34 +251,150 @@ func (r *pgRepository) UpdateDeviceStatus(ctx context.Context, deviceID int, sta
 	return err
 }
 
-func (r *pgRepository) InsertDevice(ctx context.Context, name string) (*dto.Device, error) {
+// InsertDevice returns cerrors.ErrAlreadyExists when the name is taken.
+func (r *pgRepository) InsertDevice(ctx context.Context, name string, tags []string) (*dto.Device, error) {
+	const q = `
+		INSERT INTO devices (name, status, tags)
+		VALUES ($1, 'idle', $2)
+		RETURNING ` + deviceColumns
+
+	if tags == nil {
+		tags = []string{}
+	}
+
+	d, err := scanDevice(r.db.QueryRowContext(ctx, q, name, pq.Array(tags)))
+	if isUniqueViolation(err) {
+		return nil, cerrors.ErrAlreadyExists
+	}
+	return d, err
+}
+
+// UpdateDevice changes name, tags and disabled, nil fields are left as they
+// are.
+func (r *pgRepository) UpdateDevice(ctx context.Context, deviceID int, upd dto.DeviceUpdate) (*dto.Device, error) {
+	const q = `
+	UPDATE 
+	    devices
+	SET 
+	    name = COALESCE($2, name),
+	    tags = COALESCE($3, tags),
+	    disabled = COALESCE($4, disabled)
+	WHERE 
+	    id = $1
+	RETURNING ` + deviceColumns
+
+	var tags any
+	if upd.Tags != nil {
+		tags = pq.Array(*upd.Tags)
+	}
+
+	d, err := scanDevice(r.db.QueryRowContext(ctx, q, deviceID, upd.Name, tags, upd.Disabled))
+	if isUniqueViolation(err) {
+		return nil, cerrors.ErrAlreadyExists
+	}
+	return d, err
+}
+
+// UpdateDeviceMetadata stores what the ESP reports at handshake.
+func (r *pgRepository) UpdateDeviceMetadata(ctx context.Context, deviceID int, firmware string, channels, sampleRate, adcBits int) error {
 	const q = `
-		INSERT INTO devices (name, status)
-		VALUES ($1, 'idle')
-		RETURNING id, name, status, last_seen
+	UPDATE 
+	    devices
+	SET 
+	    firmware_version = NULLIF($2, ''),
+	    channel_count = NULLIF($3, 0),
+	    sample_rate = NULLIF($4, 0),
+	    adc_bits = NULLIF($5, 0)
+	WHERE 
+	    id = $1;
 	`
+	_, err := r.db.ExecContext(ctx, q, deviceID, firmware, channels, sampleRate, adcBits)
+	return err
+}
 
-	var d dto.Device
-	err := r.db.QueryRowContext(ctx, q, name).
-		Scan(&d.ID, &d.Name, &d.Status, &d.LastSeen)
+// DeleteDevice returns cerrors.ErrDeviceHasData when trainings reference the
+// device, recorded data is never removed as a side effect.
+func (r *pgRepository) DeleteDevice(ctx context.Context, deviceID int) error {
+	const q = `DELETE FROM devices WHERE id = $1`
+
+	res, err := r.db.ExecContext(ctx, q, deviceID)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+			return cerrors.ErrDeviceHasData
+		}
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return cerrors.ErrNotFound
+	}
+	return nil
+}
+
+func (r *pgRepository) TouchDevice(ctx context.Context, deviceID int) error {
+	const q = `UPDATE devices SET last_seen = NOW() WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, q, deviceID)
+	return err
+}
+
+// GetDeviceSecretHash returns "" for devices that have no token yet.
+func (r *pgRepository) GetDeviceSecretHash(ctx context.Context, deviceID int) (string, error) {
+	const q = `SELECT COALESCE(secret_hash, '') FROM devices WHERE id = $1`
+
+	var hash string
+	if err := r.db.QueryRowContext(ctx, q, deviceID).Scan(&hash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", cerrors.ErrNotFound
+		}
+		return "", err
+	}
+	return hash, nil
+}
+
+func (r *pgRepository) SetDeviceSecretHash(ctx context.Context, deviceID int, hash string) error {
+	const q = `UPDATE devices SET secret_hash = NULLIF($2, '') WHERE id = $1`
+	_, err := r.db.ExecContext(ctx, q, deviceID, hash)
+	return err
+}
+
+func (r *pgRepository) MarkStaleDevicesDisconnected(ctx context.Context, before time.Time) ([]int, error) {
+	const q = `
+	UPDATE 
+	    devices
+	SET 
+	    status = 'disconnected'
+	WHERE 
+	    status <> 'disconnected' AND last_seen < $1
+	RETURNING id;
+	`
+	rows, err := r.db.QueryContext(ctx, q, before)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &d, nil
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
 }
 
 // ---- Training ----
-func (r *pgRepository) CreateTraining(ctx context.Context, deviceID, movementID, rep int) (int, error) {
+func (r *pgRepository) CreateTraining(ctx context.Context, deviceID, movementID, rep int, subject string) (int, error) {
 	const q = `
 	INSERT INTO training 
-	    (device_id, movement_id, repetition)
+	    (device_id, movement_id, repetition, subject)
 	VALUES 
-	    ($1, $2, $3)
+	    ($1, $2, $3, $4)
 	RETURNING id;
 	`
 	var id int
-	if err := r.db.QueryRowContext(ctx, q, deviceID, movementID, rep).Scan(&id); err != nil {
+	if err := r.db.QueryRowContext(ctx, q, deviceID, movementID, rep, subject).Scan(&id); err != nil {
 		return 0, err
 	}
 	return id, nil
@@ -234,14 +426,84 @@ func (r *pgRepository) MarkTrainingFinished(ctx context.Context, trainingID int)
 	return err
 }
 
+// DeleteTraining removes the training with everything recorded for it, its
+// samples, quality, segments and a session left open.
 func (r *pgRepository) DeleteTraining(ctx context.Context, trainingID int) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		`DELETE FROM training_raw WHERE training_id = $1`,
+		`DELETE FROM repetition_quality WHERE training_id = $1`,
+		`DELETE FROM repetition_segments WHERE training_id = $1`,
+		`DELETE FROM training_sessions WHERE training_id = $1`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, trainingID); err != nil {
+			return err
+		}
+	}
+
+	res, err := tx.ExecContext(ctx, `DELETE FROM training WHERE id = $1`, trainingID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return cerrors.ErrNotFound
+	}
+
+	return tx.Commit()
+}
+
+// ListTrainings returns the newest trainings first with how many packets they
+// hold and how many repetitions were flagged.
+func (r *pgRepository) ListTrainings(ctx context.Context, f dto.TrainingFilter) ([]dto.Training, error) {
 	const q = `
-	DELETE FROM 
-        training 
-    WHERE 
-        id = $1;`
-	_, err := r.db.ExecContext(ctx, q, trainingID)
-	return err
+	SELECT
+	    t.id, t.device_id, t.movement_id, t.repetition, t.subject, t.finished, t.timestamp,
+	    COALESCE(raw.packets, 0), COALESCE(q.flagged, 0)
+	FROM training t
+	LEFT JOIN (
+	    SELECT training_id, COUNT(*) AS packets FROM training_raw GROUP BY training_id
+	) raw ON raw.training_id = t.id
+	LEFT JOIN (
+	    SELECT training_id, COUNT(*) FILTER (WHERE flagged) AS flagged FROM repetition_quality GROUP BY training_id
+	) q ON q.training_id = t.id
+	WHERE
+	    ($1 = 0 OR t.id = $1)
+	    AND ($2 = 0 OR t.device_id = $2)
+	    AND ($3 = 0 OR t.movement_id = $3)
+	    AND ($4 = '' OR t.subject = $4)
+	ORDER BY t.id DESC
+	LIMIT NULLIF($5, 0);
+	`
+	rows, err := r.db.QueryContext(ctx, q, f.ID, f.DeviceID, f.MovementID, f.Subject, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []dto.Training
+	for rows.Next() {
+		var t dto.Training
+		if err := rows.Scan(
+			&t.ID,
+			&t.DeviceID,
+			&t.MovementID,
+			&t.Repetition,
+			&t.Subject,
+			&t.Finished,
+			&t.CreatedAt,
+			&t.Packets,
+			&t.Flagged,
+		); err != nil {
+			return nil, err
+		}
+		res = append(res, t)
+	}
+	return res, rows.Err()
 }
 
 // ---- Training Raw ----
@@ -251,6 +513,11 @@ func (r *pgRepository) InsertTrainingRaw(ctx context.Context, tr *dto.TrainingRa
 	INSERT INTO training_raw (training_id, device_id, movement_id, repetition, ts, raw)
 	VALUES ($1, $2, $3, $4, $5, $6);
 	`
+	defer prometheus.NewTimer(ingestLatency).ObserveDuration()
+
+	ctx, span := tracing.Start(ctx, "db.insert_training_raw", attribute.Int("bytes", len(tr.Raw)))
+	defer span.End()
+
 	_, err := r.db.ExecContext(
 		ctx,
 		q,
@@ -262,12 +529,24 @@ func (r *pgRepository) InsertTrainingRaw(ctx context.Context, tr *dto.TrainingRa
 		tr.Raw,
 	)
 	if err != nil {
+		ingestErrors.Inc()
+		tracing.SetError(span, err)
 		return err
 	}
 
 	return nil
 }
 
+func (r *pgRepository) DeleteTrainingRawRepetition(ctx context.Context, trainingID, rep int) error {
+	const q = `
+	DELETE FROM 
+	    training_raw 
+	WHERE 
+	    training_id = $1 AND repetition = $2;`
+	_, err := r.db.ExecContext(ctx, q, trainingID, rep)
+	return err
+}
+
 func (r *pgRepository) SelectTrainingRawSamples(ctx context.Context, trainingID, deviceID int) ([]models.RawSample, error) {
 	const q = `
 	SELECT ts, raw
@@ -276,8 +555,12 @@ func (r *pgRepository) SelectTrainingRawSamples(ctx context.Context, trainingID,
 	ORDER BY ts;
 	`
 
+	ctx, span := tracing.Start(ctx, "db.select_training_raw")
+	defer span.End()
+
 	rows, err := r.db.QueryContext(ctx, q, trainingID, deviceID)
 	if err != nil {
+		tracing.SetError(span, err)
 		return nil, err
 	}
 	defer rows.Close()
@@ -300,21 +583,25 @@ func (r *pgRepository) SelectTrainingRawSamples(ctx context.Context, trainingID,
 		})
 	}
 
+	span.SetAttributes(attribute.Int("rows", len(result)))
+
 	return result, nil
 }
 
 func (r *pgRepository) GetAllRawData(ctx context.Context) ([]dto.TrainingRaw, error) {
 	q := `
 SELECT 
-    id,
-    training_id,
-    device_id,
-    movement_id,
-    repetition,
-    ts,
-    raw
-FROM training_raw
-ORDER BY id;
+    tr.id,
+    tr.training_id,
+    tr.device_id,
+    tr.movement_id,
+    tr.repetition,
+    tr.ts,
+    tr.raw,
+    COALESCE(t.subject, '')
+FROM training_raw tr
+LEFT JOIN training t ON t.id = tr.training_id
+ORDER BY tr.id;
 `
 
 	rows, err := r.db.QueryContext(ctx, q)
@@ -336,6 +623,7 @@ ORDER BY id;
 			&tr.Repetition,
 			&tr.TS,
 			&tr.Raw,
+			&tr.Subject,
 		); err != nil {
 			return nil, err
 		}
@@ -349,3 +637,604 @@ ORDER BY id;
 
 	return result, nil
 }
+
+// ---- Reservations ----
+
+func (r *pgRepository) GetReservation(ctx context.Context, deviceID int) (*dto.Reservation, error) {
+	const q = `SELECT device_id, owner, expires_at, created_at FROM device_reservations WHERE device_id = $1`
+
+	var res dto.Reservation
+	err := r.db.QueryRowContext(ctx, q, deviceID).Scan(&res.DeviceID, &res.Owner, &res.ExpiresAt, &res.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, cerrors.ErrNotFound
+		}
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// UpsertReservation only takes over a reservation of another owner when it
+// has expired, otherwise it returns cerrors.ErrReservationConflict.
+func (r *pgRepository) UpsertReservation(ctx context.Context, deviceID int, owner string, expiresAt time.Time) (*dto.Reservation, error) {
+	const q = `
+	INSERT INTO device_reservations 
+	    (device_id, owner, expires_at)
+	VALUES 
+	    ($1, $2, $3)
+	ON CONFLICT (device_id) DO UPDATE SET
+	    owner = EXCLUDED.owner,
+	    expires_at = EXCLUDED.expires_at,
+	    created_at = CASE 
+	        WHEN device_reservations.owner = EXCLUDED.owner THEN device_reservations.created_at 
+	        ELSE now() 
+	    END
+	WHERE 
+	    device_reservations.owner = EXCLUDED.owner OR device_reservations.expires_at < now()
+	RETURNING device_id, owner, expires_at, created_at;
+	`
+
+	var res dto.Reservation
+	err := r.db.QueryRowContext(ctx, q, deviceID, owner, expiresAt).
+		Scan(&res.DeviceID, &res.Owner, &res.ExpiresAt, &res.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, cerrors.ErrReservationConflict
+		}
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+func (r *pgRepository) DeleteReservation(ctx context.Context, deviceID int, owner string) error {
+	res, err := r.GetReservation(ctx, deviceID)
+	if err != nil {
+		return err
+	}
+
+	if res.Owner != owner && res.ExpiresAt.After(time.Now()) {
+		return cerrors.ErrReservationConflict
+	}
+
+	const q = `DELETE FROM device_reservations WHERE device_id = $1 AND owner = $2`
+	_, err = r.db.ExecContext(ctx, q, deviceID, res.Owner)
+	return err
+}
+
+func (r *pgRepository) DeleteExpiredReservations(ctx context.Context) ([]int, error) {
+	const q = `DELETE FROM device_reservations WHERE expires_at < now() RETURNING device_id`
+
+	rows, err := r.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ---- Device configs ----
+
+// InsertDeviceConfig stores cfg as the next version of the device's config.
+func (r *pgRepository) InsertDeviceConfig(ctx context.Context, deviceID int, cfg models.DeviceConfig, createdBy string) (*dto.DeviceConfigVersion, error) {
+	const q = `
+	INSERT INTO device_configs 
+	    (device_id, version, config, created_by)
+	SELECT 
+	    $1, COALESCE(MAX(version), 0) + 1, $2, $3
+	FROM device_configs
+	WHERE device_id = $1
+	RETURNING version, created_at;
+	`
+
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	v := dto.DeviceConfigVersion{DeviceID: deviceID, Config: cfg, CreatedBy: createdBy}
+	err = r.db.QueryRowContext(ctx, q, deviceID, b, createdBy).Scan(&v.Version, &v.CreatedAt)
+	if err != nil {
+		// two writers raced for the same version
+		if isUniqueViolation(err) {
+			return nil, cerrors.ErrAlreadyExists
+		}
+		return nil, err
+	}
+
+	return &v, nil
+}
+
+const deviceConfigColumns = `device_id, version, config, created_by, created_at, acked_at, COALESCE(ack_error, '')`
+
+func scanDeviceConfig(row rowScanner) (*dto.DeviceConfigVersion, error) {
+	var (
+		v       dto.DeviceConfigVersion
+		raw     []byte
+		ackedAt sql.NullTime
+	)
+
+	err := row.Scan(&v.DeviceID, &v.Version, &raw, &v.CreatedBy, &v.CreatedAt, &ackedAt, &v.AckError)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, cerrors.ErrNotFound
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(raw, &v.Config); err != nil {
+		return nil, err
+	}
+
+	if ackedAt.Valid {
+		v.AckedAt = &ackedAt.Time
+	}
+
+	return &v, nil
+}
+
+func (r *pgRepository) GetLatestDeviceConfig(ctx context.Context, deviceID int) (*dto.DeviceConfigVersion, error) {
+	q := `SELECT ` + deviceConfigColumns + ` FROM device_configs WHERE device_id = $1 ORDER BY version DESC LIMIT 1`
+
+	return scanDeviceConfig(r.db.QueryRowContext(ctx, q, deviceID))
+}
+
+// ListDeviceConfigs returns the history, newest first.
+func (r *pgRepository) ListDeviceConfigs(ctx context.Context, deviceID int) ([]dto.DeviceConfigVersion, error) {
+	q := `SELECT ` + deviceConfigColumns + ` FROM device_configs WHERE device_id = $1 ORDER BY version DESC`
+
+	rows, err := r.db.QueryContext(ctx, q, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []dto.DeviceConfigVersion{}
+	for rows.Next() {
+		v, err := scanDeviceConfig(rows)
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, *v)
+	}
+
+	return history, rows.Err()
+}
+
+func (r *pgRepository) AckDeviceConfig(ctx context.Context, deviceID, version int, ackErr string) error {
+	const q = `
+	UPDATE device_configs 
+	SET acked_at = now(), ack_error = NULLIF($3, '')
+	WHERE device_id = $1 AND version = $2;
+	`
+
+	res, err := r.db.ExecContext(ctx, q, deviceID, version, ackErr)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := res.RowsAffected(); n == 0 {
+		return cerrors.ErrNotFound
+	}
+
+	return nil
+}
+
+// SelectRepetitionRaw returns the packets of one repetition in time order.
+func (r *pgRepository) SelectRepetitionRaw(ctx context.Context, trainingID, rep int) ([]dto.TrainingRaw, error) {
+	const q = `
+	SELECT id, training_id, device_id, movement_id, repetition, ts, raw
+	FROM training_raw
+	WHERE training_id = $1 AND repetition = $2
+	ORDER BY ts, id;
+	`
+	rows, err := r.db.QueryContext(ctx, q, trainingID, rep)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []dto.TrainingRaw
+	for rows.Next() {
+		var tr dto.TrainingRaw
+		if err := rows.Scan(&tr.ID, &tr.TrainingID, &tr.DeviceID, &tr.MovementID, &tr.Repetition, &tr.TS, &tr.Raw); err != nil {
+			return nil, err
+		}
+		result = append(result, tr)
+	}
+
+	return result, rows.Err()
+}
+
+// ---- Segments ----
+
+// ReplaceRepetitionSegments drops the segments of an earlier detection run
+// on the same repetition.
+func (r *pgRepository) ReplaceRepetitionSegments(ctx context.Context, trainingID, rep int, segs []dto.Segment) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	const del = `DELETE FROM repetition_segments WHERE training_id = $1 AND repetition = $2`
+	if _, err := tx.ExecContext(ctx, del, trainingID, rep); err != nil {
+		return err
+	}
+
+	const ins = `
+	INSERT INTO repetition_segments 
+	    (training_id, repetition, start_sample, end_sample, start_ts, end_ts, method)
+	VALUES 
+	    ($1, $2, $3, $4, $5, $6, $7);
+	`
+	for _, s := range segs {
+		if _, err := tx.ExecContext(ctx, ins, trainingID, rep, s.StartSample, s.EndSample, s.Start, s.End, s.Method); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const segmentColumns = `training_id, repetition, start_sample, end_sample, start_ts, end_ts, method`
+
+func (r *pgRepository) ListSegments(ctx context.Context, trainingID int) ([]dto.Segment, error) {
+	q := `SELECT ` + segmentColumns + ` FROM repetition_segments WHERE training_id = $1 ORDER BY repetition, start_sample`
+
+	return r.querySegments(ctx, q, trainingID)
+}
+
+func (r *pgRepository) ListAllSegments(ctx context.Context) ([]dto.Segment, error) {
+	q := `SELECT ` + segmentColumns + ` FROM repetition_segments ORDER BY training_id, repetition, start_sample`
+
+	return r.querySegments(ctx, q)
+}
+
+func (r *pgRepository) querySegments(ctx context.Context, q string, args ...any) ([]dto.Segment, error) {
+	rows, err := r.db.QueryContext(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []dto.Segment{}
+	for rows.Next() {
+		var s dto.Segment
+		if err := rows.Scan(&s.TrainingID, &s.Repetition, &s.StartSample, &s.EndSample, &s.Start, &s.End, &s.Method); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+
+	return list, rows.Err()
+}
+
+// ---- Repetition quality ----
+
+// UpsertRepetitionQuality overwrites the scores of a re-recorded repetition.
+func (r *pgRepository) UpsertRepetitionQuality(ctx context.Context, trainingID, rep int, m quality.Metrics) error {
+	const q = `
+	INSERT INTO repetition_quality 
+	    (training_id, repetition, samples, clipping_ratio, flatline_ratio, mains_hz, mains_ratio, snr_db, score, flagged)
+	VALUES 
+	    ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	ON CONFLICT (training_id, repetition) DO UPDATE SET
+	    samples = EXCLUDED.samples,
+	    clipping_ratio = EXCLUDED.clipping_ratio,
+	    flatline_ratio = EXCLUDED.flatline_ratio,
+	    mains_hz = EXCLUDED.mains_hz,
+	    mains_ratio = EXCLUDED.mains_ratio,
+	    snr_db = EXCLUDED.snr_db,
+	    score = EXCLUDED.score,
+	    flagged = EXCLUDED.flagged,
+	    created_at = now();
+	`
+	_, err := r.db.ExecContext(ctx, q, trainingID, rep, m.Samples, m.ClippingRatio, m.FlatlineRatio,
+		m.MainsHz, m.MainsRatio, m.SNRdB, m.Score, m.Flagged)
+	return err
+}
+
+func (r *pgRepository) ListRepetitionQuality(ctx context.Context, trainingID int) ([]dto.RepetitionQuality, error) {
+	const q = `
+	SELECT training_id, repetition, samples, clipping_ratio, flatline_ratio, mains_hz, mains_ratio, snr_db, score, flagged, created_at
+	FROM repetition_quality
+	WHERE training_id = $1
+	ORDER BY repetition;
+	`
+	rows, err := r.db.QueryContext(ctx, q, trainingID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []dto.RepetitionQuality{}
+	for rows.Next() {
+		var rq dto.RepetitionQuality
+		if err := rows.Scan(
+			&rq.TrainingID,
+			&rq.Repetition,
+			&rq.Samples,
+			&rq.ClippingRatio,
+			&rq.FlatlineRatio,
+			&rq.MainsHz,
+			&rq.MainsRatio,
+			&rq.SNRdB,
+			&rq.Score,
+			&rq.Flagged,
+			&rq.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		rq.Flatline = rq.FlatlineRatio == 1
+		list = append(list, rq)
+	}
+
+	return list, rows.Err()
+}
+
+// ---- Calibrations ----
+
+const calibrationColumns = `device_id, subject, rest_levels, mvc_levels, rest_rms, mvc_rms, rest_at, mvc_at, updated_at`
+
+func scanCalibration(row rowScanner) (*dto.Calibration, error) {
+	var (
+		c             dto.Calibration
+		restAt, mvcAt sql.NullTime
+	)
+
+	err := row.Scan(&c.DeviceID, &c.Subject, pq.Array(&c.RestLevels), pq.Array(&c.MVCLevels), &c.RestRMS, &c.MVCRMS, &restAt, &mvcAt, &c.UpdatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, cerrors.ErrNotFound
+		}
+		return nil, err
+	}
+
+	if restAt.Valid {
+		c.RestAt = &restAt.Time
+	}
+	if mvcAt.Valid {
+		c.MVCAt = &mvcAt.Time
+	}
+
+	return &c, nil
+}
+
+func (r *pgRepository) GetCalibration(ctx context.Context, deviceID int, subject string) (*dto.Calibration, error) {
+	q := `SELECT ` + calibrationColumns + ` FROM calibrations WHERE device_id = $1 AND subject = $2`
+
+	return scanCalibration(r.db.QueryRowContext(ctx, q, deviceID, subject))
+}
+
+func (r *pgRepository) ListCalibrations(ctx context.Context, deviceID int) ([]dto.Calibration, error) {
+	q := `SELECT ` + calibrationColumns + ` FROM calibrations WHERE device_id = $1 ORDER BY subject`
+
+	rows, err := r.db.QueryContext(ctx, q, deviceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []dto.Calibration{}
+	for rows.Next() {
+		c, err := scanCalibration(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, *c)
+	}
+
+	return list, rows.Err()
+}
+
+func (r *pgRepository) UpsertCalibration(ctx context.Context, c *dto.Calibration) error {
+	const q = `
+	INSERT INTO calibrations 
+	    (device_id, subject, rest_levels, mvc_levels, rest_rms, mvc_rms, rest_at, mvc_at, updated_at)
+	VALUES 
+	    ($1, $2, $3, $4, $5, $6, $7, $8, now())
+	ON CONFLICT (device_id, subject) DO UPDATE SET
+	    rest_levels = EXCLUDED.rest_levels,
+	    mvc_levels = EXCLUDED.mvc_levels,
+	    rest_rms = EXCLUDED.rest_rms,
+	    mvc_rms = EXCLUDED.mvc_rms,
+	    rest_at = EXCLUDED.rest_at,
+	    mvc_at = EXCLUDED.mvc_at,
+	    updated_at = EXCLUDED.updated_at;
+	`
+
+	_, err := r.db.ExecContext(ctx, q, c.DeviceID, c.Subject, pq.Array(c.RestLevels), pq.Array(c.MVCLevels), c.RestRMS, c.MVCRMS, c.RestAt, c.MVCAt)
+	return err
+}
+
+// ---- Users ----
+
+func (r *pgRepository) ListUsers(ctx context.Context) ([]dto.User, error) {
+	const q = `SELECT id, name, role, created_at FROM users ORDER BY id`
+
+	rows, err := r.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []dto.User
+	for rows.Next() {
+		var u dto.User
+		if err := rows.Scan(&u.ID, &u.Name, &u.Role, &u.CreatedAt); err != nil {
+			return nil, err
+		}
+		res = append(res, u)
+	}
+	return res, rows.Err()
+}
+
+func (r *pgRepository) InsertUser(ctx context.Context, name, role, keyHash string) (*dto.User, error) {
+	const q = `
+	INSERT INTO users (name, role, api_key_hash)
+	VALUES ($1, $2, $3)
+	RETURNING id, name, role, created_at;
+	`
+
+	var u dto.User
+	err := r.db.QueryRowContext(ctx, q, name, role, keyHash).Scan(&u.ID, &u.Name, &u.Role, &u.CreatedAt)
+	if isUniqueViolation(err) {
+		return nil, cerrors.ErrAlreadyExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (r *pgRepository) UpdateUserRole(ctx context.Context, userID int, role string) (*dto.User, error) {
+	const q = `
+	UPDATE 
+	    users
+	SET 
+	    role = $2
+	WHERE 
+	    id = $1
+	RETURNING id, name, role, created_at;
+	`
+
+	var u dto.User
+	err := r.db.QueryRowContext(ctx, q, userID, role).Scan(&u.ID, &u.Name, &u.Role, &u.CreatedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, cerrors.ErrNotFound
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+func (r *pgRepository) DeleteUser(ctx context.Context, userID int) error {
+	const q = `DELETE FROM users WHERE id = $1`
+
+	res, err := r.db.ExecContext(ctx, q, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return cerrors.ErrNotFound
+	}
+	return nil
+}
+
+func (r *pgRepository) LookupAPIKey(ctx context.Context, keyHash string) (string, string, error) {
+	const q = `SELECT name, role FROM users WHERE api_key_hash = $1`
+
+	var name, role string
+	if err := r.db.QueryRowContext(ctx, q, keyHash).Scan(&name, &role); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", cerrors.ErrNotFound
+		}
+		return "", "", err
+	}
+	return name, role, nil
+}
+
+// ---- Sessions ----
+
+func (r *pgRepository) SaveSession(ctx context.Context, sess *sessions.Session) error {
+	const q = `
+	INSERT INTO training_sessions 
+	    (device_id, training_id, movement_id, repetition, recording, rep_started_at, duration, interrupted_at, updated_at, subject)
+	VALUES 
+	    ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+	ON CONFLICT (device_id) DO UPDATE SET
+	    training_id = EXCLUDED.training_id,
+	    movement_id = EXCLUDED.movement_id,
+	    repetition = EXCLUDED.repetition,
+	    subject = EXCLUDED.subject,
+	    recording = EXCLUDED.recording,
+	    rep_started_at = EXCLUDED.rep_started_at,
+	    duration = EXCLUDED.duration,
+	    interrupted_at = EXCLUDED.interrupted_at,
+	    updated_at = EXCLUDED.updated_at;
+	`
+	_, err := r.db.ExecContext(
+		ctx,
+		q,
+		sess.DeviceID,
+		sess.TrainingID,
+		sess.MovementID,
+		sess.Rep,
+		sess.Recording,
+		nullTime(sess.RepStartedAt),
+		sess.Duration,
+		nullTime(sess.InterruptedAt),
+		sess.UpdatedAt,
+		sess.Subject,
+	)
+	return err
+}
+
+func (r *pgRepository) DeleteSession(ctx context.Context, deviceID int) error {
+	const q = `DELETE FROM training_sessions WHERE device_id = $1`
+	_, err := r.db.ExecContext(ctx, q, deviceID)
+	return err
+}
+
+func (r *pgRepository) LoadSessions(ctx context.Context) ([]*sessions.Session, error) {
+	const q = `
+	SELECT device_id, training_id, movement_id, repetition, recording, rep_started_at, duration, interrupted_at, updated_at, subject
+	FROM training_sessions
+	ORDER BY device_id;
+	`
+	rows, err := r.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var res []*sessions.Session
+	for rows.Next() {
+		var (
+			sess                      sessions.Session
+			repStarted, interruptedAt sql.NullTime
+		)
+
+		if err := rows.Scan(
+			&sess.DeviceID,
+			&sess.TrainingID,
+			&sess.MovementID,
+			&sess.Rep,
+			&sess.Recording,
+			&repStarted,
+			&sess.Duration,
+			&interruptedAt,
+			&sess.UpdatedAt,
+			&sess.Subject,
+		); err != nil {
+			return nil, err
+		}
+
+		sess.RepStartedAt = repStarted.Time
+		sess.InterruptedAt = interruptedAt.Time
+
+		res = append(res, &sess)
+	}
+	return res, rows.Err()
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
@@ -0,0 +1,19 @@
+package repo
+
+import (
+	"emg_esp32_classifier_backend/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	ingestLatency = metrics.Factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "emg_db_ingest_seconds",
+		Help:    "Time to insert one raw packet into training_raw.",
+		Buckets: metrics.LatencyBuckets,
+	})
+	ingestErrors = metrics.Factory.NewCounter(prometheus.CounterOpts{
+		Name: "emg_db_ingest_errors_total",
+		Help: "Raw packets that could not be inserted.",
+	})
+)
@@ -1,17 +1,20 @@
-CREATE TABLE devices (
+-- schema of the first release, IF NOT EXISTS so databases created from the
+-- old database.sql are adopted as they are
+
+CREATE TABLE IF NOT EXISTS devices (
     id SERIAL PRIMARY KEY,
     name TEXT UNIQUE,
     status TEXT CHECK (status IN ('idle', 'streaming', 'disconnected', 'reserved')),
     last_seen TIMESTAMPTZ DEFAULT now()
 );
 
-CREATE TABLE movements (
+CREATE TABLE IF NOT EXISTS movements (
     movement_id SERIAL PRIMARY KEY,
     name TEXT NOT NULL,
     description TEXT
 );
 
-CREATE TABLE training (
+CREATE TABLE IF NOT EXISTS training (
     id SERIAL PRIMARY KEY,
     device_id INT NOT NULL REFERENCES devices(id),
     movement_id INT NOT NULL REFERENCES movements(movement_id),
@@ -20,7 +23,7 @@ CREATE TABLE training (
     timestamp TIMESTAMPTZ NOT NULL DEFAULT now()
 );
 
-CREATE TABLE training_raw (
+CREATE TABLE IF NOT EXISTS training_raw (
     id BIGSERIAL PRIMARY KEY,
     training_id INTEGER NOT NULL,
     device_id INTEGER NOT NULL REFERENCES devices(id),
@@ -30,8 +33,8 @@ CREATE TABLE training_raw (
     raw BYTEA NOT NULL
 );
 
-
 INSERT INTO movements (movement_id, name, description) VALUES
-                                                           (1, 'Fist', 'Strong hand closure with full finger flexion'),
-                                                           (2, 'Wrist Extension', 'Lifting the wrist upward by activating the extensor forearm muscles'),
-                                                           (3, 'Wrist Flexion', 'Bending the wrist downward by activating the flexor forearm muscles');
+    (1, 'Fist', 'Strong hand closure with full finger flexion'),
+    (2, 'Wrist Extension', 'Lifting the wrist upward by activating the extensor forearm muscles'),
+    (3, 'Wrist Flexion', 'Bending the wrist downward by activating the flexor forearm muscles')
+ON CONFLICT (movement_id) DO NOTHING;
@@ -0,0 +1,92 @@
+-- everything added on top of the first release: device auth and registry,
+-- persisted sessions, reservations, users, device config, calibration,
+-- quality and segments
+
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS secret_hash TEXT; -- sha256 of the device token, NULL until enrolled
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS tags TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS disabled BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS firmware_version TEXT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS channel_count INT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS sample_rate INT;
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+ALTER TABLE training ADD COLUMN IF NOT EXISTS subject TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS training_sessions (
+    device_id INTEGER PRIMARY KEY REFERENCES devices(id) ON DELETE CASCADE,
+    training_id INTEGER NOT NULL,
+    movement_id INTEGER NOT NULL REFERENCES movements(movement_id),
+    repetition INTEGER NOT NULL,
+    subject TEXT NOT NULL DEFAULT '',
+    recording BOOLEAN NOT NULL DEFAULT false,
+    rep_started_at TIMESTAMPTZ,
+    duration INTEGER NOT NULL,
+    interrupted_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+ALTER TABLE training_sessions ADD COLUMN IF NOT EXISTS subject TEXT NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS repetition_quality (
+    training_id INTEGER NOT NULL,
+    repetition INTEGER NOT NULL,
+    samples INTEGER NOT NULL,
+    clipping_ratio DOUBLE PRECISION NOT NULL,
+    flatline_ratio DOUBLE PRECISION NOT NULL,
+    mains_hz INTEGER NOT NULL DEFAULT 0,
+    mains_ratio DOUBLE PRECISION NOT NULL,
+    snr_db DOUBLE PRECISION NOT NULL DEFAULT 0,
+    score DOUBLE PRECISION NOT NULL,
+    flagged BOOLEAN NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (training_id, repetition)
+);
+
+CREATE TABLE IF NOT EXISTS repetition_segments (
+    training_id INTEGER NOT NULL,
+    repetition INTEGER NOT NULL,
+    start_sample INTEGER NOT NULL,
+    end_sample INTEGER NOT NULL,
+    start_ts TIMESTAMPTZ NOT NULL,
+    end_ts TIMESTAMPTZ NOT NULL,
+    method TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS repetition_segments_rep_idx ON repetition_segments (training_id, repetition);
+
+CREATE TABLE IF NOT EXISTS device_reservations (
+    device_id INTEGER PRIMARY KEY REFERENCES devices(id) ON DELETE CASCADE,
+    owner TEXT NOT NULL,
+    expires_at TIMESTAMPTZ NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS device_configs (
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    version INTEGER NOT NULL,
+    config JSONB NOT NULL,
+    created_by TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    acked_at TIMESTAMPTZ,
+    ack_error TEXT,
+    PRIMARY KEY (device_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS calibrations (
+    device_id INTEGER NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    subject TEXT NOT NULL,
+    rest_rms DOUBLE PRECISION NOT NULL DEFAULT 0,
+    mvc_rms DOUBLE PRECISION NOT NULL DEFAULT 0,
+    rest_at TIMESTAMPTZ,
+    mvc_at TIMESTAMPTZ,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    PRIMARY KEY (device_id, subject)
+);
+
+CREATE TABLE IF NOT EXISTS users (
+    id SERIAL PRIMARY KEY,
+    name TEXT NOT NULL UNIQUE,
+    role TEXT NOT NULL CHECK (role IN ('admin', 'operator', 'researcher', 'viewer')),
+    api_key_hash TEXT NOT NULL UNIQUE,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
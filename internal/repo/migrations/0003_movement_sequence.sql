@@ -0,0 +1,7 @@
+-- the seeded movements were inserted with explicit ids, move the sequence past
+-- them so new movements can be added
+
+SELECT setval(
+    pg_get_serial_sequence('movements', 'movement_id'),
+    (SELECT COALESCE(MAX(movement_id), 1) FROM movements)
+);
@@ -0,0 +1,7 @@
+-- calibration levels are now taken around the mean, the stored ones include
+-- the ADC offset and would break onset detection and normalisation. Both
+-- phases have to be recorded again.
+
+UPDATE calibrations
+SET rest_rms = 0, mvc_rms = 0, rest_at = NULL, mvc_at = NULL, updated_at = now()
+WHERE rest_at IS NOT NULL OR mvc_at IS NOT NULL;
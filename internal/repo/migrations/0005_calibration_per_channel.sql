@@ -0,0 +1,11 @@
+-- calibration levels are now kept per active channel, a single pooled level
+-- scaled weak channels by the MVC of strong ones. The pooled levels stored so
+-- far can't be split, both phases have to be recorded again.
+
+ALTER TABLE calibrations
+    ADD COLUMN IF NOT EXISTS rest_levels DOUBLE PRECISION[] NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS mvc_levels DOUBLE PRECISION[] NOT NULL DEFAULT '{}';
+
+UPDATE calibrations
+SET rest_rms = 0, mvc_rms = 0, rest_at = NULL, mvc_at = NULL, updated_at = now()
+WHERE rest_at IS NOT NULL OR mvc_at IS NOT NULL;
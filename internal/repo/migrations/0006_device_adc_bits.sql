@@ -0,0 +1,4 @@
+-- ADC resolution reported at handshake, quality checks take the saturation
+-- limits from it instead of the int16 storage limits
+
+ALTER TABLE devices ADD COLUMN IF NOT EXISTS adc_bits INT;
@@ -0,0 +1,288 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/cerrors"
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/models"
+	"emg_esp32_classifier_backend/pkg/utils"
+)
+
+// calibrationRun collects the levels of one phase while it is recorded, one
+// per channel. Rest uses the RMS over the whole phase, MVC the highest RMS of
+// a single packet. Both are taken around the mean of the channel: the ADC is
+// unipolar, with the offset left in the rest level would be mostly DC instead
+// of noise. utils.NormalizedFeatures takes the features the same way.
+type calibrationRun struct {
+	subject  string
+	phase    dto.CalibrationPhase
+	channels int
+	sum      []float64 // per channel
+	sumSq    []float64
+	peak     []float64
+	n        int
+}
+
+func newCalibrationRun(subject string, phase dto.CalibrationPhase, channels int) *calibrationRun {
+	return &calibrationRun{
+		subject:  subject,
+		phase:    phase,
+		channels: channels,
+		sum:      make([]float64, channels),
+		sumSq:    make([]float64, channels),
+		peak:     make([]float64, channels),
+	}
+}
+
+func (r *calibrationRun) add(raw []int) {
+	chs := utils.Deinterleave(raw, r.channels)
+	if len(chs[0]) == 0 {
+		return
+	}
+
+	for ch, x := range chs {
+		for _, v := range x {
+			r.sum[ch] += float64(v)
+			r.sumSq[ch] += float64(v) * float64(v)
+		}
+		r.peak[ch] = math.Max(r.peak[ch], math.Sqrt(utils.VAR(x)))
+	}
+	r.n += len(chs[0])
+}
+
+func (r *calibrationRun) levels() []float64 {
+	if r.phase == dto.CalibrationMVC {
+		return append([]float64(nil), r.peak...)
+	}
+
+	out := make([]float64, r.channels)
+	for ch := range out {
+		mean := r.sum[ch] / float64(r.n)
+		out[ch] = math.Sqrt(math.Max(r.sumSq[ch]/float64(r.n)-mean*mean, 0))
+	}
+	return out
+}
+
+// pooled is the RMS of per-channel levels, the level of the envelope onset
+// detection pools over the channels.
+func pooled(levels []float64) float64 {
+	if len(levels) == 0 {
+		return 0
+	}
+
+	sq := 0.0
+	for _, l := range levels {
+		sq += l * l
+	}
+	return math.Sqrt(sq / float64(len(levels)))
+}
+
+// WSStartCalibration puts the device into calibration mode for one phase.
+func (s *Service) WSStartCalibration(ctx context.Context, msg models.WsFrontendToBackend, owner string) (*models.WsBackendToEsp, error) {
+	subject := strings.TrimSpace(msg.Subject)
+	if subject == "" {
+		return nil, fmt.Errorf("%w: subject is required", cerrors.ErrInvalidCalibration)
+	}
+
+	phase := dto.CalibrationPhase(msg.Phase)
+	duration := s.restDuration
+	switch phase {
+	case dto.CalibrationRest:
+	case dto.CalibrationMVC:
+		duration = s.mvcDuration
+	default:
+		return nil, fmt.Errorf("%w: phase must be rest or mvc", cerrors.ErrInvalidCalibration)
+	}
+
+	if err := s.checkReservation(ctx, msg.DeviceID, owner); err != nil {
+		return nil, err
+	}
+
+	dev, err := s.repo.GetDeviceById(ctx, msg.DeviceID)
+	if err != nil {
+		return nil, err
+	}
+
+	if dev.Disabled {
+		return nil, cerrors.ErrDeviceDisabled
+	}
+
+	if dev.Status == dto.DeviceStatusDisconnected {
+		return nil, cerrors.ErrDeviceDisconnected
+	}
+
+	if err := s.checkIdle(msg.DeviceID); err != nil {
+		return nil, err
+	}
+
+	run := newCalibrationRun(subject, phase, s.deviceChannels(ctx, msg.DeviceID))
+
+	s.modeMu.Lock()
+	s.calibrations[msg.DeviceID] = run
+	s.modeMu.Unlock()
+
+	s.setDeviceMode(msg.DeviceID, dto.DeviceModeCalibration)
+
+	if err := s.setDeviceStatus(ctx, msg.DeviceID, dto.DeviceStatusStreaming); err != nil {
+		return nil, err
+	}
+
+	return &models.WsBackendToEsp{
+		Event:      models.EventESPStartCalibration,
+		Duration:   duration,
+		ServerTime: time.Now().UnixMilli(),
+		Phase:      string(phase),
+	}, nil
+}
+
+// calibrationPacket handles calibration_data and calibration_finish, the
+// levels are stored when the phase finishes.
+func (s *Service) calibrationPacket(ctx context.Context, msg models.WsEspToBackend, deviceId int) (*models.WsBackendToFrontend, error) {
+	s.modeMu.Lock()
+	run := s.calibrations[deviceId]
+	if run != nil && msg.Event == models.EventCalibrationData {
+		run.add(msg.Raw)
+	}
+	s.modeMu.Unlock()
+
+	if run == nil {
+		return nil, cerrors.ErrSomethingWentWrong
+	}
+
+	if msg.Event == models.EventCalibrationData {
+		ts := s.clock.ToServerTime(deviceId, msg.Timestamp, time.Now())
+		return &models.WsBackendToFrontend{
+			Event:    models.EventCalibrationData,
+			DeviceID: deviceId,
+			Status:   string(run.phase),
+			Raw: []models.RawSample{{
+				Timestamp: ts.UTC().Format(time.RFC3339Nano),
+				Raw:       msg.Raw,
+			}},
+		}, nil
+	}
+
+	s.setDeviceMode(deviceId, dto.DeviceModeIdle)
+
+	if err := s.setDeviceStatus(ctx, deviceId, s.restingStatus(ctx, deviceId)); err != nil {
+		slog.ErrorContext(ctx, "update device status", "err", err)
+	}
+
+	resp := &models.WsBackendToFrontend{
+		Event:    models.EventCalibrationCompleted,
+		DeviceID: deviceId,
+		Status:   string(run.phase),
+	}
+
+	if run.n == 0 {
+		resp.Message = fmt.Sprintf("%s calibration of %s recorded no samples, start it again", run.phase, run.subject)
+		return resp, nil
+	}
+
+	c, err := s.saveCalibration(ctx, deviceId, run)
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Message = fmt.Sprintf("%s levels of %s: %s", run.phase, run.subject, formatLevels(run.levels()))
+	if c.Ready() {
+		resp.Message += fmt.Sprintf(", calibration complete (rest %.1f, mvc %.1f)", c.RestRMS, c.MVCRMS)
+	}
+
+	return resp, nil
+}
+
+func (s *Service) saveCalibration(ctx context.Context, deviceId int, run *calibrationRun) (*dto.Calibration, error) {
+	c, err := s.repo.GetCalibration(ctx, deviceId, run.subject)
+	if errors.Is(err, cerrors.ErrNotFound) {
+		c, err = &dto.Calibration{DeviceID: deviceId, Subject: run.subject}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	levels := run.levels()
+	if run.phase == dto.CalibrationMVC {
+		c.MVCLevels, c.MVCRMS, c.MVCAt = levels, pooled(levels), &now
+	} else {
+		c.RestLevels, c.RestRMS, c.RestAt = levels, pooled(levels), &now
+	}
+
+	if err := s.repo.UpsertCalibration(ctx, c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// liveCalibration returns the calibration used to normalise live predictions,
+// nil when the stream was started without a calibrated subject.
+func (s *Service) liveCalibration(deviceId int) *dto.Calibration {
+	s.modeMu.Lock()
+	defer s.modeMu.Unlock()
+	return s.liveCalibrations[deviceId]
+}
+
+func (s *Service) setLiveCalibration(deviceId int, c *dto.Calibration) {
+	if c == nil {
+		return
+	}
+
+	s.modeMu.Lock()
+	defer s.modeMu.Unlock()
+	s.liveCalibrations[deviceId] = c
+}
+
+// loadCalibration returns nil without error when the subject has no complete
+// calibration, data is then used unnormalised.
+func (s *Service) loadCalibration(ctx context.Context, deviceId int, subject string) (*dto.Calibration, error) {
+	if subject == "" {
+		return nil, nil
+	}
+
+	c, err := s.repo.GetCalibration(ctx, deviceId, subject)
+	if errors.Is(err, cerrors.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !c.Ready() {
+		return nil, nil
+	}
+
+	// recorded before the active channels changed, the levels belong to
+	// other channels
+	if channels := s.deviceChannels(ctx, deviceId); c.Channels() != channels {
+		slog.WarnContext(ctx, "calibration channels differ from the device, not used", "subject", subject, "calibrated", c.Channels(), "active", channels)
+		return nil, nil
+	}
+
+	return c, nil
+}
+
+func formatLevels(levels []float64) string {
+	strs := make([]string, len(levels))
+	for i, v := range levels {
+		strs[i] = strconv.FormatFloat(v, 'f', 1, 64)
+	}
+	return strings.Join(strs, " / ")
+}
+
+func (s *Service) ListCalibrations(ctx context.Context, deviceId int) ([]dto.Calibration, error) {
+	if _, err := s.repo.GetDeviceById(ctx, deviceId); err != nil {
+		return nil, err
+	}
+
+	return s.repo.ListCalibrations(ctx, deviceId)
+}
@@ -0,0 +1,118 @@
+package svc
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/dto"
+)
+
+// channel is one simulated electrode: a unipolar ADC offset, gaussian rest
+// noise and the amplitude of an 80 Hz sine at maximum contraction.
+type channel struct {
+	offset, noise, mvc float64
+}
+
+// record returns packets of frames samples per channel, interleaved. active
+// says per channel whether it contracts at full strength.
+func record(rng *rand.Rand, chs []channel, packets, frames int, active ...bool) [][]int {
+	out := make([][]int, packets)
+	for p := range out {
+		raw := make([]int, 0, frames*len(chs))
+		for f := range frames {
+			for ch, c := range chs {
+				v := c.offset + rng.NormFloat64()*c.noise
+				if ch < len(active) && active[ch] {
+					v += c.mvc * math.Sin(2*math.Pi*80*float64(f)/1000)
+				}
+				raw = append(raw, int(math.Round(v)))
+			}
+		}
+		out[p] = raw
+	}
+	return out
+}
+
+func TestCalibrationNormalizesFeatures(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// a strong and a weak muscle on different offsets
+	chs := []channel{
+		{offset: 2000, noise: 10, mvc: 1200},
+		{offset: 800, noise: 4, mvc: 200},
+	}
+	const frames = 50 // 4 whole periods of 80 Hz at 1 kHz
+
+	levels := func(phase dto.CalibrationPhase, active ...bool) []float64 {
+		run := newCalibrationRun("anna", phase, len(chs))
+		for _, raw := range record(rng, chs, 60, frames, active...) {
+			run.add(raw)
+		}
+		return run.levels()
+	}
+	cal := &dto.Calibration{
+		RestLevels: levels(dto.CalibrationRest),
+		MVCLevels:  levels(dto.CalibrationMVC, true, true),
+	}
+
+	for ch, c := range chs {
+		if d := cal.RestLevels[ch] - c.noise; math.Abs(d) > c.noise*0.1 {
+			t.Errorf("channel %d rest level %.2f, want about %.0f without the offset", ch, cal.RestLevels[ch], c.noise)
+		}
+		if want := c.mvc / math.Sqrt2; math.Abs(cal.MVCLevels[ch]-want) > want*0.05 {
+			t.Errorf("channel %d mvc level %.1f, want about %.1f", ch, cal.MVCLevels[ch], want)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		active  []bool
+		wantRMS float64 // in fractions of MVC, pooled over the channels
+	}{
+		{name: "rest", wantRMS: 0},
+		{name: "full contraction", active: []bool{true, true}, wantRMS: 1},
+		// scaled by the strong channel's MVC the weak one would be at 0.17
+		{name: "only the weak channel at its mvc", active: []bool{false, true}, wantRMS: math.Sqrt(0.5)},
+		{name: "only the strong channel at its mvc", active: []bool{true, false}, wantRMS: math.Sqrt(0.5)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, raw := range record(rng, chs, 5, frames, tt.active...) {
+				f := cal.Features(raw)
+				if rms := f[1]; math.Abs(rms-tt.wantRMS) > 0.1 {
+					t.Errorf("packet %d: normalised RMS %.3f, want %.2f ± 0.1", i, rms, tt.wantRMS)
+				}
+				if v := f[3]; math.Abs(v-tt.wantRMS*tt.wantRMS) > 0.1 {
+					t.Errorf("packet %d: normalised VAR %.3f, want %.2f ± 0.1", i, v, tt.wantRMS*tt.wantRMS)
+				}
+			}
+		})
+	}
+}
+
+func TestCalibrationReady(t *testing.T) {
+	now := time.Now()
+	at := &now
+
+	tests := []struct {
+		name      string
+		rest, mvc []float64
+		want      bool
+	}{
+		{"complete", []float64{5, 2}, []float64{800, 150}, true},
+		{"one channel below rest", []float64{5, 2}, []float64{800, 1}, false},
+		{"channels changed between phases", []float64{5}, []float64{800, 150}, false},
+		{"no channels", nil, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &dto.Calibration{RestLevels: tt.rest, MVCLevels: tt.mvc, RestAt: at, MVCAt: at}
+			if got := c.Ready(); got != tt.want {
+				t.Errorf("Ready %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
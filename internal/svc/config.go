@@ -0,0 +1,156 @@
+package svc
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/cerrors"
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/models"
+)
+
+// defaultChannelCount is assumed for devices that did not report theirs at
+// handshake.
+const defaultChannelCount = 8
+
+var validGains = map[int]bool{1: true, 2: true, 4: true, 6: true, 8: true, 12: true, 24: true}
+
+// OnESPCommand sets the callback used to push commands that do not originate
+// from the ESP socket itself (config edits over REST). It reports false when
+// the device is not connected.
+func (s *Service) OnESPCommand(fn func(deviceID int, msg *models.WsBackendToEsp) bool) {
+	s.espCommand = fn
+}
+
+// OnESPDisconnect sets the callback used to close a device's ESP socket. It
+// reports false when the device is not connected.
+func (s *Service) OnESPDisconnect(fn func(deviceID int) bool) {
+	s.espDisconnect = fn
+}
+
+// OnDeviceDeleted sets the callback run after a device was removed from the
+// registry, to drop what is kept per device outside the service.
+func (s *Service) OnDeviceDeleted(fn func(deviceID int)) {
+	s.deviceDeleted = fn
+}
+
+func validateConfig(cfg models.DeviceConfig, channelCount int) error {
+	if channelCount <= 0 {
+		channelCount = defaultChannelCount
+	}
+
+	if cfg.SampleRate < 100 || cfg.SampleRate > 4000 {
+		return fmt.Errorf("%w: sample_rate must be within 100..4000 Hz", cerrors.ErrInvalidConfig)
+	}
+
+	if !validGains[cfg.Gain] {
+		return fmt.Errorf("%w: gain must be one of 1, 2, 4, 6, 8, 12, 24", cerrors.ErrInvalidConfig)
+	}
+
+	if cfg.PacketSize < 1 || cfg.PacketSize > 256 {
+		return fmt.Errorf("%w: packet_size must be within 1..256", cerrors.ErrInvalidConfig)
+	}
+
+	if len(cfg.ActiveChannels) == 0 {
+		return fmt.Errorf("%w: at least one active channel is required", cerrors.ErrInvalidConfig)
+	}
+
+	seen := make(map[int]bool, len(cfg.ActiveChannels))
+	for _, ch := range cfg.ActiveChannels {
+		if ch < 0 || ch >= channelCount || seen[ch] {
+			return fmt.Errorf("%w: active channel %d invalid for %d channels", cerrors.ErrInvalidConfig, ch, channelCount)
+		}
+		seen[ch] = true
+	}
+
+	switch cfg.WifiPowerMode {
+	case models.WifiPowerNone, models.WifiPowerMin, models.WifiPowerMax:
+	default:
+		return fmt.Errorf("%w: wifi_power_mode must be none, min or max", cerrors.ErrInvalidConfig)
+	}
+
+	return nil
+}
+
+// SetDeviceConfig stores cfg as a new version and pushes it when the device
+// is connected, otherwise it goes out on the next handshake. Changing the
+// config while the device streams would mix sample rates in one recording,
+// so it is refused.
+func (s *Service) SetDeviceConfig(ctx context.Context, deviceId int, cfg models.DeviceConfig, owner string) (*dto.DeviceConfigVersion, bool, error) {
+	dev, err := s.repo.GetDeviceById(ctx, deviceId)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := validateConfig(cfg, dev.ChannelCount); err != nil {
+		return nil, false, err
+	}
+
+	if err := s.checkIdle(deviceId); err != nil {
+		return nil, false, err
+	}
+
+	v, err := s.repo.InsertDeviceConfig(ctx, deviceId, cfg, owner)
+	if err != nil {
+		return nil, false, err
+	}
+
+	pushed := s.espCommand != nil && s.espCommand(deviceId, setConfigCommand(v))
+
+	return v, pushed, nil
+}
+
+func (s *Service) GetDeviceConfig(ctx context.Context, deviceId int) (*dto.DeviceConfigVersion, error) {
+	return s.repo.GetLatestDeviceConfig(ctx, deviceId)
+}
+
+func (s *Service) GetDeviceConfigHistory(ctx context.Context, deviceId int) ([]dto.DeviceConfigVersion, error) {
+	if _, err := s.repo.GetDeviceById(ctx, deviceId); err != nil {
+		return nil, err
+	}
+
+	return s.repo.ListDeviceConfigs(ctx, deviceId)
+}
+
+// PendingConfig returns the set_config to send after a handshake. The latest
+// version is always sent, the ESP may have rebooted with its defaults.
+func (s *Service) PendingConfig(ctx context.Context, deviceId int) (*models.WsBackendToEsp, error) {
+	v, err := s.repo.GetLatestDeviceConfig(ctx, deviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	return setConfigCommand(v), nil
+}
+
+// WSConfigAck records the ESP's answer to set_config and returns the event
+// for the device's frontends.
+func (s *Service) WSConfigAck(ctx context.Context, msg models.WsEspToBackend, deviceId int) (*models.WsBackendToFrontend, error) {
+	if err := s.repo.AckDeviceConfig(ctx, deviceId, msg.ConfigVersion, msg.Error); err != nil {
+		return nil, err
+	}
+
+	resp := &models.WsBackendToFrontend{
+		Event:    models.EventConfigApplied,
+		DeviceID: deviceId,
+		Message:  fmt.Sprintf("config version %d applied", msg.ConfigVersion),
+	}
+
+	if msg.Error != "" {
+		resp.Message = fmt.Sprintf("config version %d rejected by device: %s", msg.ConfigVersion, msg.Error)
+	}
+
+	return resp, nil
+}
+
+func setConfigCommand(v *dto.DeviceConfigVersion) *models.WsBackendToEsp {
+	cfg := v.Config
+
+	return &models.WsBackendToEsp{
+		Event:         models.EventESPSetConfig,
+		ServerTime:    time.Now().UnixMilli(),
+		ConfigVersion: v.Version,
+		Config:        &cfg,
+	}
+}
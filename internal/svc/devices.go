@@ -0,0 +1,148 @@
+package svc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"emg_esp32_classifier_backend/pkg/auth"
+	"emg_esp32_classifier_backend/pkg/cerrors"
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/logging"
+)
+
+// ProvisionDevice registers a device before it ever connects. The returned
+// token has to be flashed into the ESP, only its hash is stored.
+func (s *Service) ProvisionDevice(ctx context.Context, name string, tags []string) (*dto.Device, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", cerrors.ErrInvalidName
+	}
+
+	dev, err := s.repo.InsertDevice(ctx, name, tags)
+	if err != nil {
+		return nil, "", err
+	}
+
+	token, err := s.rotateDeviceToken(ctx, dev.ID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return dev, token, nil
+}
+
+func (s *Service) GetDevice(ctx context.Context, deviceId int) (*dto.Device, error) {
+	dev, err := s.repo.GetDeviceById(ctx, deviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	dev.Mode = s.deviceMode(deviceId)
+
+	return dev, nil
+}
+
+func (s *Service) UpdateDevice(ctx context.Context, deviceId int, upd dto.DeviceUpdate) (*dto.Device, error) {
+	if upd.Name != nil {
+		name := strings.TrimSpace(*upd.Name)
+		if name == "" {
+			return nil, cerrors.ErrInvalidName
+		}
+		upd.Name = &name
+	}
+
+	dev, err := s.repo.UpdateDevice(ctx, deviceId, upd)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake refuses it from now on, a connected ESP is dropped so
+	// that it cannot keep streaming
+	if dev.Disabled && s.espDisconnect != nil && s.espDisconnect(deviceId) {
+		slog.InfoContext(logging.WithDevice(ctx, deviceId), "disabled device disconnected")
+	}
+
+	return dev, nil
+}
+
+// DeleteDevice only works for devices without recorded trainings, disable
+// those instead.
+func (s *Service) DeleteDevice(ctx context.Context, deviceId int) error {
+	if _, ok := s.session.Get(deviceId); ok {
+		return cerrors.ErrDeviceBusy
+	}
+
+	if err := s.repo.DeleteDevice(ctx, deviceId); err != nil {
+		return err
+	}
+
+	if s.deviceDeleted != nil {
+		s.deviceDeleted(deviceId)
+	}
+
+	return nil
+}
+
+// RotateDeviceToken invalidates the old token, a connected ESP keeps its
+// socket until it reconnects.
+func (s *Service) RotateDeviceToken(ctx context.Context, deviceId int) (string, error) {
+	if _, err := s.repo.GetDeviceById(ctx, deviceId); err != nil {
+		return "", err
+	}
+
+	return s.rotateDeviceToken(ctx, deviceId)
+}
+
+func (s *Service) rotateDeviceToken(ctx context.Context, deviceId int) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	if err := s.repo.SetDeviceSecretHash(ctx, deviceId, auth.HashSecret(token)); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// SetDeviceDebug switches debug logging for one device, it lasts until the
+// process restarts.
+func (s *Service) SetDeviceDebug(ctx context.Context, deviceId int, on bool) error {
+	if _, err := s.repo.GetDeviceById(ctx, deviceId); err != nil {
+		return err
+	}
+
+	logging.SetDeviceDebug(deviceId, on)
+	slog.InfoContext(logging.WithDevice(ctx, deviceId), "device debug logging", "enabled", on)
+
+	return nil
+}
+
+// ResetDeviceStatus overwrites a status that got stuck, e.g. streaming after
+// a crash. A connected device sets its real status again with its next
+// packet.
+func (s *Service) ResetDeviceStatus(ctx context.Context, deviceId int, status dto.DeviceStatus) error {
+	switch status {
+	case dto.DeviceStatusIdle, dto.DeviceStatusStreaming, dto.DeviceStatusReserved, dto.DeviceStatusDisconnected:
+	default:
+		return fmt.Errorf("%w: %q", cerrors.ErrInvalidStatus, status)
+	}
+
+	if _, err := s.repo.GetDeviceById(ctx, deviceId); err != nil {
+		return err
+	}
+
+	if err := s.setDeviceStatus(ctx, deviceId, status); err != nil {
+		return err
+	}
+
+	slog.InfoContext(logging.WithDevice(ctx, deviceId), "device status reset", "status", status)
+
+	return nil
+}
@@ -0,0 +1,20 @@
+package svc
+
+import (
+	"context"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/health"
+)
+
+// RegisterHealthChecks adds the ML service check. It is not critical: without
+// it training still records, only live predictions are missing.
+func (s *Service) RegisterHealthChecks(c *health.Checker) {
+	c.Add(health.Check{
+		Name:    "ml",
+		Timeout: 2 * time.Second,
+		Fn: func(ctx context.Context) error {
+			return s.ml.Health(ctx)
+		},
+	})
+}
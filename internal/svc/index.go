@@ -3,40 +3,105 @@ package svc
 import (
 	"bytes"
 	"context"
+	"crypto/subtle"
+	"emg_esp32_classifier_backend/internal/config"
 	"emg_esp32_classifier_backend/internal/mlclient"
 	"emg_esp32_classifier_backend/internal/repo"
+	"emg_esp32_classifier_backend/pkg/auth"
 	"emg_esp32_classifier_backend/pkg/cerrors"
+	"emg_esp32_classifier_backend/pkg/clocksync"
 	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/logging"
 	"emg_esp32_classifier_backend/pkg/models"
+	"emg_esp32_classifier_backend/pkg/onset"
+	"emg_esp32_classifier_backend/pkg/quality"
 	"emg_esp32_classifier_backend/pkg/sessions"
+	"emg_esp32_classifier_backend/pkg/tracing"
 	"emg_esp32_classifier_backend/pkg/utils"
 	"encoding/csv"
-	"log"
+	"errors"
+	"log/slog"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 type Service struct {
 	repo    repo.Repository
 	session *sessions.SessionManager
 	ml      *mlclient.Client
+	clock   *clocksync.Registry
+
+	resumePolicy sessions.ResumePolicy
+	onsetMethod  onset.Method
+
+	// per training, durations in whole seconds as the ESP takes them
+	repetitions  int
+	repDuration  int
+	restDuration int
+	mvcDuration  int
+
+	// espEnrollSecret lets devices without a stored token register one,
+	// empty disables enrollment
+	espAuth         bool
+	espEnrollSecret string
+
+	statusMu       sync.Mutex
+	statuses       map[int]dto.DeviceStatus
+	statusListener func(deviceID int, status dto.DeviceStatus)
+
+	espCommand    func(deviceID int, msg *models.WsBackendToEsp) bool
+	espDisconnect func(deviceID int) bool
+	deviceDeleted func(deviceID int)
+
+	modeMu           sync.Mutex
+	modes            map[int]dto.DeviceMode
+	calibrations     map[int]*calibrationRun
+	liveCalibrations map[int]*dto.Calibration
+	monitors         map[int]*qualityMonitor
 }
 
-func NewService(repo repo.Repository) *Service {
+// NewService expects a validated cfg.
+func NewService(repo repo.Repository, cfg *config.Config) *Service {
 	return &Service{
 		repo:    repo,
-		session: sessions.NewSessionManager(),
-		ml:      mlclient.New("http://emg-ml:8000"),
+		session: sessions.NewSessionManager(repo),
+		ml:      mlclient.New(cfg.ML.BaseURL(), time.Duration(cfg.ML.Timeout)),
+		clock:   clocksync.NewRegistry(),
+
+		resumePolicy: sessions.ResumePolicy(cfg.Training.ResumePolicy),
+		onsetMethod:  onset.Method(cfg.Training.OnsetMethod),
+
+		repetitions:  cfg.Training.Repetitions,
+		repDuration:  seconds(cfg.Training.RepDuration),
+		restDuration: seconds(cfg.Training.RestDuration),
+		mvcDuration:  seconds(cfg.Training.MVCDuration),
+
+		espAuth:         !cfg.Auth.Disabled,
+		espEnrollSecret: cfg.Auth.ESPEnrollSecret,
+
+		statuses: make(map[int]dto.DeviceStatus),
+		modes:    make(map[int]dto.DeviceMode),
+		monitors: make(map[int]*qualityMonitor),
+
+		calibrations:     make(map[int]*calibrationRun),
+		liveCalibrations: make(map[int]*dto.Calibration),
 	}
 }
 
 // from frontend
-func (s *Service) WSStartTraining(ctx context.Context, msg models.WsFrontendToBackend) (*models.WsBackendToEsp, error) {
-	if msg.Rep > 5 {
+func (s *Service) WSStartTraining(ctx context.Context, msg models.WsFrontendToBackend, owner string) (*models.WsBackendToEsp, error) {
+	if msg.Rep > s.repetitions {
 		return nil, cerrors.ErrIncorrectRep
 	}
 
+	if err := s.checkReservation(ctx, msg.DeviceID, owner); err != nil {
+		return nil, err
+	}
+
 	if _, err := s.repo.GetMovementsById(ctx, msg.MovementID); err != nil {
 		return nil, err
 	}
@@ -46,8 +111,16 @@ func (s *Service) WSStartTraining(ctx context.Context, msg models.WsFrontendToBa
 		return nil, err
 	}
 
-	if dev.Status == dto.DeviceStatusStreaming {
-		return nil, cerrors.ErrDeviceBusy
+	if dev.Disabled {
+		return nil, cerrors.ErrDeviceDisabled
+	}
+
+	if dev.Status == dto.DeviceStatusDisconnected {
+		return nil, cerrors.ErrDeviceDisconnected
+	}
+
+	if err := s.checkIdle(msg.DeviceID); err != nil {
+		return nil, err
 	}
 
 	ss, exists := s.session.Get(msg.DeviceID)
@@ -57,8 +130,10 @@ func (s *Service) WSStartTraining(ctx context.Context, msg models.WsFrontendToBa
 			return nil, cerrors.ErrIncorrectRep
 		}
 
+		subject := strings.TrimSpace(msg.Subject)
+
 		var tID int
-		tID, err = s.repo.CreateTraining(ctx, msg.DeviceID, msg.MovementID, msg.Rep)
+		tID, err = s.repo.CreateTraining(ctx, msg.DeviceID, msg.MovementID, msg.Rep, subject)
 		if err != nil {
 			return nil, err
 		}
@@ -68,6 +143,8 @@ func (s *Service) WSStartTraining(ctx context.Context, msg models.WsFrontendToBa
 			Rep:        msg.Rep,
 			MovementID: msg.MovementID,
 			DeviceID:   msg.DeviceID,
+			Subject:    subject,
+			Duration:   s.repDuration,
 		}
 
 		s.session.Set(msg.DeviceID, ss)
@@ -76,100 +153,149 @@ func (s *Service) WSStartTraining(ctx context.Context, msg models.WsFrontendToBa
 			return nil, cerrors.ErrMovementNotAllowed
 		}
 
-		if msg.Rep != ss.Rep+1 {
+		// the last rep may be recorded again once its quality was flagged
+		redo := msg.Rep == ss.Rep
+		if !redo && msg.Rep != ss.Rep+1 {
 			return nil, cerrors.ErrIncorrectRep
 		}
 
+		if ss.Recording {
+			return nil, cerrors.ErrDeviceBusy
+		}
+
+		if redo {
+			flagged, err := s.repFlagged(ctx, ss.TrainingID, ss.Rep)
+			if err != nil {
+				return nil, err
+			}
+			if !flagged {
+				return nil, cerrors.ErrRepNotFlagged
+			}
+
+			if err := s.repo.DeleteTrainingRawRepetition(ctx, ss.TrainingID, ss.Rep); err != nil {
+				return nil, err
+			}
+		}
+
 		s.session.Update(msg.DeviceID, func(sx *sessions.Session) {
 			sx.Rep = msg.Rep
 			sx.TrainingID = ss.TrainingID
+			sx.Duration = s.repDuration
 		})
 	}
 
+	s.setDeviceMode(msg.DeviceID, dto.DeviceModeRecording)
+
+	slog.InfoContext(logging.WithTraining(ctx, ss.TrainingID, msg.Rep), "repetition started", "movement_id", msg.MovementID, "subject", ss.Subject)
+
 	return &models.WsBackendToEsp{
 		Event:      models.EventESPStartRawStream,
-		Duration:   models.DefaultDurationOfTraining,
+		Duration:   s.repDuration,
 		ServerTime: time.Now().UnixMilli(),
+		MovementID: msg.MovementID,
 	}, nil
 }
 
-// from esp
+// from esp, every packet has to match the mode the device was put in
 func (s *Service) WSRawStream(ctx context.Context, msg models.WsEspToBackend, deviceId int) (*models.WsBackendToFrontend, error) {
+	if err := s.checkPacketMode(deviceId, msg.Event); err != nil {
+		return nil, err
+	}
+
+	switch msg.Event {
+	case models.EventLiveStreamData:
+		return s.liveStream(ctx, msg, deviceId)
+	case models.EventCalibrationData, models.EventCalibrationFinish:
+		return s.calibrationPacket(ctx, msg, deviceId)
+	}
+
 	ss, ex := s.session.Get(deviceId)
+	if !ex {
+		return nil, cerrors.ErrSomethingWentWrong
+	}
+
+	ctx = logging.WithTraining(ctx, ss.TrainingID, ss.Rep)
 
 	var event models.Event
-	var Prob []float64
-	var ClassID int
-	var ClassName string
+	var q *quality.Metrics
+	var message string
 
 	raw := []models.RawSample{}
 
 	switch msg.Event {
 	case models.EventRawStreamBegin:
-		if !ex {
-			return nil, cerrors.ErrSomethingWentWrong
-		}
-
 		event = models.EventTrainingStarted
-		if err := s.repo.UpdateDeviceStatus(ctx, deviceId, dto.DeviceStatusStreaming); err != nil {
-			log.Printf("[RawStream][EventRawStreamBegin][UpdateDeviceStatus]: %v\n", err)
+		s.session.Update(deviceId, func(sx *sessions.Session) {
+			// a resumed rep keeps its start so the remaining time stays right
+			if !sx.Recording {
+				sx.Recording = true
+				sx.RepStartedAt = time.Now()
+			}
+			sx.InterruptedAt = time.Time{}
+		})
+
+		if err := s.setDeviceStatus(ctx, deviceId, dto.DeviceStatusStreaming); err != nil {
+			slog.ErrorContext(ctx, "update device status", "err", err)
 		}
 		raw = nil
 	case models.EventRawStreamInProc:
-		if ex {
-			event = models.EventTrainingRawData
-			err := s.repo.InsertTrainingRaw(ctx, dto.MapWsToTrainingRaw(msg.Raw, msg.Timestamp, ss))
-			if err != nil {
-				return nil, err
-			}
+		event = models.EventTrainingRawData
+		ts := s.clock.ToServerTime(deviceId, msg.Timestamp, time.Now())
+		err := s.repo.InsertTrainingRaw(ctx, dto.MapWsToTrainingRaw(msg.Raw, ts, ss))
+		if err != nil {
+			return nil, err
+		}
 
-			raw, err = s.repo.SelectTrainingRawSamples(ctx, ss.TrainingID, ss.DeviceID)
-			if err != nil {
-				return nil, err
-			}
+		raw, err = s.repo.SelectTrainingRawSamples(ctx, ss.TrainingID, ss.DeviceID)
+		if err != nil {
+			return nil, err
+		}
 
-			if err = s.repo.UpdateDeviceStatus(ctx, deviceId, dto.DeviceStatusStreaming); err != nil {
-				log.Printf("[RawStream][EventRawStreamBegin][UpdateDeviceStatus]: %v\n", err)
-			}
-		} else {
-			event = models.EventStreamingData
-			if err := s.repo.UpdateDeviceStatus(ctx, deviceId, dto.DeviceStatusStreaming); err != nil {
-				log.Printf("[RawStream][EventRawStreamBegin][UpdateDeviceStatus]: %v\n", err)
-			}
+		if err = s.setDeviceStatus(ctx, deviceId, dto.DeviceStatusStreaming); err != nil {
+			slog.ErrorContext(ctx, "update device status", "err", err)
+		}
 
-			features := utils.ExtractFeatures(msg.Raw)
+		m := s.packetQuality(ctx, deviceId, msg.Raw, s.sessionCalibration(ctx, ss))
+		q = &m
+		slog.DebugContext(ctx, "raw packet stored", "samples", len(msg.Raw), "score", m.Score)
 
-			pred, err := s.ml.Predict(features)
-			if err != nil {
-				log.Printf("[ML ERROR] %v", err)
-			}
+	case models.EventRawStreamFinish:
+		event = models.EventTrainingCompleted
+		s.session.Update(deviceId, func(sx *sessions.Session) {
+			sx.Recording = false
+		})
 
-			ClassID = pred.ClassID
-			ClassName = pred.ClassName
-			Prob = pred.Probabilities
+		m := s.repQuality(deviceId)
+		q = &m
+		if err := s.repo.UpsertRepetitionQuality(ctx, ss.TrainingID, ss.Rep, m); err != nil {
+			slog.ErrorContext(ctx, "store repetition quality", "err", err)
+		}
+		if m.Flagged {
+			message = qualityMessage(ss.Rep, m)
 		}
 
-	case models.EventRawStreamFinish:
-
-		if !ex {
-			return nil, cerrors.ErrSomethingWentWrong
+		if _, err := s.detectSegments(ctx, ss); err != nil {
+			slog.ErrorContext(ctx, "detect segments", "err", err)
 		}
 
-		event = models.EventTrainingCompleted
-		if ss.Rep == 5 {
+		s.setDeviceMode(deviceId, dto.DeviceModeIdle)
+
+		// a flagged last rep keeps the session so it can be recorded again
+		if ss.Rep == s.repetitions && !m.Flagged {
 			defer s.session.Delete(deviceId)
-			if err := s.repo.UpdateDeviceStatus(ctx, deviceId, dto.DeviceStatusIdle); err != nil {
-				log.Printf("[RawStream][EventRawStreamFinish][UpdateDeviceStatus]: %v", err)
+			if err := s.setDeviceStatus(ctx, deviceId, s.restingStatus(ctx, deviceId)); err != nil {
+				slog.ErrorContext(ctx, "update device status", "err", err)
 			}
 
-			if err := s.repo.DeleteTraining(ctx, ss.TrainingID); err != nil {
-				log.Printf("[RawStream][EventRawStreamFinish][DeleteTraining]: %v\n", err)
+			// the training row is kept, exports read its subject
+			if err := s.repo.MarkTrainingFinished(ctx, ss.TrainingID); err != nil {
+				slog.ErrorContext(ctx, "mark training finished", "err", err)
 			}
 		}
 
-		if ss.Rep < 5 {
-			if err := s.repo.UpdateDeviceStatus(ctx, deviceId, dto.DeviceStatusReserved); err != nil {
-				log.Printf("[RawStream][EventRawStreamBegin][UpdateDeviceStatus]: %v\n", err)
+		if ss.Rep < s.repetitions || m.Flagged {
+			if err := s.setDeviceStatus(ctx, deviceId, dto.DeviceStatusReserved); err != nil {
+				slog.ErrorContext(ctx, "update device status", "err", err)
 			}
 		}
 
@@ -181,39 +307,216 @@ func (s *Service) WSRawStream(ctx context.Context, msg models.WsEspToBackend, de
 		DeviceID:   deviceId,
 		MovementID: ss.MovementID,
 		Rep:        ss.Rep,
+		Message:    message,
 		Raw:        raw,
-		Prob:       Prob,
-		ClassID:    ClassID,
-		ClassName:  ClassName,
+		Quality:    q,
 	}, nil
 }
 
-func (s *Service) RegisterDevice(ctx context.Context, deviceName string) (int, error) {
-	dev, err := s.repo.InsertDevice(ctx, deviceName)
+// liveStream classifies one live packet, nothing is stored. Features are
+// normalised when the stream was started for a calibrated subject. A failed
+// prediction still forwards the samples so the frontend keeps drawing.
+func (s *Service) liveStream(ctx context.Context, msg models.WsEspToBackend, deviceId int) (*models.WsBackendToFrontend, error) {
+	if err := s.setDeviceStatus(ctx, deviceId, dto.DeviceStatusStreaming); err != nil {
+		slog.ErrorContext(ctx, "update device status", "err", err)
+	}
+
+	ts := s.clock.ToServerTime(deviceId, msg.Timestamp, time.Now())
+
+	resp := &models.WsBackendToFrontend{
+		Event:    models.EventStreamingData,
+		DeviceID: deviceId,
+		Raw: []models.RawSample{{
+			Timestamp: ts.UTC().Format(time.RFC3339Nano),
+			Raw:       msg.Raw,
+		}},
+	}
+
+	cal := s.liveCalibration(deviceId)
+
+	m := s.packetQuality(ctx, deviceId, msg.Raw, func() *dto.Calibration { return cal })
+	resp.Quality = &m
+
+	_, span := tracing.Start(ctx, "features", attribute.Bool("normalized", cal != nil))
+	var features []float64
+	if cal != nil {
+		features = cal.Features(msg.Raw)
+	} else {
+		features = utils.ExtractFeatures(msg.Raw)
+	}
+	span.End()
+
+	pred, err := s.ml.Predict(ctx, features)
 	if err != nil {
+		slog.WarnContext(ctx, "ml predict", "err", err)
+		return resp, nil
+	}
+
+	resp.ClassID = pred.ClassID
+	resp.ClassName = pred.ClassName
+	resp.Prob = pred.Probabilities
+
+	slog.DebugContext(ctx, "live prediction", "class", pred.ClassName, "samples", len(msg.Raw))
+
+	return resp, nil
+}
+
+// RegisterDevice looks the device up by name so a returning ESP keeps its ID,
+// only unknown names are inserted. With ESP auth on, a known device must
+// present its token, a device without a token is enrolled with enrollToken
+// and its token is stored from then on.
+func (s *Service) RegisterDevice(ctx context.Context, msg models.WsEspToBackend) (int, error) {
+	deviceName, token, enrollToken := msg.DeviceName, msg.Token, msg.EnrollToken
+
+	dev, err := s.repo.GetDeviceByName(ctx, deviceName)
+	if err != nil && !errors.Is(err, cerrors.ErrNotFound) {
+		return 0, err
+	}
+
+	if dev != nil && dev.Disabled {
+		return 0, cerrors.ErrDeviceDisabled
+	}
+
+	enroll := false
+	if s.espAuth {
+		hash := ""
+		if dev != nil {
+			if hash, err = s.repo.GetDeviceSecretHash(ctx, dev.ID); err != nil {
+				return 0, err
+			}
+		}
+
+		switch {
+		case hash != "":
+			if subtle.ConstantTimeCompare([]byte(auth.HashSecret(token)), []byte(hash)) != 1 {
+				return 0, cerrors.ErrDeviceUnauthorized
+			}
+		case s.espEnrollSecret != "" && token != "" &&
+			subtle.ConstantTimeCompare([]byte(enrollToken), []byte(s.espEnrollSecret)) == 1:
+			enroll = true
+		default:
+			return 0, cerrors.ErrDeviceUnauthorized
+		}
+	}
+
+	if dev == nil {
+		if dev, err = s.repo.InsertDevice(ctx, deviceName, nil); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := s.repo.UpdateDeviceMetadata(ctx, dev.ID, msg.FirmwareVersion, msg.ChannelCount, msg.SampleRate, msg.ADCBits); err != nil {
+		return 0, err
+	}
+
+	if enroll {
+		if err := s.repo.SetDeviceSecretHash(ctx, dev.ID, auth.HashSecret(token)); err != nil {
+			return 0, err
+		}
+		slog.InfoContext(ctx, "device enrolled", "device_name", deviceName, "device_id", dev.ID)
+	}
+
+	// new connection means the ESP may have rebooted, its clock is unknown
+	// again and it is not streaming anything
+	s.clock.Reset(dev.ID)
+	s.setDeviceMode(dev.ID, dto.DeviceModeIdle)
+
+	status := s.restingStatus(ctx, dev.ID)
+	if _, ok := s.session.Get(dev.ID); ok {
+		status = dto.DeviceStatusReserved
+	}
+
+	if err := s.setDeviceStatus(ctx, dev.ID, status); err != nil {
 		return 0, err
 	}
 
 	return dev.ID, nil
 }
 
-func (s *Service) ReserveDevice(ctx context.Context, deviceId int) error {
+// ReserveDevice creates or renews the owner's reservation, someone else's
+// valid reservation is a conflict.
+func (s *Service) ReserveDevice(ctx context.Context, deviceId int, owner string, ttl time.Duration) (*dto.Reservation, error) {
+	if owner == "" {
+		return nil, cerrors.ErrNoClientID
+	}
+
 	dev, err := s.repo.GetDeviceById(ctx, deviceId)
 
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if dev.Disabled {
+		return nil, cerrors.ErrDeviceDisabled
 	}
 
 	if dev.Status == dto.DeviceStatusStreaming {
-		return cerrors.ErrDeviceBusy
+		if res, err := s.repo.GetReservation(ctx, deviceId); err != nil || res.Owner != owner {
+			return nil, cerrors.ErrDeviceBusy
+		}
+	}
+
+	res, err := s.repo.UpsertReservation(ctx, deviceId, owner, time.Now().Add(ttl))
+	if err != nil {
+		return nil, err
+	}
+
+	// a disconnected device keeps its status, the handshake turns it
+	// reserved once the ESP is back
+	if dev.Status == dto.DeviceStatusIdle {
+		if err = s.setDeviceStatus(ctx, deviceId, dto.DeviceStatusReserved); err != nil {
+			return nil, err
+		}
 	}
 
-	if err = s.repo.UpdateDeviceStatus(ctx, deviceId, dto.DeviceStatusReserved); err != nil {
-		return err
+	return res, nil
+}
+
+// to esp, t1 is stamped as late as possible to keep the exchange tight
+func (s *Service) WSTimeSyncRequest() *models.WsBackendToEsp {
+	now := time.Now()
+	return &models.WsBackendToEsp{
+		Event:      models.EventESPTimeSync,
+		ServerTime: now.UnixMilli(),
+		T1:         now.UnixNano(),
+	}
+}
+
+// from esp, received is the server time the reply was read from the socket
+func (s *Service) WSTimeSyncReply(msg models.WsEspToBackend, deviceId int, received time.Time) error {
+	ok := s.clock.Get(deviceId).Add(clocksync.Exchange{
+		T1: msg.T1,
+		T2: msg.T2,
+		T3: msg.T3,
+		T4: received.UnixNano(),
+	})
+	if !ok {
+		return cerrors.ErrInvalidTimeSync
 	}
 
 	return nil
+}
+
+func (s *Service) GetClockSync(ctx context.Context, deviceId int) (*dto.ClockSync, error) {
+	if _, err := s.repo.GetDeviceById(ctx, deviceId); err != nil {
+		return nil, err
+	}
+
+	res := &dto.ClockSync{DeviceID: deviceId}
+
+	est, ok := s.clock.Get(deviceId).Estimate()
+	if !ok {
+		return res, nil
+	}
 
+	res.Synced = true
+	res.OffsetMs = float64(est.Offset) / float64(time.Millisecond)
+	res.DriftPPM = est.Drift * 1e6
+	res.ErrorMs = float64(est.Error) / float64(time.Millisecond)
+	res.Samples = est.Samples
+	res.LastSync = est.LastSync
+
+	return res, nil
 }
 
 func (s *Service) GetDeviceList(ctx context.Context) ([]dto.Device, error) {
@@ -222,38 +525,106 @@ func (s *Service) GetDeviceList(ctx context.Context) ([]dto.Device, error) {
 		return nil, err
 	}
 
-	return dev, nil
+	return s.withModes(dev), nil
 }
 
-func (s *Service) WSStartStreaming(ctx context.Context, msg models.WsFrontendToBackend) (*models.WsBackendToEsp, error) {
+func (s *Service) WSStartStreaming(ctx context.Context, msg models.WsFrontendToBackend, owner string) (*models.WsBackendToEsp, error) {
+	if err := s.checkReservation(ctx, msg.DeviceID, owner); err != nil {
+		return nil, err
+	}
+
 	dev, err := s.repo.GetDeviceById(ctx, msg.DeviceID)
 	if err != nil {
 		return nil, err
 	}
 
-	if dev.Status == dto.DeviceStatusStreaming {
-		return nil, cerrors.ErrDeviceBusy
+	if dev.Disabled {
+		return nil, cerrors.ErrDeviceDisabled
 	}
 
-	if err := s.repo.UpdateDeviceStatus(ctx, msg.DeviceID, dto.DeviceStatusStreaming); err != nil {
+	if dev.Status == dto.DeviceStatusDisconnected {
+		return nil, cerrors.ErrDeviceDisconnected
+	}
+
+	if err := s.checkIdle(msg.DeviceID); err != nil {
+		return nil, err
+	}
+
+	cal, err := s.loadCalibration(ctx, msg.DeviceID, strings.TrimSpace(msg.Subject))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.setDeviceStatus(ctx, msg.DeviceID, dto.DeviceStatusStreaming); err != nil {
 		return nil, err
 	}
 
+	s.setDeviceMode(msg.DeviceID, dto.DeviceModeLiveInference)
+	s.setLiveCalibration(msg.DeviceID, cal)
+
+	// no duration, the ESP streams until stop_live_stream
 	return &models.WsBackendToEsp{
-		Event:      models.EventESPStartRawStream, // можно завести отдельный EventESPStartLiveStream
-		Duration:   models.DefaultDurationOfTraining * 60,
+		Event:      models.EventESPStartLiveStream,
 		ServerTime: time.Now().UnixMilli(),
 	}, nil
 }
 
-func (s *Service) WSStopStreaming(ctx context.Context, deviceID int) (*models.WsBackendToEsp, error) {
-	if err := s.repo.UpdateDeviceStatus(ctx, deviceID, dto.DeviceStatusIdle); err != nil {
+// WSStopStreaming stops whatever the device is doing. Like a start it needs
+// the reservation, unless takeover is set (the client may take the device
+// over anyway) or the reservation ran out while streaming. A rep stopped
+// while recording is discarded, the frontend has to start it again.
+func (s *Service) WSStopStreaming(ctx context.Context, deviceID int, owner string, takeover bool) (*models.WsBackendToEsp, error) {
+	if !takeover {
+		if err := s.checkReservation(ctx, deviceID, owner); err != nil && !errors.Is(err, cerrors.ErrNotReserved) {
+			return nil, err
+		}
+	}
+
+	mode := s.deviceMode(deviceID)
+
+	if mode == dto.DeviceModeIdle {
+		return nil, cerrors.ErrNotStreaming
+	}
+
+	stop := stopCommand(mode)
+
+	if mode == dto.DeviceModeRecording {
+		if ss, ok := s.session.Get(deviceID); ok {
+			if err := s.repo.DeleteTrainingRawRepetition(ctx, ss.TrainingID, ss.Rep); err != nil {
+				return nil, err
+			}
+
+			s.session.Update(deviceID, func(sx *sessions.Session) {
+				sx.Recording = false
+				sx.Rep--
+			})
+		}
+	}
+
+	s.setDeviceMode(deviceID, dto.DeviceModeIdle)
+
+	if err := s.setDeviceStatus(ctx, deviceID, s.restingStatus(ctx, deviceID)); err != nil {
 		return nil, err
 	}
 
-	return &models.WsBackendToEsp{
-		Event: models.EventESPStopRawStream,
-	}, nil
+	return stop, nil
+}
+
+// stopCommand is what ends mode on the ESP.
+func stopCommand(mode dto.DeviceMode) *models.WsBackendToEsp {
+	stop := &models.WsBackendToEsp{
+		Event:      models.EventESPStopRawStream,
+		ServerTime: time.Now().UnixMilli(),
+	}
+
+	switch mode {
+	case dto.DeviceModeLiveInference:
+		stop.Event = models.EventESPStopLiveStream
+	case dto.DeviceModeCalibration:
+		stop.Event = models.EventESPStopCalibration
+	}
+
+	return stop
 }
 
 func (s *Service) GetMovements(ctx context.Context) ([]dto.Movements, error) {
@@ -264,6 +635,17 @@ func (s *Service) GetMovements(ctx context.Context) ([]dto.Movements, error) {
 	return movs, nil
 }
 
+// CreateMovement adds a movement class, the ML model has to be retrained to
+// predict it.
+func (s *Service) CreateMovement(ctx context.Context, name, description string) (*dto.Movements, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, cerrors.ErrInvalidName
+	}
+
+	return s.repo.InsertMovement(ctx, name, strings.TrimSpace(description))
+}
+
 func IntSliceToString(nums []int) string {
 	if len(nums) == 0 {
 		return ""
@@ -275,12 +657,39 @@ func IntSliceToString(nums []int) string {
 	return strings.Join(strs, ",")
 }
 
-func (s *Service) GetTrainingRawCSV(ctx context.Context) ([]byte, error) {
+func formatFloats(nums []float64) string {
+	strs := make([]string, len(nums))
+	for i, v := range nums {
+		strs[i] = strconv.FormatFloat(v, 'f', 5, 64)
+	}
+	return strings.Join(strs, ",")
+}
+
+// GetTrainingRawCSV exports every recorded sample. The segment column says
+// whether the samples lie in detected muscle activity, a packet that crosses
+// a segment boundary is split into one row per side (same id, timestamp of
+// the first sample of the row). activeOnly drops all rest samples. With
+// normalize, a features_normalized column holds the row's features normalised
+// exactly like live prediction does, empty for trainings without a complete
+// calibration.
+func (s *Service) GetTrainingRawCSV(ctx context.Context, normalize, activeOnly bool) ([]byte, error) {
 	rows, err := s.repo.GetAllRawData(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	segs, err := s.repo.ListAllSegments(ctx)
+	if err != nil {
+		return nil, err
+	}
+	labels := newSegmentLabeler(segs)
+
+	type calKey struct {
+		deviceID int
+		subject  string
+	}
+	cals := map[calKey]*dto.Calibration{}
+
 	var buf bytes.Buffer
 	writer := csv.NewWriter(&buf)
 
@@ -292,30 +701,62 @@ func (s *Service) GetTrainingRawCSV(ctx context.Context) ([]byte, error) {
 		"repetition",
 		"timestamp",
 		"raw",
+		"subject",
+		"segment",
+	}
+
+	if normalize {
+		header = append(header, "features_normalized")
 	}
 
 	if err := writer.Write(header); err != nil {
 		return nil, err
 	}
 
+	decoded := make(map[int][]int, len(rows))
 	for _, r := range rows {
+		decoded[r.ID] = utils.DecodeRawBytes(r.Raw)
+	}
+	offsets := repOffsets(rows, decoded)
 
-		rawDecoded := utils.DecodeRawBytes(r.Raw)
+	for _, r := range rows {
+		for _, run := range labels.split(r, decoded[r.ID], offsets[r.ID]) {
+			if activeOnly && run.Label != "active" {
+				continue
+			}
 
-		rawStr := IntSliceToString(rawDecoded)
+			row := []string{
+				strconv.Itoa(r.ID),
+				strconv.Itoa(r.TrainingID),
+				strconv.Itoa(r.DeviceID),
+				strconv.Itoa(r.MovementID),
+				strconv.Itoa(r.Repetition),
+				run.TS.UTC().Format(time.RFC3339Nano),
+				IntSliceToString(run.Raw),
+				r.Subject,
+				run.Label,
+			}
 
-		row := []string{
-			strconv.Itoa(r.ID),
-			strconv.Itoa(r.TrainingID),
-			strconv.Itoa(r.DeviceID),
-			strconv.Itoa(r.MovementID),
-			strconv.Itoa(r.Repetition),
-			r.TS.UTC().Format(time.RFC3339Nano),
-			rawStr,
-		}
+			if normalize {
+				key := calKey{r.DeviceID, r.Subject}
+				c, ok := cals[key]
+				if !ok {
+					if c, err = s.loadCalibration(ctx, r.DeviceID, r.Subject); err != nil {
+						return nil, err
+					}
+					cals[key] = c
+				}
+
+				norm := ""
+				if c != nil {
+					norm = formatFloats(c.Features(run.Raw))
+				}
+				row = append(row, norm)
+			}
 
-		if err := writer.Write(row); err != nil {
-			return nil, err
+			if err := writer.Write(row); err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -327,3 +768,7 @@ func (s *Service) GetTrainingRawCSV(ctx context.Context) ([]byte, error) {
 
 	return buf.Bytes(), nil
 }
+
+func seconds(d config.Duration) int {
+	return int(time.Duration(d) / time.Second)
+}
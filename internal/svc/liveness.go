@@ -0,0 +1,126 @@
+package svc
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/sessions"
+)
+
+// OnDeviceStatusChange sets the callback used to tell frontends about device
+// status changes. Must be called before the service is used.
+func (s *Service) OnDeviceStatusChange(fn func(deviceID int, status dto.DeviceStatus)) {
+	s.statusListener = fn
+}
+
+// setDeviceStatus updates status and last_seen, the listener only fires when
+// the status actually changed (raw packets set streaming every 100 ms).
+func (s *Service) setDeviceStatus(ctx context.Context, deviceId int, status dto.DeviceStatus) error {
+	if err := s.repo.UpdateDeviceStatus(ctx, deviceId, status); err != nil {
+		return err
+	}
+
+	s.statusChanged(deviceId, status)
+
+	return nil
+}
+
+func (s *Service) statusChanged(deviceId int, status dto.DeviceStatus) {
+	s.statusMu.Lock()
+	prev, known := s.statuses[deviceId]
+	s.statuses[deviceId] = status
+	s.statusMu.Unlock()
+
+	if known && prev == status {
+		return
+	}
+
+	if s.statusListener != nil {
+		s.statusListener(deviceId, status)
+	}
+}
+
+// DeviceSeen is called on every pong from the ESP so idle devices are not
+// swept as disconnected.
+func (s *Service) DeviceSeen(ctx context.Context, deviceId int) error {
+	return s.repo.TouchDevice(ctx, deviceId)
+}
+
+// DeviceDisconnected is called when the ESP socket is gone. The session is
+// kept, the ESP may come back within the sweep timeout.
+func (s *Service) DeviceDisconnected(ctx context.Context, deviceId int) error {
+	s.session.Update(deviceId, func(sx *sessions.Session) {
+		sx.InterruptedAt = time.Now()
+	})
+	s.setDeviceMode(deviceId, dto.DeviceModeIdle)
+
+	return s.setDeviceStatus(ctx, deviceId, dto.DeviceStatusDisconnected)
+}
+
+// SweepDisconnected marks devices that were not seen since timeout as
+// disconnected and drops sessions of devices that stayed disconnected.
+func (s *Service) SweepDisconnected(ctx context.Context, timeout time.Duration) error {
+	cutoff := time.Now().Add(-timeout)
+
+	ids, err := s.repo.MarkStaleDevicesDisconnected(ctx, cutoff)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		slog.InfoContext(ctx, "device not seen, marked disconnected", "device_id", id, "since", cutoff)
+		s.statusChanged(id, dto.DeviceStatusDisconnected)
+		s.setDeviceMode(id, dto.DeviceModeIdle)
+
+		s.session.Update(id, func(sx *sessions.Session) {
+			if sx.InterruptedAt.IsZero() {
+				sx.InterruptedAt = time.Now()
+			}
+		})
+	}
+
+	// the ESP gets timeout to come back after the session was interrupted
+	for _, ss := range s.session.List() {
+		if ss.InterruptedAt.IsZero() || ss.InterruptedAt.After(cutoff) {
+			continue
+		}
+
+		dev, err := s.repo.GetDeviceById(ctx, ss.DeviceID)
+		if err != nil {
+			slog.ErrorContext(ctx, "sweeper: get device", "device_id", ss.DeviceID, "err", err)
+			continue
+		}
+
+		if dev.Status != dto.DeviceStatusDisconnected {
+			continue
+		}
+
+		slog.InfoContext(ctx, "session dropped, device stayed disconnected", "device_id", ss.DeviceID, "training_id", ss.TrainingID, "rep", ss.Rep)
+		s.session.Delete(ss.DeviceID)
+	}
+
+	return nil
+}
+
+// RunSweeper blocks until ctx is done.
+func (s *Service) RunSweeper(ctx context.Context, interval, timeout, sessionTTL time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.SweepDisconnected(ctx, timeout); err != nil {
+				slog.ErrorContext(ctx, "sweeper", "err", err)
+			}
+			s.ExpireSessions(sessionTTL)
+			if err := s.ExpireReservations(ctx); err != nil {
+				slog.ErrorContext(ctx, "sweeper", "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package svc
+
+import (
+	"emg_esp32_classifier_backend/pkg/dto"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var devicesDesc = prometheus.NewDesc("emg_devices",
+	"Devices per status, as last seen by this process.", []string{"status"}, nil)
+
+// RegisterMetrics exposes session and device status counts.
+func (s *Service) RegisterMetrics(r prometheus.Registerer) {
+	r.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "emg_active_sessions",
+		Help: "Training sessions in progress.",
+	}, func() float64 {
+		return float64(len(s.session.List()))
+	}))
+
+	r.MustRegister(deviceStatusCollector{s})
+}
+
+// deviceStatusCollector counts the statuses at scrape time, a status no
+// device has is reported as 0.
+type deviceStatusCollector struct {
+	s *Service
+}
+
+func (c deviceStatusCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- devicesDesc
+}
+
+func (c deviceStatusCollector) Collect(ch chan<- prometheus.Metric) {
+	c.s.statusMu.Lock()
+	counts := map[dto.DeviceStatus]float64{}
+	for _, st := range c.s.statuses {
+		counts[st]++
+	}
+	c.s.statusMu.Unlock()
+
+	for _, st := range []dto.DeviceStatus{dto.DeviceStatusIdle, dto.DeviceStatusStreaming, dto.DeviceStatusReserved, dto.DeviceStatusDisconnected} {
+		ch <- prometheus.MustNewConstMetric(devicesDesc, prometheus.GaugeValue, counts[st], string(st))
+	}
+}
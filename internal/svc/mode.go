@@ -0,0 +1,75 @@
+package svc
+
+import (
+	"fmt"
+
+	"emg_esp32_classifier_backend/pkg/cerrors"
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/models"
+)
+
+// packetModes lists the mode a device has to be in for each packet it sends.
+var packetModes = map[models.Event]dto.DeviceMode{
+	models.EventRawStreamBegin:  dto.DeviceModeRecording,
+	models.EventRawStreamInProc: dto.DeviceModeRecording,
+	models.EventRawStreamFinish: dto.DeviceModeRecording,
+	models.EventLiveStreamData:  dto.DeviceModeLiveInference,
+
+	models.EventCalibrationData:   dto.DeviceModeCalibration,
+	models.EventCalibrationFinish: dto.DeviceModeCalibration,
+}
+
+func (s *Service) deviceMode(deviceId int) dto.DeviceMode {
+	s.modeMu.Lock()
+	defer s.modeMu.Unlock()
+
+	if m, ok := s.modes[deviceId]; ok {
+		return m
+	}
+	return dto.DeviceModeIdle
+}
+
+func (s *Service) setDeviceMode(deviceId int, mode dto.DeviceMode) {
+	s.modeMu.Lock()
+	defer s.modeMu.Unlock()
+
+	// whatever ran before is over, its per-mode state goes with it
+	if mode == dto.DeviceModeIdle {
+		delete(s.modes, deviceId)
+		delete(s.calibrations, deviceId)
+		delete(s.liveCalibrations, deviceId)
+		delete(s.monitors, deviceId)
+		return
+	}
+	s.modes[deviceId] = mode
+}
+
+// checkIdle refuses to start anything on a device that is busy with
+// something else.
+func (s *Service) checkIdle(deviceId int) error {
+	if cur := s.deviceMode(deviceId); cur != dto.DeviceModeIdle {
+		return fmt.Errorf("%w: device is in %s mode", cerrors.ErrDeviceBusy, cur)
+	}
+	return nil
+}
+
+// checkPacketMode rejects packets the device should not send in its current
+// mode, e.g. raw_stream_in_process after the rep was stopped.
+func (s *Service) checkPacketMode(deviceId int, event models.Event) error {
+	want, ok := packetModes[event]
+	if !ok {
+		return fmt.Errorf("%w: unknown event %q", cerrors.ErrModeMismatch, event)
+	}
+
+	if cur := s.deviceMode(deviceId); cur != want {
+		return fmt.Errorf("%w: %s while in %s mode", cerrors.ErrModeMismatch, event, cur)
+	}
+	return nil
+}
+
+func (s *Service) withModes(devices []dto.Device) []dto.Device {
+	for i := range devices {
+		devices[i].Mode = s.deviceMode(devices[i].ID)
+	}
+	return devices
+}
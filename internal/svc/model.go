@@ -0,0 +1,98 @@
+package svc
+
+import (
+	"context"
+	"fmt"
+
+	"emg_esp32_classifier_backend/pkg/cerrors"
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/utils"
+)
+
+// ModelURL is where the ML service is expected.
+func (s *Service) ModelURL() string {
+	return s.ml.URL
+}
+
+// ModelHealth asks the ML service whether it is up.
+func (s *Service) ModelHealth(ctx context.Context) error {
+	return s.ml.Health(ctx)
+}
+
+// EvaluateModel classifies every stored packet of a training like live
+// inference would and counts the predicted classes, to check a deployed model
+// against recordings whose movement is known. Packets are split at segment
+// boundaries like in the export, activeOnly skips the rest samples. normalize
+// applies the subject's calibration.
+func (s *Service) EvaluateModel(ctx context.Context, trainingId int, activeOnly, normalize bool) (*dto.ModelEvaluation, error) {
+	t, err := s.GetTraining(ctx, trainingId)
+	if err != nil {
+		return nil, err
+	}
+
+	var cal *dto.Calibration
+	if normalize {
+		if cal, err = s.loadCalibration(ctx, t.DeviceID, t.Subject); err != nil {
+			return nil, err
+		}
+		if cal == nil {
+			return nil, fmt.Errorf("%w: subject %q is not calibrated", cerrors.ErrInvalidCalibration, t.Subject)
+		}
+	}
+
+	segs, err := s.repo.ListSegments(ctx, trainingId)
+	if err != nil {
+		return nil, err
+	}
+	labels := newSegmentLabeler(segs)
+
+	ev := &dto.ModelEvaluation{
+		TrainingID: t.ID,
+		MovementID: t.MovementID,
+		Classes:    map[string]int{},
+	}
+
+	var lastErr error
+	for rep := 1; rep <= t.Repetition; rep++ {
+		rows, err := s.repo.SelectRepetitionRaw(ctx, trainingId, rep)
+		if err != nil {
+			return nil, err
+		}
+
+		offset := 0
+		for _, r := range rows {
+			raw := utils.DecodeRawBytes(r.Raw)
+			runs := labels.split(r, raw, offset)
+			offset += len(raw)
+
+			for _, run := range runs {
+				if activeOnly && run.Label != "active" {
+					continue
+				}
+
+				var features []float64
+				if cal != nil {
+					features = cal.Features(run.Raw)
+				} else {
+					features = utils.ExtractFeatures(run.Raw)
+				}
+
+				pred, err := s.ml.Predict(ctx, features)
+				if err != nil {
+					ev.Failed++
+					lastErr = err
+					continue
+				}
+
+				ev.Packets++
+				ev.Classes[pred.ClassName]++
+			}
+		}
+	}
+
+	if ev.Packets == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+
+	return ev, nil
+}
@@ -0,0 +1,172 @@
+package svc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/quality"
+	"emg_esp32_classifier_backend/pkg/sessions"
+	"emg_esp32_classifier_backend/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// qualityWindow is how many of the latest samples per channel every packet is
+// assessed over, packets alone are too short to see 50 Hz.
+const qualityWindow = 256
+
+type qualityMonitor struct {
+	sampleRate float64
+	channels   int
+	rest       []float64 // per channel
+	limits     quality.Limits
+	window     []int
+	rep        quality.Accumulator
+}
+
+// packetQuality assesses raw together with the samples before it and adds
+// the result to the running repetition. calibration is only asked for when
+// the first packet of a recording arrives.
+func (s *Service) packetQuality(ctx context.Context, deviceId int, raw []int, calibration func() *dto.Calibration) quality.Metrics {
+	ctx, span := tracing.Start(ctx, "quality")
+	defer span.End()
+
+	s.modeMu.Lock()
+	mon := s.monitors[deviceId]
+	s.modeMu.Unlock()
+
+	if mon == nil {
+		mon = &qualityMonitor{
+			sampleRate: float64(s.deviceSampleRate(ctx, deviceId)),
+			channels:   s.deviceChannels(ctx, deviceId),
+			limits:     s.deviceLimits(ctx, deviceId),
+		}
+		if cal := calibration(); cal != nil {
+			mon.rest = cal.RestLevels
+		}
+	}
+
+	s.modeMu.Lock()
+	defer s.modeMu.Unlock()
+
+	if cur := s.monitors[deviceId]; cur != nil {
+		mon = cur
+	} else {
+		s.monitors[deviceId] = mon
+	}
+
+	mon.window = append(mon.window, raw...)
+	if n, keep := len(mon.window), qualityWindow*mon.channels; n > keep {
+		mon.window = append(mon.window[:0], mon.window[n-keep:]...)
+	}
+
+	m := quality.Assess(mon.window, mon.channels, mon.sampleRate, mon.rest, mon.limits)
+	mon.rep.Add(m, len(raw))
+
+	span.SetAttributes(attribute.Float64("score", m.Score))
+
+	return m
+}
+
+// repQuality returns the metrics of the repetition recorded so far and starts
+// a new one.
+func (s *Service) repQuality(deviceId int) quality.Metrics {
+	s.modeMu.Lock()
+	defer s.modeMu.Unlock()
+
+	mon := s.monitors[deviceId]
+	if mon == nil {
+		return quality.Metrics{}
+	}
+
+	m := mon.rep.Result()
+	mon.rep = quality.Accumulator{}
+
+	return m
+}
+
+// deviceSampleRate prefers the acknowledged config over what the firmware
+// reported at handshake, 0 when neither is known.
+func (s *Service) deviceSampleRate(ctx context.Context, deviceId int) int {
+	if v, err := s.repo.GetLatestDeviceConfig(ctx, deviceId); err == nil && v.AckedAt != nil && v.AckError == "" {
+		return v.Config.SampleRate
+	}
+
+	if dev, err := s.repo.GetDeviceById(ctx, deviceId); err == nil {
+		return dev.SampleRate
+	}
+
+	return 0
+}
+
+// deviceChannels is how many channels are interleaved in a packet: the active
+// channels of the acknowledged config, else every channel reported at
+// handshake, else one.
+func (s *Service) deviceChannels(ctx context.Context, deviceId int) int {
+	if v, err := s.repo.GetLatestDeviceConfig(ctx, deviceId); err == nil && v.AckedAt != nil && v.AckError == "" && len(v.Config.ActiveChannels) > 0 {
+		return len(v.Config.ActiveChannels)
+	}
+
+	if dev, err := s.repo.GetDeviceById(ctx, deviceId); err == nil && dev.ChannelCount > 0 {
+		return dev.ChannelCount
+	}
+
+	return 1
+}
+
+// deviceLimits are the saturation limits of the ADC the firmware reported at
+// handshake, the int16 storage limits when it did not.
+func (s *Service) deviceLimits(ctx context.Context, deviceId int) quality.Limits {
+	if dev, err := s.repo.GetDeviceById(ctx, deviceId); err == nil {
+		return quality.ADCLimits(dev.ADCBits)
+	}
+
+	return quality.StorageLimits
+}
+
+// sessionCalibration gives the rest level for the SNR of a training, nil when
+// the subject is not calibrated.
+func (s *Service) sessionCalibration(ctx context.Context, ss *sessions.Session) func() *dto.Calibration {
+	return func() *dto.Calibration {
+		c, err := s.loadCalibration(ctx, ss.DeviceID, ss.Subject)
+		if err != nil {
+			slog.WarnContext(ctx, "load calibration", "err", err)
+		}
+		return c
+	}
+}
+
+func qualityMessage(rep int, m quality.Metrics) string {
+	switch {
+	case m.Flatline:
+		return fmt.Sprintf("repetition %d flagged: flat signal, check the electrodes and record it again", rep)
+	case m.ClippingRatio > 0.01:
+		return fmt.Sprintf("repetition %d flagged: %.1f%% of samples clipped, lower the gain and record it again", rep, m.ClippingRatio*100)
+	case m.MainsRatio > 0.3:
+		return fmt.Sprintf("repetition %d flagged: %d Hz mains noise, record it again", rep, m.MainsHz)
+	default:
+		return fmt.Sprintf("repetition %d flagged: quality score %.2f, record it again", rep, m.Score)
+	}
+}
+
+// repFlagged reports whether the stored quality of a repetition asks for it
+// to be recorded again.
+func (s *Service) repFlagged(ctx context.Context, trainingId, rep int) (bool, error) {
+	list, err := s.repo.ListRepetitionQuality(ctx, trainingId)
+	if err != nil {
+		return false, err
+	}
+
+	for _, q := range list {
+		if q.Repetition == rep {
+			return q.Flagged, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *Service) GetTrainingQuality(ctx context.Context, trainingId int) ([]dto.RepetitionQuality, error) {
+	return s.repo.ListRepetitionQuality(ctx, trainingId)
+}
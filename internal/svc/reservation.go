@@ -0,0 +1,123 @@
+package svc
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/cerrors"
+	"emg_esp32_classifier_backend/pkg/dto"
+)
+
+const (
+	DefaultReservationTTL = 5 * time.Minute
+	MaxReservationTTL     = time.Hour
+)
+
+// ReleaseDevice ends the owner's reservation, the device goes idle unless
+// it is still streaming.
+func (s *Service) ReleaseDevice(ctx context.Context, deviceId int, owner string) error {
+	if owner == "" {
+		return cerrors.ErrNoClientID
+	}
+
+	if err := s.repo.DeleteReservation(ctx, deviceId, owner); err != nil {
+		return err
+	}
+
+	dev, err := s.repo.GetDeviceById(ctx, deviceId)
+	if err != nil {
+		return err
+	}
+
+	if dev.Status != dto.DeviceStatusReserved {
+		return nil
+	}
+
+	return s.setDeviceStatus(ctx, deviceId, dto.DeviceStatusIdle)
+}
+
+// ForceReleaseDevice ends the reservation whoever holds it.
+func (s *Service) ForceReleaseDevice(ctx context.Context, deviceId int) error {
+	res, err := s.repo.GetReservation(ctx, deviceId)
+	if err != nil {
+		return err
+	}
+
+	return s.ReleaseDevice(ctx, deviceId, res.Owner)
+}
+
+func (s *Service) GetReservation(ctx context.Context, deviceId int) (*dto.Reservation, error) {
+	res, err := s.repo.GetReservation(ctx, deviceId)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.ExpiresAt.Before(time.Now()) {
+		return nil, cerrors.ErrNotFound
+	}
+
+	return res, nil
+}
+
+// checkReservation lets only the holder of a valid reservation drive the
+// device. A successful check renews the reservation.
+func (s *Service) checkReservation(ctx context.Context, deviceId int, owner string) error {
+	res, err := s.GetReservation(ctx, deviceId)
+	if errors.Is(err, cerrors.ErrNotFound) {
+		return cerrors.ErrNotReserved
+	}
+	if err != nil {
+		return err
+	}
+
+	if res.Owner != owner {
+		return cerrors.ErrReservationConflict
+	}
+
+	// never shortens a longer reservation
+	expires := time.Now().Add(DefaultReservationTTL)
+	if res.ExpiresAt.After(expires) {
+		return nil
+	}
+
+	_, err = s.repo.UpsertReservation(ctx, deviceId, owner, expires)
+	return err
+}
+
+// restingStatus is where a device goes when streaming stops.
+func (s *Service) restingStatus(ctx context.Context, deviceId int) dto.DeviceStatus {
+	if _, err := s.GetReservation(ctx, deviceId); err == nil {
+		return dto.DeviceStatusReserved
+	}
+	return dto.DeviceStatusIdle
+}
+
+// ExpireReservations frees devices whose reservation ran out.
+func (s *Service) ExpireReservations(ctx context.Context) error {
+	ids, err := s.repo.DeleteExpiredReservations(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		dev, err := s.repo.GetDeviceById(ctx, id)
+		if err != nil {
+			slog.ErrorContext(ctx, "expire reservation: get device", "device_id", id, "err", err)
+			continue
+		}
+
+		slog.InfoContext(ctx, "reservation expired", "device_id", id)
+
+		if dev.Status != dto.DeviceStatusReserved {
+			continue
+		}
+
+		if err := s.setDeviceStatus(ctx, id, dto.DeviceStatusIdle); err != nil {
+			slog.ErrorContext(ctx, "update device status", "device_id", id, "err", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,83 @@
+package svc
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/sessions"
+)
+
+// RestoreSessions loads sessions saved before a restart. Sessions not touched
+// within ttl are dropped, the rest are marked interrupted since no ESP socket
+// survives a restart; they are resumed on handshake.
+func (s *Service) RestoreSessions(ctx context.Context, ttl time.Duration) error {
+	if err := s.session.Load(ctx); err != nil {
+		return err
+	}
+
+	s.ExpireSessions(ttl)
+
+	now := time.Now()
+	for _, ss := range s.session.List() {
+		if ss.InterruptedAt.IsZero() {
+			s.session.Update(ss.DeviceID, func(sx *sessions.Session) {
+				sx.InterruptedAt = now
+			})
+		}
+
+		slog.InfoContext(ctx, "session restored", "device_id", ss.DeviceID, "training_id", ss.TrainingID, "movement_id", ss.MovementID, "rep", ss.Rep)
+	}
+
+	return nil
+}
+
+// ExpireSessions drops sessions that were not updated within ttl.
+func (s *Service) ExpireSessions(ttl time.Duration) {
+	cutoff := time.Now().Add(-ttl)
+
+	for _, ss := range s.session.List() {
+		if ss.UpdatedAt.After(cutoff) {
+			continue
+		}
+
+		slog.Info("session expired", "device_id", ss.DeviceID, "training_id", ss.TrainingID, "idle_since", ss.UpdatedAt)
+		s.session.Delete(ss.DeviceID)
+	}
+}
+
+// ReconcileDevices marks every device without a live ESP socket as
+// disconnected, statuses left over from before a restart are meaningless.
+// On shutdown it runs with no connected devices.
+func (s *Service) ReconcileDevices(ctx context.Context, connected []int) error {
+	devices, err := s.repo.ListDevices(ctx)
+	if err != nil {
+		return err
+	}
+
+	alive := make(map[int]bool, len(connected))
+	for _, id := range connected {
+		alive[id] = true
+	}
+
+	for _, d := range devices {
+		if alive[d.ID] {
+			continue
+		}
+
+		if d.Status == dto.DeviceStatusDisconnected {
+			s.statusChanged(d.ID, d.Status)
+			continue
+		}
+
+		if err := s.repo.UpdateDeviceStatus(ctx, d.ID, dto.DeviceStatusDisconnected); err != nil {
+			return err
+		}
+		s.statusChanged(d.ID, dto.DeviceStatusDisconnected)
+
+		slog.InfoContext(ctx, "device marked disconnected", "device_id", d.ID, "was", d.Status)
+	}
+
+	return nil
+}
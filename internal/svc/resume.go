@@ -0,0 +1,81 @@
+package svc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/logging"
+	"emg_esp32_classifier_backend/pkg/models"
+	"emg_esp32_classifier_backend/pkg/sessions"
+)
+
+// ResumeSession reattaches a reconnected ESP to its session. Both results are
+// nil when the device has no session. toEsp is only set when the ESP has to
+// record the rest of a cut repetition.
+func (s *Service) ResumeSession(ctx context.Context, deviceId int) (toEsp *models.WsBackendToEsp, toMaster *models.WsBackendToFrontend, err error) {
+	ss, ok := s.session.Get(deviceId)
+	if !ok {
+		return nil, nil, nil
+	}
+
+	toMaster = &models.WsBackendToFrontend{
+		Event:      models.EventSessionResumed,
+		DeviceID:   deviceId,
+		MovementID: ss.MovementID,
+		Rep:        ss.Rep,
+		Message:    "device reconnected",
+	}
+
+	if !ss.Recording {
+		return nil, toMaster, nil
+	}
+
+	interruptedAt := ss.InterruptedAt
+	if interruptedAt.IsZero() {
+		interruptedAt = time.Now()
+	}
+	recorded := interruptedAt.Sub(ss.RepStartedAt)
+	remaining := time.Duration(ss.Duration)*time.Second - recorded
+
+	if s.resumePolicy == sessions.ResumeContinue && remaining > 0 {
+		s.session.Update(deviceId, func(sx *sessions.Session) {
+			// shift the start so that elapsed time only counts recorded time
+			sx.RepStartedAt = time.Now().Add(-recorded)
+			sx.InterruptedAt = time.Time{}
+		})
+
+		s.setDeviceMode(deviceId, dto.DeviceModeRecording)
+
+		toMaster.Message = fmt.Sprintf("repetition %d continues, %.1f s left", ss.Rep, remaining.Seconds())
+
+		return &models.WsBackendToEsp{
+			Event:      models.EventESPStartRawStream,
+			Duration:   int(math.Ceil(remaining.Seconds())),
+			ServerTime: time.Now().UnixMilli(),
+			MovementID: ss.MovementID,
+		}, toMaster, nil
+	}
+
+	rep := ss.Rep
+
+	if err := s.repo.DeleteTrainingRawRepetition(ctx, ss.TrainingID, rep); err != nil {
+		return nil, nil, err
+	}
+
+	slog.InfoContext(logging.WithTraining(ctx, ss.TrainingID, rep), "interrupted repetition discarded")
+
+	s.session.Update(deviceId, func(sx *sessions.Session) {
+		sx.Recording = false
+		sx.InterruptedAt = time.Time{}
+		sx.Rep--
+	})
+
+	toMaster.Rep = rep - 1
+	toMaster.Message = fmt.Sprintf("repetition %d discarded, start it again", rep)
+
+	return nil, toMaster, nil
+}
@@ -0,0 +1,171 @@
+package svc
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/onset"
+	"emg_esp32_classifier_backend/pkg/sessions"
+	"emg_esp32_classifier_backend/pkg/utils"
+)
+
+// detectSegments finds muscle activity in the repetition just recorded and
+// stores it, the reaction lag before and the relaxation after are rest.
+func (s *Service) detectSegments(ctx context.Context, ss *sessions.Session) ([]dto.Segment, error) {
+	packets, err := s.repo.SelectRepetitionRaw(ctx, ss.TrainingID, ss.Rep)
+	if err != nil {
+		return nil, err
+	}
+
+	// offsets[i] is the index of the first sample of packet i
+	var samples []int
+	offsets := make([]int, len(packets))
+	for i, p := range packets {
+		offsets[i] = len(samples)
+		samples = append(samples, utils.DecodeRawBytes(p.Raw)...)
+	}
+
+	sampleRate := float64(s.deviceSampleRate(ctx, ss.DeviceID))
+	channels := s.deviceChannels(ctx, ss.DeviceID)
+
+	noise := 0.0
+	if cal, err := s.loadCalibration(ctx, ss.DeviceID, ss.Subject); err == nil && cal != nil {
+		noise = cal.RestRMS
+	}
+
+	// sample time: packet timestamp plus the frame the sample is in
+	at := func(i int) time.Time {
+		p := sort.Search(len(offsets), func(k int) bool { return offsets[k] > i }) - 1
+		ts := packets[p].TS
+		if sampleRate > 0 {
+			frame := (i - offsets[p]) / channels
+			ts = ts.Add(time.Duration(float64(frame) / sampleRate * float64(time.Second)))
+		}
+		return ts
+	}
+
+	segs := []dto.Segment{}
+	for _, d := range onset.Detect(samples, channels, sampleRate, s.onsetMethod, noise) {
+		seg := dto.Segment{
+			TrainingID:  ss.TrainingID,
+			Repetition:  ss.Rep,
+			StartSample: d.Start,
+			EndSample:   d.End,
+			Start:       at(d.Start),
+			Method:      string(s.onsetMethod),
+		}
+
+		if d.End < len(samples) {
+			seg.End = at(d.End)
+		} else {
+			// open end: just past the last sample
+			seg.End = at(len(samples) - 1).Add(time.Nanosecond)
+		}
+
+		segs = append(segs, seg)
+	}
+
+	if err := s.repo.ReplaceRepetitionSegments(ctx, ss.TrainingID, ss.Rep, segs); err != nil {
+		return nil, err
+	}
+
+	return segs, nil
+}
+
+func (s *Service) GetTrainingSegments(ctx context.Context, trainingId int) ([]dto.Segment, error) {
+	return s.repo.ListSegments(ctx, trainingId)
+}
+
+type repKey struct {
+	trainingID, rep int
+}
+
+// segmentLabeler labels exported samples by their position in the
+// repetition, "" for repetitions without any detected activity (or never run
+// through the detector).
+type segmentLabeler map[repKey][]dto.Segment
+
+func newSegmentLabeler(segs []dto.Segment) segmentLabeler {
+	l := segmentLabeler{}
+	for _, sg := range segs {
+		k := repKey{sg.TrainingID, sg.Repetition}
+		l[k] = append(l[k], sg)
+	}
+	for _, list := range l {
+		sort.Slice(list, func(i, j int) bool { return list[i].StartSample < list[j].StartSample })
+	}
+	return l
+}
+
+// labeledRun is the part of a packet that lies entirely inside or entirely
+// outside of the detected activity.
+type labeledRun struct {
+	TS    time.Time // of its first sample
+	Raw   []int
+	Label string
+}
+
+// split cuts a packet whose first sample is sample offset of its repetition
+// at the segment boundaries. A packet of a repetition without segments is a
+// single run labelled "".
+func (l segmentLabeler) split(tr dto.TrainingRaw, raw []int, offset int) []labeledRun {
+	segs, ok := l[repKey{tr.TrainingID, tr.Repetition}]
+	if !ok || len(raw) == 0 {
+		return []labeledRun{{TS: tr.TS, Raw: raw}}
+	}
+
+	end := offset + len(raw)
+
+	var runs []labeledRun
+	pos, ts := offset, tr.TS
+	for pos < end {
+		label, next, nextTS := "rest", end, time.Time{}
+		for _, sg := range segs {
+			switch {
+			case pos >= sg.StartSample && pos < sg.EndSample:
+				label = "active"
+				if sg.EndSample < next {
+					next, nextTS = sg.EndSample, sg.End
+				}
+			case sg.StartSample > pos && sg.StartSample < next:
+				next, nextTS = sg.StartSample, sg.Start
+			}
+		}
+
+		runs = append(runs, labeledRun{TS: ts, Raw: raw[pos-offset : next-offset], Label: label})
+		pos, ts = next, nextTS
+	}
+
+	return runs
+}
+
+// repOffsets gives the first sample of every packet within its repetition,
+// counted in the order detectSegments joins them (ts, then id). samples are
+// the decoded packets by id.
+func repOffsets(rows []dto.TrainingRaw, samples map[int][]int) map[int]int {
+	byRep := map[repKey][]dto.TrainingRaw{}
+	for _, r := range rows {
+		k := repKey{r.TrainingID, r.Repetition}
+		byRep[k] = append(byRep[k], r)
+	}
+
+	offsets := make(map[int]int, len(rows))
+	for _, list := range byRep {
+		sort.Slice(list, func(i, j int) bool {
+			if !list[i].TS.Equal(list[j].TS) {
+				return list[i].TS.Before(list[j].TS)
+			}
+			return list[i].ID < list[j].ID
+		})
+
+		n := 0
+		for _, r := range list {
+			offsets[r.ID] = n
+			n += len(samples[r.ID])
+		}
+	}
+
+	return offsets
+}
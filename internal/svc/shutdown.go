@@ -0,0 +1,40 @@
+package svc
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/logging"
+	"emg_esp32_classifier_backend/pkg/sessions"
+)
+
+// StopDevices tells every busy ESP to stop before the backend goes away. The
+// mode is kept so packets already on the wire are still stored, sessions are
+// marked interrupted and resumed by the resume policy when the device comes
+// back to the next instance.
+func (s *Service) StopDevices(ctx context.Context) int {
+	s.modeMu.Lock()
+	busy := make(map[int]dto.DeviceMode, len(s.modes))
+	for id, m := range s.modes {
+		busy[id] = m
+	}
+	s.modeMu.Unlock()
+
+	now := time.Now()
+	for id, mode := range busy {
+		dctx := logging.WithDevice(ctx, id)
+
+		sent := s.espCommand != nil && s.espCommand(id, stopCommand(mode))
+		slog.InfoContext(dctx, "stopping device for shutdown", "mode", mode, "sent", sent)
+
+		s.session.Update(id, func(sx *sessions.Session) {
+			if sx.InterruptedAt.IsZero() {
+				sx.InterruptedAt = now
+			}
+		})
+	}
+
+	return len(busy)
+}
@@ -0,0 +1,106 @@
+package svc
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"emg_esp32_classifier_backend/pkg/cerrors"
+	"emg_esp32_classifier_backend/pkg/dto"
+	"emg_esp32_classifier_backend/pkg/logging"
+	"emg_esp32_classifier_backend/pkg/sessions"
+)
+
+func (s *Service) ListTrainings(ctx context.Context, f dto.TrainingFilter) ([]dto.Training, error) {
+	return s.repo.ListTrainings(ctx, f)
+}
+
+func (s *Service) GetTraining(ctx context.Context, trainingId int) (*dto.Training, error) {
+	ts, err := s.repo.ListTrainings(ctx, dto.TrainingFilter{ID: trainingId})
+	if err != nil {
+		return nil, err
+	}
+	if len(ts) == 0 {
+		return nil, cerrors.ErrNotFound
+	}
+
+	return &ts[0], nil
+}
+
+// DeleteTraining removes a training with everything recorded for it. One
+// with an open session is refused, drop the session first.
+func (s *Service) DeleteTraining(ctx context.Context, trainingId int) error {
+	open, err := s.repo.LoadSessions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, ss := range open {
+		if ss.TrainingID == trainingId {
+			return cerrors.ErrTrainingActive
+		}
+	}
+
+	if err := s.repo.DeleteTraining(ctx, trainingId); err != nil {
+		return err
+	}
+
+	slog.InfoContext(logging.WithTraining(ctx, trainingId, 0), "training deleted")
+
+	return nil
+}
+
+// ListSessions reads the stored sessions, the ones a running backend
+// restores after a restart.
+func (s *Service) ListSessions(ctx context.Context) ([]*sessions.Session, error) {
+	return s.repo.LoadSessions(ctx)
+}
+
+// DropSession deletes the stored session of a device, e.g. one left over
+// from a crash that keeps a training open. A running backend keeps its copy
+// in memory until it restarts or the session expires.
+func (s *Service) DropSession(ctx context.Context, deviceId int) error {
+	open, err := s.repo.LoadSessions(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, ss := range open {
+		if ss.DeviceID != deviceId {
+			continue
+		}
+
+		s.session.Delete(deviceId)
+		slog.InfoContext(logging.WithTraining(logging.WithDevice(ctx, deviceId), ss.TrainingID, ss.Rep), "session dropped")
+
+		return nil
+	}
+
+	return cerrors.ErrNotFound
+}
+
+// ExpireStoredSessions deletes stored sessions not updated within ttl, like
+// a starting backend does, and returns them.
+func (s *Service) ExpireStoredSessions(ctx context.Context, ttl time.Duration) ([]*sessions.Session, error) {
+	open, err := s.repo.LoadSessions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := time.Now().Add(-ttl)
+
+	var expired []*sessions.Session
+	for _, ss := range open {
+		if ss.UpdatedAt.After(cutoff) {
+			continue
+		}
+
+		if err := s.repo.DeleteSession(ctx, ss.DeviceID); err != nil {
+			return expired, err
+		}
+		slog.InfoContext(ctx, "session expired", "device_id", ss.DeviceID, "training_id", ss.TrainingID, "idle_since", ss.UpdatedAt)
+
+		expired = append(expired, ss)
+	}
+
+	return expired, nil
+}
@@ -0,0 +1,61 @@
+package svc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	"emg_esp32_classifier_backend/pkg/auth"
+	"emg_esp32_classifier_backend/pkg/cerrors"
+	"emg_esp32_classifier_backend/pkg/dto"
+)
+
+func (s *Service) ListUsers(ctx context.Context) ([]dto.User, error) {
+	return s.repo.ListUsers(ctx)
+}
+
+// CreateUser returns the API key of the new user, only its hash is stored so
+// it can't be shown again.
+func (s *Service) CreateUser(ctx context.Context, name, role string) (*dto.User, string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, "", cerrors.ErrInvalidName
+	}
+
+	if !auth.Role(role).Valid() {
+		return nil, "", cerrors.ErrInvalidRole
+	}
+
+	key, err := newAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+
+	u, err := s.repo.InsertUser(ctx, name, role, auth.HashSecret(key))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return u, key, nil
+}
+
+func (s *Service) UpdateUserRole(ctx context.Context, userID int, role string) (*dto.User, error) {
+	if !auth.Role(role).Valid() {
+		return nil, cerrors.ErrInvalidRole
+	}
+
+	return s.repo.UpdateUserRole(ctx, userID, role)
+}
+
+func (s *Service) DeleteUser(ctx context.Context, userID int) error {
+	return s.repo.DeleteUser(ctx, userID)
+}
+
+func newAPIKey() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "emg_" + hex.EncodeToString(b), nil
+}
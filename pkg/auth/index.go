@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+var ErrUnauthenticated = errors.New("unauthenticated")
+
+type Principal struct {
+	Subject string
+	Role    Role
+	Method  string // "jwt", "api_key" or "none" when auth is disabled
+}
+
+// UserStore resolves API keys of users created through the user API.
+type UserStore interface {
+	// LookupAPIKey returns an error for unknown keys.
+	LookupAPIKey(ctx context.Context, keyHash string) (subject string, role string, err error)
+}
+
+// APIKey is a static key from configuration.
+type APIKey struct {
+	Subject string
+	Role    Role
+}
+
+type ctxKey struct{}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, ctxKey{}, p)
+}
+
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(ctxKey{}).(*Principal)
+	return p, ok
+}
+
+// ClientID identifies the caller for reservations: the authenticated subject,
+// otherwise X-Client-ID header or client_id query parameter (browsers can't
+// set headers on WebSockets).
+func ClientID(r *http.Request) string {
+	if p, ok := FromContext(r.Context()); ok && p.Method != "none" {
+		return p.Subject
+	}
+	if id := r.Header.Get("X-Client-ID"); id != "" {
+		return id
+	}
+	return r.URL.Query().Get("client_id")
+}
+
+type Authenticator struct {
+	jwtSecret []byte
+	apiKeys   map[string]APIKey // sha256(key) → static key from config
+	users     UserStore
+	disabled  bool
+}
+
+// NewAuthenticator: apiKeys comes from ParseAPIKeys, users may be nil. With
+// disabled every request passes as an anonymous admin, for local development
+// only.
+func NewAuthenticator(jwtSecret string, apiKeys map[string]APIKey, users UserStore, disabled bool) *Authenticator {
+	a := &Authenticator{
+		jwtSecret: []byte(jwtSecret),
+		apiKeys:   make(map[string]APIKey, len(apiKeys)),
+		users:     users,
+		disabled:  disabled,
+	}
+	for k, v := range apiKeys {
+		a.apiKeys[HashSecret(k)] = v
+	}
+
+	if disabled {
+		slog.Warn("authentication is DISABLED")
+	}
+
+	return a
+}
+
+// ParseAPIKeys reads "key1:subject1:role1,key2:subject2". The role defaults
+// to viewer, unknown roles are skipped.
+func ParseAPIKeys(s string) map[string]APIKey {
+	res := make(map[string]APIKey)
+	for _, item := range strings.Split(s, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+
+		role := RoleViewer
+		if len(parts) > 2 {
+			role = Role(parts[2])
+		}
+		if !role.Valid() {
+			slog.Warn("api key with unknown role skipped", "subject", parts[1], "role", role)
+			continue
+		}
+
+		res[parts[0]] = APIKey{Subject: parts[1], Role: role}
+	}
+	return res
+}
+
+// Authenticate accepts "Authorization: Bearer <jwt|api key>", "X-API-Key"
+// or ?token= for WebSockets.
+func (a *Authenticator) Authenticate(r *http.Request) (*Principal, error) {
+	if a.disabled {
+		return &Principal{Subject: "anonymous", Role: RoleAdmin, Method: "none"}, nil
+	}
+
+	token := r.Header.Get("X-API-Key")
+	if h := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		return nil, ErrUnauthenticated
+	}
+
+	hash := HashSecret(token)
+	if k, ok := a.apiKeys[hash]; ok {
+		return &Principal{Subject: k.Subject, Role: k.Role, Method: "api_key"}, nil
+	}
+
+	if a.users != nil && strings.Count(token, ".") != 2 {
+		sub, role, err := a.users.LookupAPIKey(r.Context(), hash)
+		if err != nil {
+			return nil, ErrUnauthenticated
+		}
+		return &Principal{Subject: sub, Role: Role(role), Method: "api_key"}, nil
+	}
+
+	if len(a.jwtSecret) == 0 || strings.Count(token, ".") != 2 {
+		return nil, ErrUnauthenticated
+	}
+
+	claims, err := VerifyJWT(token, a.jwtSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	role := Role(claims.Role)
+	if !role.Valid() {
+		role = RoleViewer
+	}
+
+	return &Principal{Subject: claims.Subject, Role: role, Method: "jwt"}, nil
+}
+
+// Middleware rejects unauthenticated requests except for public paths.
+func (a *Authenticator) Middleware(next http.Handler, public ...string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, p := range public {
+			if r.URL.Path == p {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		// preflight carries no credentials
+		if r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		p, err := a.Authenticate(r)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
+
+// HashSecret is how API keys and device secrets are stored.
+func HashSecret(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
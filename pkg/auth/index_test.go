@@ -0,0 +1,190 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// users is a UserStore keyed by the hash, like the users table.
+type users map[string][2]string
+
+func (u users) LookupAPIKey(_ context.Context, keyHash string) (string, string, error) {
+	v, ok := u[keyHash]
+	if !ok {
+		return "", "", errors.New("not found")
+	}
+	return v[0], v[1], nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	jwtToken, err := SignJWT(claims("anna", time.Hour, 0), testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownRole, err := SignJWT(Claims{Role: "root", RegisteredClaims: claims("bob", time.Hour, 0).RegisteredClaims}, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := users{HashSecret("user-key"): {"carla", "researcher"}}
+	a := NewAuthenticator(string(testSecret), ParseAPIKeys("static-key:grafana:viewer,ops-key:ops:operator"), store, false)
+
+	tests := []struct {
+		name    string
+		header  map[string]string
+		query   string
+		want    *Principal
+		wantErr bool
+	}{
+		{
+			name:   "static key in X-API-Key",
+			header: map[string]string{"X-API-Key": "static-key"},
+			want:   &Principal{Subject: "grafana", Role: RoleViewer, Method: "api_key"},
+		},
+		{
+			name:   "static key as bearer",
+			header: map[string]string{"Authorization": "Bearer ops-key"},
+			want:   &Principal{Subject: "ops", Role: RoleOperator, Method: "api_key"},
+		},
+		{
+			name:  "static key in the query",
+			query: "?token=static-key",
+			want:  &Principal{Subject: "grafana", Role: RoleViewer, Method: "api_key"},
+		},
+		{
+			name:   "user key looked up by its hash",
+			header: map[string]string{"X-API-Key": "user-key"},
+			want:   &Principal{Subject: "carla", Role: RoleResearcher, Method: "api_key"},
+		},
+		{
+			name:    "unknown key",
+			header:  map[string]string{"X-API-Key": "guess"},
+			wantErr: true,
+		},
+		{
+			name:   "jwt",
+			header: map[string]string{"Authorization": "Bearer " + jwtToken},
+			want:   &Principal{Subject: "anna", Role: RoleOperator, Method: "jwt"},
+		},
+		{
+			name:   "jwt with an unknown role is a viewer",
+			header: map[string]string{"Authorization": "Bearer " + unknownRole},
+			want:   &Principal{Subject: "bob", Role: RoleViewer, Method: "jwt"},
+		},
+		{
+			name:    "forged jwt",
+			header:  map[string]string{"Authorization": "Bearer " + jwtToken[:len(jwtToken)-2] + "xx"},
+			wantErr: true,
+		},
+		{
+			name:    "basic auth",
+			header:  map[string]string{"Authorization": "Basic c3RhdGljLWtleTo="},
+			wantErr: true,
+		},
+		{
+			name:    "nothing",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/devices"+tt.query, nil)
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+
+			got, err := a.Authenticate(r)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("authenticated as %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateWithoutJWTSecret(t *testing.T) {
+	token, err := SignJWT(claims("anna", time.Hour, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty secret must not verify tokens signed with an empty key
+	a := NewAuthenticator("", nil, nil, false)
+	r := httptest.NewRequest(http.MethodGet, "/devices", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	if p, err := a.Authenticate(r); err == nil {
+		t.Errorf("authenticated as %+v", p)
+	}
+}
+
+func TestAuthenticateDisabled(t *testing.T) {
+	a := NewAuthenticator("", nil, nil, true)
+
+	p, err := a.Authenticate(httptest.NewRequest(http.MethodGet, "/devices", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Role != RoleAdmin || p.Method != "none" {
+		t.Errorf("got %+v, want an anonymous admin", p)
+	}
+}
+
+func TestParseAPIKeys(t *testing.T) {
+	got := ParseAPIKeys(" k1:grafana , k2:ops:operator,k3:x:root,:nokey,k4:,k5")
+
+	want := map[string]APIKey{
+		"k1": {Subject: "grafana", Role: RoleViewer},
+		"k2": {Subject: "ops", Role: RoleOperator},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	a := NewAuthenticator("", ParseAPIKeys("k1:grafana"), nil, false)
+	h := a.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := FromContext(r.Context()); !ok && r.URL.Path != "/livez" && r.Method != http.MethodOptions {
+			t.Errorf("%s %s without a principal", r.Method, r.URL.Path)
+		}
+	}), "/livez")
+
+	tests := []struct {
+		method, path, key string
+		want              int
+	}{
+		{http.MethodGet, "/livez", "", http.StatusOK},
+		{http.MethodGet, "/devices", "", http.StatusUnauthorized},
+		{http.MethodGet, "/devices", "k1", http.StatusOK},
+		{http.MethodGet, "/livez/x", "", http.StatusUnauthorized},
+		{http.MethodOptions, "/devices", "", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.key != "" {
+			r.Header.Set("X-API-Key", tt.key)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("%s %s key %q: %d, want %d", tt.method, tt.path, tt.key, w.Code, tt.want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrInvalidToken = errors.New("invalid token")
+
+type Claims struct {
+	Role string `json:"role,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// VerifyJWT checks an HS256 token: signature, exp and nbf when present, and
+// a subject. Only HS256 is accepted, "none" and asymmetric algorithms are
+// rejected.
+func VerifyJWT(token string, secret []byte) (*Claims, error) {
+	var c Claims
+	_, err := jwt.ParseWithClaims(token, &c,
+		func(*jwt.Token) (any, error) { return secret, nil },
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if c.Subject == "" {
+		return nil, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+
+	return &c, nil
+}
+
+// SignJWT issues an HS256 token, used by tooling and tests of the frontend.
+func SignJWT(c Claims, secret []byte) (string, error) {
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, c).SignedString(secret)
+}
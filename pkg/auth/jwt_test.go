@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var testSecret = []byte("0123456789abcdef0123456789abcdef")
+
+func sign(t *testing.T, method jwt.SigningMethod, c Claims, key any) string {
+	t.Helper()
+	s, err := jwt.NewWithClaims(method, c).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func claims(sub string, exp, nbf time.Duration) Claims {
+	c := Claims{Role: "operator", RegisteredClaims: jwt.RegisteredClaims{Subject: sub}}
+	now := time.Now()
+	if exp != 0 {
+		c.ExpiresAt = jwt.NewNumericDate(now.Add(exp))
+	}
+	if nbf != 0 {
+		c.NotBefore = jwt.NewNumericDate(now.Add(nbf))
+	}
+	return c
+}
+
+func TestVerifyJWT(t *testing.T) {
+	valid := sign(t, jwt.SigningMethodHS256, claims("anna", time.Hour, 0), testSecret)
+	parts := strings.Split(valid, ".")
+
+	b64 := base64.RawURLEncoding.EncodeToString
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{name: "valid", token: valid, ok: true},
+		{name: "valid without exp", token: sign(t, jwt.SigningMethodHS256, claims("anna", 0, 0), testSecret), ok: true},
+		{name: "valid after nbf", token: sign(t, jwt.SigningMethodHS256, claims("anna", time.Hour, -time.Minute), testSecret), ok: true},
+		{
+			name:  "alg none",
+			token: b64([]byte(`{"alg":"none","typ":"JWT"}`)) + "." + parts[1] + ".",
+		},
+		{
+			name:  "alg none signed by the library",
+			token: sign(t, jwt.SigningMethodNone, claims("anna", time.Hour, 0), jwt.UnsafeAllowNoneSignatureType),
+		},
+		{
+			name:  "HS384 with the right key",
+			token: sign(t, jwt.SigningMethodHS384, claims("anna", time.Hour, 0), testSecret),
+		},
+		{
+			// alg confusion: the secret used as an HMAC key under an RS256 header
+			name:  "RS256 header",
+			token: b64([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + parts[1] + "." + parts[2],
+		},
+		{name: "wrong key", token: sign(t, jwt.SigningMethodHS256, claims("anna", time.Hour, 0), []byte("another secret"))},
+		{name: "expired", token: sign(t, jwt.SigningMethodHS256, claims("anna", -time.Second, 0), testSecret)},
+		{name: "not yet valid", token: sign(t, jwt.SigningMethodHS256, claims("anna", time.Hour, time.Minute), testSecret)},
+		{name: "no subject", token: sign(t, jwt.SigningMethodHS256, claims("", time.Hour, 0), testSecret)},
+		{name: "tampered payload", token: parts[0] + "." + b64([]byte(`{"sub":"root","role":"admin"}`)) + "." + parts[2]},
+		{name: "truncated signature", token: valid[:len(valid)-4]},
+		{name: "no signature", token: parts[0] + "." + parts[1]},
+		{name: "header only", token: parts[0]},
+		{name: "bad base64", token: parts[0] + ".!!!." + parts[2]},
+		{name: "header not json", token: b64([]byte("HS256")) + "." + parts[1] + "." + parts[2]},
+		{name: "empty", token: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := VerifyJWT(tt.token, testSecret)
+			if !tt.ok {
+				if !errors.Is(err, ErrInvalidToken) {
+					t.Fatalf("err %v, want ErrInvalidToken", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.Subject != "anna" || c.Role != "operator" {
+				t.Errorf("claims %+v", c)
+			}
+		})
+	}
+}
+
+func TestSignJWT(t *testing.T) {
+	token, err := SignJWT(claims("anna", time.Hour, 0), testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := VerifyJWT(token, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Subject != "anna" || c.Role != "operator" {
+		t.Errorf("round trip gave %+v", c)
+	}
+}
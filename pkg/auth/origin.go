@@ -0,0 +1,69 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Origins is the list of browser origins allowed to call the API, "*" allows
+// any origin.
+type Origins struct {
+	any     bool
+	allowed map[string]struct{}
+}
+
+// ParseOrigins reads a comma separated list.
+func ParseOrigins(s string) *Origins {
+	o := &Origins{allowed: make(map[string]struct{})}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimRight(strings.TrimSpace(v), "/")
+		if v == "" {
+			continue
+		}
+		if v == "*" {
+			o.any = true
+			continue
+		}
+		o.allowed[strings.ToLower(v)] = struct{}{}
+	}
+	return o
+}
+
+func (o *Origins) Allowed(origin string) bool {
+	if o.any {
+		return true
+	}
+	_, ok := o.allowed[strings.ToLower(strings.TrimRight(origin, "/"))]
+	return ok
+}
+
+// CheckOrigin is meant for websocket.Upgrader. Requests without Origin come
+// from non-browser clients (ESPs, tools) and are let through, they still
+// have to authenticate.
+func (o *Origins) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || o.Allowed(origin)
+}
+
+// CORS answers preflights and sets the CORS headers for allowed origins
+// only. Credentials are never combined with a wildcard origin.
+func (o *Origins) CORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+
+		if origin != "" && o.Allowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Client-ID")
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,68 @@
+package auth
+
+import "net/http"
+
+type Role string
+
+const (
+	RoleAdmin      Role = "admin"
+	RoleOperator   Role = "operator"
+	RoleResearcher Role = "researcher"
+	RoleViewer     Role = "viewer"
+)
+
+type Permission string
+
+const (
+	// PermView: list devices and movements, subscribe to device data
+	PermView Permission = "view"
+	// PermControl: reserve devices, acquire control, start/stop trainings and streams
+	PermControl Permission = "control"
+	// PermExport: download recorded datasets
+	PermExport Permission = "export"
+	// PermTakeover: take control of a device from another client
+	PermTakeover Permission = "takeover"
+	// PermManageUsers: create, change and delete users
+	PermManageUsers Permission = "manage_users"
+	// PermManageDevices: provision, rename, tag, disable and delete devices
+	PermManageDevices Permission = "manage_devices"
+	// PermDebug: read the running configuration
+	PermDebug Permission = "debug"
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleAdmin:      {PermView, PermControl, PermExport, PermTakeover, PermManageUsers, PermManageDevices, PermDebug},
+	RoleOperator:   {PermView, PermControl},
+	RoleResearcher: {PermView, PermExport},
+	RoleViewer:     {PermView},
+}
+
+func (r Role) Valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+func (r Role) Can(p Permission) bool {
+	for _, v := range rolePermissions[r] {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Principal) Can(perm Permission) bool {
+	return p != nil && p.Role.Can(perm)
+}
+
+// Require answers 403 unless the authenticated principal has perm.
+func Require(perm Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, _ := FromContext(r.Context())
+		if !p.Can(perm) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequire(t *testing.T) {
+	all := []Permission{PermView, PermControl, PermExport, PermTakeover, PermManageUsers, PermManageDevices, PermDebug}
+
+	// what every role may do, the rest is forbidden
+	allowed := map[Role][]Permission{
+		RoleAdmin:      all,
+		RoleOperator:   {PermView, PermControl},
+		RoleResearcher: {PermView, PermExport},
+		RoleViewer:     {PermView},
+		Role("root"):   nil,
+	}
+
+	for role, perms := range allowed {
+		for _, perm := range all {
+			want := http.StatusForbidden
+			for _, p := range perms {
+				if p == perm {
+					want = http.StatusOK
+				}
+			}
+
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r = r.WithContext(WithPrincipal(r.Context(), &Principal{Subject: "x", Role: role}))
+			w := httptest.NewRecorder()
+			Require(perm, func(http.ResponseWriter, *http.Request) {})(w, r)
+
+			if w.Code != want {
+				t.Errorf("%s with %s: %d, want %d", role, perm, w.Code, want)
+			}
+		}
+	}
+}
+
+func TestRequireWithoutPrincipal(t *testing.T) {
+	w := httptest.NewRecorder()
+	Require(PermView, func(http.ResponseWriter, *http.Request) {
+		t.Error("handler called")
+	})(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("%d, want 403", w.Code)
+	}
+}
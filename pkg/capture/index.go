@@ -0,0 +1,94 @@
+// Package capture is the file format of recorded WebSocket traffic: JSON
+// lines, one per message, in the order the backend saw them.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Direction is seen from the backend.
+type Direction string
+
+const (
+	In     Direction = "in"    // read from the socket
+	Out    Direction = "out"   // written to the socket
+	Closed Direction = "close" // the connection ended, no message
+)
+
+type Record struct {
+	At   time.Time       `json:"at"`
+	Conn string          `json:"conn"` // connection id, esp-3, frontend-7
+	Kind string          `json:"kind"` // esp or frontend
+	Dir  Direction       `json:"dir"`
+	Msg  json.RawMessage `json:"msg,omitempty"`
+}
+
+// Writer appends records to a file, safe for concurrent use. Every record is
+// written through so a crash loses nothing.
+type Writer struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// Create opens path for appending, a capture over several runs stays one
+// file.
+func Create(path string) (*Writer, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{f: f}, nil
+}
+
+// Write stores r, a message that is not JSON is kept as a JSON string.
+func (w *Writer) Write(r Record) error {
+	if r.Msg != nil && !json.Valid(r.Msg) {
+		r.Msg, _ = json.Marshal(string(r.Msg))
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err = w.f.Write(b)
+	return err
+}
+
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.f.Close()
+}
+
+// Read returns every record of a capture.
+func Read(r io.Reader) ([]Record, error) {
+	var out []Record
+
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for line := 1; sc.Scan(); line++ {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(sc.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		out = append(out, rec)
+	}
+
+	return out, sc.Err()
+}
@@ -5,5 +5,25 @@ import "errors"
 var ErrNotFound = errors.New("not found")
 var ErrDeviceBusy = errors.New("device busy")
 var ErrIncorrectRep = errors.New("incorrect rep")
+var ErrRepNotFlagged = errors.New("only a flagged repetition can be recorded again")
 var ErrMovementNotAllowed = errors.New("movement not allowed")
 var ErrSomethingWentWrong = errors.New("something went wrong")
+var ErrInvalidTimeSync = errors.New("invalid time sync reply")
+var ErrDeviceDisconnected = errors.New("device disconnected")
+var ErrNotInControl = errors.New("not in control of device")
+var ErrForbidden = errors.New("forbidden")
+var ErrNotReserved = errors.New("device is not reserved")
+var ErrReservationConflict = errors.New("device is reserved by another client")
+var ErrNoClientID = errors.New("client id is required")
+var ErrDeviceUnauthorized = errors.New("device authentication failed")
+var ErrAlreadyExists = errors.New("already exists")
+var ErrInvalidRole = errors.New("invalid role")
+var ErrInvalidName = errors.New("invalid name")
+var ErrDeviceDisabled = errors.New("device disabled")
+var ErrDeviceHasData = errors.New("device has recorded trainings")
+var ErrTrainingActive = errors.New("training has an open session")
+var ErrInvalidStatus = errors.New("invalid device status")
+var ErrInvalidConfig = errors.New("invalid device config")
+var ErrNotStreaming = errors.New("device is not streaming")
+var ErrInvalidCalibration = errors.New("invalid calibration request")
+var ErrModeMismatch = errors.New("packet does not match device mode")
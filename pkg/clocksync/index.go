@@ -0,0 +1,198 @@
+package clocksync
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxExchanges is how many ping exchanges are kept per device. Older ones
+// are dropped so that the drift estimate follows temperature changes of the
+// ESP crystal.
+const maxExchanges = 32
+
+// bestFraction is the share of exchanges with the lowest round-trip delay
+// that is used for the fit. Wi-Fi delays are very asymmetric, the fast
+// exchanges are the ones that are closest to symmetric.
+const bestFraction = 0.5
+
+// Exchange is one NTP-style ping. T1 and T4 are server clock, T2 and T3 are
+// ESP clock, all in nanoseconds.
+type Exchange struct {
+	T1 int64
+	T2 int64
+	T3 int64
+	T4 int64
+}
+
+// Offset is ESP clock minus server clock at the middle of the exchange.
+func (e Exchange) Offset() int64 {
+	return ((e.T2 - e.T1) + (e.T3 - e.T4)) / 2
+}
+
+// Delay is the network round trip without ESP processing time.
+func (e Exchange) Delay() int64 {
+	return (e.T4 - e.T1) - (e.T3 - e.T2)
+}
+
+// Midpoint is the server time the offset belongs to.
+func (e Exchange) Midpoint() int64 {
+	return e.T1 + (e.T4-e.T1)/2
+}
+
+type Estimate struct {
+	// Offset is ESP clock minus server clock at Reference.
+	Offset time.Duration
+	// Drift is how many nanoseconds the ESP clock gains per server nanosecond.
+	Drift float64
+	// Error is the estimated uncertainty of a corrected timestamp.
+	Error     time.Duration
+	Reference time.Time
+	Samples   int
+	LastSync  time.Time
+}
+
+// ToServer converts an ESP timestamp (ns) to server time (ns).
+func (e Estimate) ToServer(espNs int64) int64 {
+	ref := e.Reference.UnixNano()
+	// espNs = server + offset + drift*(server-ref), solved for server.
+	return ref + int64(float64(espNs-ref-int64(e.Offset))/(1+e.Drift))
+}
+
+type Clock struct {
+	mu        sync.Mutex
+	exchanges []Exchange
+	estimate  Estimate
+	valid     bool
+}
+
+func (c *Clock) Add(ex Exchange) bool {
+	if ex.T4 < ex.T1 || ex.T3 < ex.T2 || ex.Delay() < 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.exchanges = append(c.exchanges, ex)
+	if len(c.exchanges) > maxExchanges {
+		c.exchanges = c.exchanges[len(c.exchanges)-maxExchanges:]
+	}
+
+	c.estimate = fit(c.exchanges)
+	c.valid = true
+
+	return true
+}
+
+func (c *Clock) Estimate() (Estimate, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.estimate, c.valid
+}
+
+// fit does a least squares line through offset(midpoint) of the fastest
+// exchanges. With a single usable exchange the drift is assumed to be zero.
+func fit(all []Exchange) Estimate {
+	best := make([]Exchange, len(all))
+	copy(best, all)
+	sort.Slice(best, func(i, j int) bool { return best[i].Delay() < best[j].Delay() })
+
+	n := int(math.Ceil(float64(len(best)) * bestFraction))
+	if n < 1 {
+		n = 1
+	}
+	best = best[:n]
+
+	ref := all[len(all)-1].Midpoint()
+
+	var sx, sy, sxx, sxy float64
+	for _, ex := range best {
+		x := float64(ex.Midpoint() - ref)
+		y := float64(ex.Offset())
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+
+	fn := float64(n)
+	drift := 0.0
+	offset := sy / fn
+	if den := fn*sxx - sx*sx; n > 2 && den != 0 {
+		drift = (fn*sxy - sx*sy) / den
+		offset = (sy - drift*sx) / fn
+	}
+
+	var residual float64
+	for _, ex := range best {
+		x := float64(ex.Midpoint() - ref)
+		d := float64(ex.Offset()) - (offset + drift*x)
+		residual += d * d
+	}
+	residual = math.Sqrt(residual / fn)
+
+	// Offset of an exchange is off by at most half of its delay (fully
+	// asymmetric path), the residual covers jitter between exchanges.
+	errNs := float64(best[0].Delay())/2 + residual
+
+	return Estimate{
+		Offset:    time.Duration(offset),
+		Drift:     drift,
+		Error:     time.Duration(errNs),
+		Reference: time.Unix(0, ref).UTC(),
+		Samples:   len(all),
+		LastSync:  time.Unix(0, all[len(all)-1].T4).UTC(),
+	}
+}
+
+// Registry keeps one Clock per device.
+type Registry struct {
+	mu     sync.Mutex
+	clocks map[int]*Clock
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		clocks: make(map[int]*Clock),
+	}
+}
+
+func (r *Registry) Get(deviceID int) *Clock {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.clocks[deviceID]
+	if !ok {
+		c = &Clock{}
+		r.clocks[deviceID] = c
+	}
+	return c
+}
+
+// Reset forgets the exchanges of a device, used when the ESP reboots and its
+// clock starts from scratch.
+func (r *Registry) Reset(deviceID int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.clocks, deviceID)
+}
+
+// ToServerTime maps an ESP timestamp string (Unix ns) to server time. Until
+// the device has a sync estimate, or when the timestamp cannot be parsed, the
+// receive time is used: the ESP clock is never trusted as is.
+func (r *Registry) ToServerTime(deviceID int, espTs string, received time.Time) time.Time {
+	est, ok := r.Get(deviceID).Estimate()
+	if !ok {
+		return received.UTC()
+	}
+
+	espNs, err := strconv.ParseInt(espTs, 10, 64)
+	if err != nil {
+		return received.UTC()
+	}
+
+	return time.Unix(0, est.ToServer(espNs)).UTC()
+}
@@ -0,0 +1,193 @@
+package clocksync
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// espClock is the clock of a simulated ESP: offset ahead of the server at
+// t0 and gaining drift ns per server ns.
+type espClock struct {
+	t0     int64
+	offset int64
+	drift  float64
+}
+
+func (c espClock) at(server int64) int64 {
+	return server + c.offset + int64(c.drift*float64(server-c.t0))
+}
+
+// exchange pings at server time t1 with up and down network delays and 1 ms
+// of processing on the ESP.
+func (c espClock) exchange(t1 int64, up, down time.Duration) Exchange {
+	const processing = int64(time.Millisecond)
+	arrive := t1 + int64(up)
+	return Exchange{
+		T1: t1,
+		T2: c.at(arrive),
+		T3: c.at(arrive + processing),
+		T4: arrive + processing + int64(down),
+	}
+}
+
+func TestFit(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	fast := 2 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		clock     espClock
+		exchanges func(c espClock) []Exchange
+		tolerance time.Duration // of a corrected timestamp
+	}{
+		{
+			name:  "offset only",
+			clock: espClock{t0: t0, offset: int64(3 * time.Second)},
+			exchanges: func(c espClock) []Exchange {
+				var out []Exchange
+				for i := range 16 {
+					out = append(out, c.exchange(t0+int64(i)*int64(time.Second), fast, fast))
+				}
+				return out
+			},
+			tolerance: 10 * time.Microsecond,
+		},
+		{
+			name:  "offset and drift",
+			clock: espClock{t0: t0, offset: -int64(40 * time.Second), drift: 50e-6}, // 50 ppm crystal
+			exchanges: func(c espClock) []Exchange {
+				var out []Exchange
+				for i := range 32 {
+					out = append(out, c.exchange(t0+int64(i)*int64(10*time.Second), fast, fast))
+				}
+				return out
+			},
+			tolerance: 10 * time.Microsecond,
+		},
+		{
+			name:  "slow asymmetric exchanges are discarded",
+			clock: espClock{t0: t0, offset: int64(time.Second), drift: 20e-6},
+			exchanges: func(c espClock) []Exchange {
+				var out []Exchange
+				for i := range 32 {
+					up := fast
+					if i%2 == 1 {
+						// would put the offset 100 ms off
+						up = 200 * time.Millisecond
+					}
+					out = append(out, c.exchange(t0+int64(i)*int64(5*time.Second), up, fast))
+				}
+				return out
+			},
+			tolerance: 10 * time.Microsecond,
+		},
+		{
+			name:  "single exchange assumes no drift",
+			clock: espClock{t0: t0, offset: int64(7 * time.Millisecond)},
+			exchanges: func(c espClock) []Exchange {
+				return []Exchange{c.exchange(t0, fast, fast)}
+			},
+			tolerance: 10 * time.Microsecond,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Clock
+			exs := tt.exchanges(tt.clock)
+			for _, ex := range exs {
+				if !c.Add(ex) {
+					t.Fatalf("exchange %+v rejected", ex)
+				}
+			}
+
+			est, ok := c.Estimate()
+			if !ok {
+				t.Fatal("no estimate")
+			}
+			if est.Samples != len(exs) {
+				t.Errorf("samples %d, want %d", est.Samples, len(exs))
+			}
+			if est.Error < fast/2 {
+				t.Errorf("error %v below half the fastest delay %v", est.Error, fast/2)
+			}
+			if want := tt.clock.drift; abs(est.Drift-want) > 1e-7 {
+				t.Errorf("drift %g, want %g", est.Drift, want)
+			}
+
+			// a packet stamped a minute after the last exchange
+			last := exs[len(exs)-1].T4
+			for _, server := range []int64{t0, last, last + int64(time.Minute)} {
+				got := est.ToServer(tt.clock.at(server))
+				if d := time.Duration(got - server); d > tt.tolerance || d < -tt.tolerance {
+					t.Errorf("server time %d mapped %v off", server, d)
+				}
+			}
+		})
+	}
+}
+
+func TestAddRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		ex   Exchange
+	}{
+		{"reply before request", Exchange{T1: 100, T2: 10, T3: 20, T4: 50}},
+		{"esp replied before it received", Exchange{T1: 0, T2: 20, T3: 10, T4: 100}},
+		{"processing longer than the round trip", Exchange{T1: 0, T2: 0, T3: 200, T4: 100}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c Clock
+			if c.Add(tt.ex) {
+				t.Error("accepted")
+			}
+			if _, ok := c.Estimate(); ok {
+				t.Error("estimate from a rejected exchange")
+			}
+		})
+	}
+}
+
+func TestToServerTime(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano()
+	clock := espClock{t0: t0, offset: int64(time.Hour)}
+	received := time.Unix(0, t0+int64(5*time.Second))
+	packet := strconv.FormatInt(clock.at(t0+int64(4*time.Second)), 10)
+
+	r := NewRegistry()
+
+	// the ESP clock is an hour ahead, it must not be used unsynced
+	if got := r.ToServerTime(1, packet, received); !got.Equal(received) {
+		t.Errorf("unsynced: %v, want the receive time %v", got, received)
+	}
+
+	r.Get(1).Add(clock.exchange(t0, time.Millisecond, time.Millisecond))
+
+	if got, want := r.ToServerTime(1, packet, received), time.Unix(0, t0+int64(4*time.Second)); got.Sub(want).Abs() > time.Millisecond {
+		t.Errorf("synced: %v, want %v", got, want)
+	}
+	if got := r.ToServerTime(1, "soon", received); !got.Equal(received) {
+		t.Errorf("unparsable: %v, want the receive time", got)
+	}
+	if got := r.ToServerTime(2, packet, received); !got.Equal(received) {
+		t.Errorf("other device: %v, want the receive time", got)
+	}
+	if got := r.ToServerTime(1, packet, received); got.Location() != time.UTC {
+		t.Errorf("location %v, want UTC", got.Location())
+	}
+
+	r.Reset(1)
+	if got := r.ToServerTime(1, packet, received); !got.Equal(received) {
+		t.Errorf("after reset: %v, want the receive time", got)
+	}
+}
+
+func abs(x float64) float64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -1,9 +1,10 @@
 package dto
 
 import (
+	"emg_esp32_classifier_backend/pkg/models"
+	"emg_esp32_classifier_backend/pkg/quality"
 	"emg_esp32_classifier_backend/pkg/sessions"
 	"emg_esp32_classifier_backend/pkg/utils"
-	"strconv"
 	"time"
 )
 
@@ -15,6 +16,7 @@ type TrainingRaw struct {
 	Repetition int       `db:"repetition" json:"repetition"`
 	TS         time.Time `db:"ts" json:"timestamp"`
 	Raw        []byte    `db:"raw" json:"raw"` // BYTEA
+	Subject    string    `db:"subject" json:"subject"`
 }
 
 type DeviceStatus string
@@ -23,13 +25,144 @@ const (
 	DeviceStatusIdle      DeviceStatus = "idle"
 	DeviceStatusStreaming DeviceStatus = "streaming"
 	DeviceStatusReserved  DeviceStatus = "reserved"
+
+	DeviceStatusDisconnected DeviceStatus = "disconnected"
+)
+
+// DeviceMode is what the ESP is currently asked to do, it decides which
+// packets are accepted from it. Kept in memory only, a reconnecting ESP
+// starts idle.
+type DeviceMode string
+
+const (
+	DeviceModeIdle          DeviceMode = "idle"
+	DeviceModeRecording     DeviceMode = "recording"
+	DeviceModeLiveInference DeviceMode = "live_inference"
+	DeviceModeCalibration   DeviceMode = "calibration"
 )
 
 type Device struct {
 	ID       int          `json:"id"`
 	Name     string       `json:"name"`
 	Status   DeviceStatus `json:"status"`
+	Mode     DeviceMode   `json:"mode"`
 	LastSeen time.Time    `json:"last_seen"`
+	Tags     []string     `json:"tags"`
+	Disabled bool         `json:"disabled"`
+
+	// reported by the ESP at handshake
+	FirmwareVersion string `json:"firmware_version,omitempty"`
+	ChannelCount    int    `json:"channel_count,omitempty"`
+	SampleRate      int    `json:"sample_rate,omitempty"`
+	ADCBits         int    `json:"adc_bits,omitempty"` // unipolar, samples 0 .. 2^bits-1
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// DeviceUpdate is a partial update, nil fields are not changed.
+type DeviceUpdate struct {
+	Name     *string   `json:"name"`
+	Tags     *[]string `json:"tags"`
+	Disabled *bool     `json:"disabled"`
+}
+
+// DeviceConfigVersion is one entry of a device's config history, AckedAt
+// stays nil until the ESP confirmed it.
+type DeviceConfigVersion struct {
+	DeviceID  int                 `json:"device_id"`
+	Version   int                 `json:"version"`
+	Config    models.DeviceConfig `json:"config"`
+	CreatedBy string              `json:"created_by"`
+	CreatedAt time.Time           `json:"created_at"`
+	AckedAt   *time.Time          `json:"acked_at,omitempty"`
+	AckError  string              `json:"ack_error,omitempty"`
+}
+
+type RepetitionQuality struct {
+	TrainingID int `json:"training_id"`
+	Repetition int `json:"repetition"`
+	quality.Metrics
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Segment is a detected run of muscle activity inside a repetition, samples
+// outside of every segment of a repetition are rest.
+type Segment struct {
+	TrainingID  int       `json:"training_id"`
+	Repetition  int       `json:"repetition"`
+	StartSample int       `json:"start_sample"` // within the repetition
+	EndSample   int       `json:"end_sample"`   // exclusive
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Method      string    `json:"method"`
+}
+
+// Contains reports whether ts falls into the segment.
+func (s Segment) Contains(ts time.Time) bool {
+	return !ts.Before(s.Start) && ts.Before(s.End)
+}
+
+type CalibrationPhase string
+
+const (
+	// CalibrationRest records the relaxed muscle, its RMS is the noise floor.
+	CalibrationRest CalibrationPhase = "rest"
+	// CalibrationMVC records a maximum voluntary contraction.
+	CalibrationMVC CalibrationPhase = "mvc"
+)
+
+// Calibration holds the levels of one subject on one device, both phases are
+// recorded separately. The levels are per active channel in packet order,
+// RestRMS and MVCRMS pool them for onset detection and messages.
+type Calibration struct {
+	DeviceID   int        `json:"device_id"`
+	Subject    string     `json:"subject"`
+	RestLevels []float64  `json:"rest_levels"`
+	MVCLevels  []float64  `json:"mvc_levels"`
+	RestRMS    float64    `json:"rest_rms"`
+	MVCRMS     float64    `json:"mvc_rms"`
+	RestAt     *time.Time `json:"rest_at,omitempty"`
+	MVCAt      *time.Time `json:"mvc_at,omitempty"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// Ready reports whether both phases were recorded with the same channels and
+// every channel contracts above its rest level.
+func (c *Calibration) Ready() bool {
+	if c == nil || c.RestAt == nil || c.MVCAt == nil || len(c.MVCLevels) == 0 || len(c.RestLevels) != len(c.MVCLevels) {
+		return false
+	}
+	for ch, mvc := range c.MVCLevels {
+		if mvc <= c.RestLevels[ch] {
+			return false
+		}
+	}
+	return true
+}
+
+// Channels is how many channels the calibration was recorded with.
+func (c *Calibration) Channels() int {
+	return len(c.MVCLevels)
+}
+
+// Features is what live prediction, the export and the model evaluation use
+// instead of utils.ExtractFeatures for a calibrated subject.
+func (c *Calibration) Features(raw []int) []float64 {
+	return utils.NormalizedFeatures(raw, c.RestLevels, c.MVCLevels)
+}
+
+type Reservation struct {
+	DeviceID  int       `json:"device_id"`
+	Owner     string    `json:"owner"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type User struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
 }
 
 type Movements struct {
@@ -38,6 +171,38 @@ type Movements struct {
 	Description string `json:"description"`
 }
 
+// Training is one training with what was recorded for it so far.
+type Training struct {
+	ID         int       `json:"id"`
+	DeviceID   int       `json:"device_id"`
+	MovementID int       `json:"movement_id"`
+	Repetition int       `json:"repetition"` // the last one started
+	Subject    string    `json:"subject"`
+	Finished   bool      `json:"finished"`
+	CreatedAt  time.Time `json:"created_at"`
+	Packets    int       `json:"packets"`
+	Flagged    int       `json:"flagged"` // repetitions flagged by the quality check
+}
+
+// TrainingFilter narrows ListTrainings, zero fields match everything.
+type TrainingFilter struct {
+	ID         int
+	DeviceID   int
+	MovementID int
+	Subject    string
+	Limit      int
+}
+
+// ModelEvaluation is how the ML service classifies the packets of one
+// training.
+type ModelEvaluation struct {
+	TrainingID int            `json:"training_id"`
+	MovementID int            `json:"movement_id"`
+	Packets    int            `json:"packets"`
+	Failed     int            `json:"failed"`  // predict errors
+	Classes    map[string]int `json:"classes"` // class name → packets
+}
+
 type TrainingSummary struct {
 	TrainingID int `json:"training_id"`
 	DeviceID   int `json:"device_id"`
@@ -46,18 +211,19 @@ type TrainingSummary struct {
 	Samples    int `json:"samples"`
 }
 
-func MapWsToTrainingRaw(rawSlice []int, espTs string, session *sessions.Session) *TrainingRaw {
-	rawBytes := utils.IntSliceToBytea(rawSlice)
-
-	tsInt, err := strconv.ParseInt(espTs, 10, 64)
-	if err != nil {
-		tsInt = time.Now().UnixNano()
-	}
-
-	sec := tsInt / 1_000_000_000
-	nsec := tsInt % 1_000_000_000
+type ClockSync struct {
+	DeviceID int       `json:"device_id"`
+	Synced   bool      `json:"synced"`
+	OffsetMs float64   `json:"offset_ms"`
+	DriftPPM float64   `json:"drift_ppm"`
+	ErrorMs  float64   `json:"error_ms"`
+	Samples  int       `json:"samples"`
+	LastSync time.Time `json:"last_sync,omitempty"`
+}
 
-	ts := time.Unix(sec, nsec).UTC()
+// MapWsToTrainingRaw expects ts already converted to server time.
+func MapWsToTrainingRaw(rawSlice []int, ts time.Time, session *sessions.Session) *TrainingRaw {
+	rawBytes := utils.IntSliceToBytea(rawSlice)
 
 	return &TrainingRaw{
 		TrainingID: session.TrainingID,
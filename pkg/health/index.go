@@ -0,0 +1,143 @@
+// Package health runs named dependency checks for /livez and /readyz.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusOK       Status = "ok"
+	StatusDegraded Status = "degraded" // a non critical check failed, still ready
+	StatusDown     Status = "down"
+)
+
+type Check struct {
+	Name string
+	// a failing critical check makes /readyz answer 503
+	Critical bool
+	Timeout  time.Duration
+	Fn       func(ctx context.Context) error
+}
+
+type CheckResult struct {
+	Status    Status  `json:"status"`
+	Critical  bool    `json:"critical"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type Report struct {
+	Status Status                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+type Checker struct {
+	mu     sync.Mutex
+	checks []Check
+}
+
+func NewChecker() *Checker {
+	return &Checker{}
+}
+
+// Add registers a check, a zero Timeout means 2s.
+func (c *Checker) Add(check Check) {
+	if check.Timeout <= 0 {
+		check.Timeout = 2 * time.Second
+	}
+
+	c.mu.Lock()
+	c.checks = append(c.checks, check)
+	c.mu.Unlock()
+}
+
+// Run runs every check concurrently, each under its own timeout.
+func (c *Checker) Run(ctx context.Context) Report {
+	c.mu.Lock()
+	checks := append([]Check(nil), c.checks...)
+	c.mu.Unlock()
+
+	results := make([]CheckResult, len(checks))
+
+	var wg sync.WaitGroup
+	for i, check := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = run(ctx, check)
+		}()
+	}
+	wg.Wait()
+
+	rep := Report{Status: StatusOK, Checks: make(map[string]CheckResult, len(checks))}
+	for i, check := range checks {
+		res := results[i]
+		rep.Checks[check.Name] = res
+
+		if res.Status == StatusOK {
+			continue
+		}
+		if check.Critical {
+			rep.Status = StatusDown
+		} else if rep.Status == StatusOK {
+			rep.Status = StatusDegraded
+		}
+	}
+
+	return rep
+}
+
+func run(ctx context.Context, check Check) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, check.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check.Fn(ctx)
+
+	res := CheckResult{
+		Status:    StatusOK,
+		Critical:  check.Critical,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		res.Status = StatusDown
+		res.Error = err.Error()
+	}
+
+	return res
+}
+
+// LiveHandler only says the process is serving, it never checks dependencies
+// so a database outage does not get the container restarted.
+func LiveHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeReport(w, http.StatusOK, Report{Status: StatusOK})
+	}
+}
+
+// ReadyHandler answers 503 when a critical check fails, 200 otherwise.
+func (c *Checker) ReadyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rep := c.Run(r.Context())
+
+		code := http.StatusOK
+		if rep.Status == StatusDown {
+			code = http.StatusServiceUnavailable
+		}
+
+		writeReport(w, code, rep)
+	}
+}
+
+func writeReport(w http.ResponseWriter, code int, rep Report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(rep)
+}
@@ -0,0 +1,182 @@
+// Package logging sets up log/slog for the backend: text or JSON output,
+// request scoped fields carried in the context and debug output that can be
+// switched on for single devices while running.
+package logging
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+type ctxKey struct{}
+
+// fields are what the context carries, deviceID is kept apart from the attrs
+// so the handler can look up the per-device level without scanning them.
+type fields struct {
+	attrs    []slog.Attr
+	deviceID int
+}
+
+func fromContext(ctx context.Context) fields {
+	if ctx == nil {
+		return fields{}
+	}
+	f, _ := ctx.Value(ctxKey{}).(fields)
+	return f
+}
+
+// With returns ctx with attrs added to every record logged with it. A key
+// set again replaces the older value.
+func With(ctx context.Context, attrs ...slog.Attr) context.Context {
+	f := fromContext(ctx)
+
+	out := make([]slog.Attr, 0, len(f.attrs)+len(attrs))
+	for _, a := range f.attrs {
+		replaced := false
+		for _, b := range attrs {
+			if a.Key == b.Key {
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			out = append(out, a)
+		}
+	}
+	f.attrs = append(out, attrs...)
+
+	return context.WithValue(ctx, ctxKey{}, f)
+}
+
+func WithDevice(ctx context.Context, deviceID int) context.Context {
+	ctx = With(ctx, slog.Int("device_id", deviceID))
+	f := fromContext(ctx)
+	f.deviceID = deviceID
+	return context.WithValue(ctx, ctxKey{}, f)
+}
+
+func WithTraining(ctx context.Context, trainingID, rep int) context.Context {
+	return With(ctx, slog.Int("training_id", trainingID), slog.Int("rep", rep))
+}
+
+func WithConn(ctx context.Context, connID string) context.Context {
+	return With(ctx, slog.String("conn_id", connID))
+}
+
+func WithEvent(ctx context.Context, event string) context.Context {
+	return With(ctx, slog.String("event", event))
+}
+
+var (
+	level = new(slog.LevelVar)
+
+	debugMu      sync.RWMutex
+	debugDevices = map[int]bool{}
+)
+
+// SetDeviceDebug turns debug records on or off for one device, whatever the
+// global level is.
+func SetDeviceDebug(deviceID int, on bool) {
+	debugMu.Lock()
+	defer debugMu.Unlock()
+
+	if on {
+		debugDevices[deviceID] = true
+	} else {
+		delete(debugDevices, deviceID)
+	}
+}
+
+func DeviceDebug(deviceID int) bool {
+	debugMu.RLock()
+	defer debugMu.RUnlock()
+
+	return debugDevices[deviceID]
+}
+
+// DebugDevices lists the devices with debug on, sorted.
+func DebugDevices() []int {
+	debugMu.RLock()
+	defer debugMu.RUnlock()
+
+	ids := make([]int, 0, len(debugDevices))
+	for id := range debugDevices {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+// ParseLevel accepts debug, info, warn and error, anything else is info.
+func ParseLevel(s string) slog.Level {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// Setup installs the default slog logger, format is "json" or "text". The
+// standard log package ends up there too.
+func Setup(w io.Writer, format string, lvl slog.Level) {
+	level.Set(lvl)
+
+	// the inner handler lets everything through, Enabled below decides
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	var inner slog.Handler
+	if format == "json" {
+		inner = slog.NewJSONHandler(w, opts)
+	} else {
+		inner = slog.NewTextHandler(w, opts)
+	}
+
+	slog.SetDefault(slog.New(&handler{inner: inner}))
+}
+
+type handler struct {
+	inner slog.Handler
+}
+
+func (h *handler) Enabled(ctx context.Context, l slog.Level) bool {
+	if l >= level.Level() {
+		return true
+	}
+
+	f := fromContext(ctx)
+	return l >= slog.LevelDebug && f.deviceID != 0 && DeviceDebug(f.deviceID)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	f := fromContext(ctx)
+	span := trace.SpanContextFromContext(ctx)
+
+	if len(f.attrs) > 0 || span.IsSampled() {
+		r = r.Clone()
+		r.AddAttrs(f.attrs...)
+	}
+	// lets a log line be looked up in the trace it belongs to
+	if span.IsSampled() {
+		r.AddAttrs(slog.String("trace_id", span.TraceID().String()), slog.String("span_id", span.SpanID().String()))
+	}
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{inner: h.inner.WithAttrs(attrs)}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{inner: h.inner.WithGroup(name)}
+}
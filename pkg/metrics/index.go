@@ -0,0 +1,34 @@
+// Package metrics holds the Prometheus registry the backend registers its
+// metrics with, and serves it.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry has the Go runtime and process collectors, and everything created
+// through Factory.
+var Registry = prometheus.NewRegistry()
+
+// Factory creates metrics registered with Registry.
+var Factory = promauto.With(Registry)
+
+// LatencyBuckets in seconds, 1 ms .. 5 s.
+var LatencyBuckets = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+}
+
+// Handler serves Registry in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"emg_esp32_classifier_backend/pkg/quality"
 	"errors"
 )
 
@@ -8,30 +9,54 @@ type Event string
 
 var ErrMovementNotAllowed = errors.New("movement is not allowed: previous movement is not finished")
 
-const DefaultDurationOfTraining = 5
-
 const (
 
 	// Frontend to backend
-	EventStartTraining  Event = "start_training"
-	EventStartStreaming Event = "start_streaming"
-	EventStopTraining   Event = "stop"
+	EventStartTraining    Event = "start_training"
+	EventStartStreaming   Event = "start_streaming"
+	EventStopTraining     Event = "stop"
+	EventSubscribe        Event = "subscribe"
+	EventUnsubscribe      Event = "unsubscribe"
+	EventAcquireControl   Event = "acquire_control"
+	EventControlHeartbeat Event = "control_heartbeat"
+	EventReleaseControl   Event = "release_control"
+	EventTakeoverControl  Event = "takeover_control" // admin only
+	EventStartCalibration Event = "start_calibration"
 
 	// Backend to esp
-	EventESPStartRawStream Event = "raw_stream"
-	EventESPStopRawStream  Event = "stop_raw_stream"
+	EventESPStartRawStream   Event = "raw_stream" // recording one rep, stops by itself after duration
+	EventESPStopRawStream    Event = "stop_raw_stream"
+	EventESPStartLiveStream  Event = "start_live_stream" // live inference, runs until stop_live_stream
+	EventESPStopLiveStream   Event = "stop_live_stream"
+	EventESPStartCalibration Event = "start_calibration" // fixed duration, like raw_stream
+	EventESPStopCalibration  Event = "stop_calibration"
+	EventESPTimeSync         Event = "time_sync"
+	EventESPSetConfig        Event = "set_config"
 
 	// Esp to backend
-	HandShake            Event = "handshake"
-	EventRawStreamBegin  Event = "raw_stream_begin" // first packet
-	EventRawStreamInProc Event = "raw_stream_in_process"
-	EventRawStreamFinish Event = "raw_stream_finish"
+	HandShake              Event = "handshake"
+	EventRawStreamBegin    Event = "raw_stream_begin" // first packet
+	EventRawStreamInProc   Event = "raw_stream_in_process"
+	EventRawStreamFinish   Event = "raw_stream_finish"
+	EventLiveStreamData    Event = "live_stream_data"
+	EventCalibrationData   Event = "calibration_data"
+	EventCalibrationFinish Event = "calibration_finish"
+	EventTimeSyncReply     Event = "time_sync_reply"
+	EventConfigAck         Event = "config_ack"
 
 	// backend to frontend
-	EventTrainingStarted   Event = "training_started"
-	EventTrainingRawData   Event = "training_raw_data"
-	EventTrainingCompleted Event = "start_training_completed"
-	EventStreamingData     Event = "streaming_data"
+	EventTrainingStarted      Event = "training_started"
+	EventTrainingRawData      Event = "training_raw_data"
+	EventTrainingCompleted    Event = "start_training_completed"
+	EventStreamingData        Event = "streaming_data"
+	EventDeviceStatus         Event = "device_status"
+	EventSessionResumed       Event = "session_resumed"
+	EventSubscribed           Event = "subscribed"
+	EventUnsubscribed         Event = "unsubscribed"
+	EventControlAcquired      Event = "control_acquired"
+	EventControlChanged       Event = "control_changed"
+	EventConfigApplied        Event = "config_applied"
+	EventCalibrationCompleted Event = "calibration_completed"
 )
 
 type WsBackendToFrontend struct {
@@ -40,10 +65,18 @@ type WsBackendToFrontend struct {
 	MovementID int         `json:"movement_id,omitempty"`
 	Rep        int         `json:"rep,omitempty"`
 	Message    string      `json:"message"`
+	Status     string      `json:"status,omitempty"`
+	Mode       string      `json:"mode,omitempty"`
+	Controller string      `json:"controller,omitempty"`
+	InControl  bool        `json:"in_control,omitempty"`
 	Raw        []RawSample `json:"raw,omitempty"`
 	ClassID    int         `json:"class_id,omitempty"`
 	ClassName  string      `json:"class_name,omitempty"`
 	Prob       []float64   `json:"prob,omitempty"`
+
+	// training_raw_data, streaming_data: the latest window,
+	// start_training_completed: the whole repetition
+	Quality *quality.Metrics `json:"quality,omitempty"`
 }
 
 type RawSample struct {
@@ -56,6 +89,12 @@ type WsFrontendToBackend struct {
 	DeviceID   int   `json:"device_id"`
 	MovementID int   `json:"movement_id,omitempty"`
 	Rep        int   `json:"rep,omitempty"`
+
+	// start_training, start_streaming, start_calibration: whose arm it is,
+	// selects the calibration used for normalisation
+	Subject string `json:"subject,omitempty"`
+	// start_calibration: "rest" or "mvc"
+	Phase string `json:"phase,omitempty"`
 }
 
 type WsEspToBackend struct {
@@ -63,10 +102,56 @@ type WsEspToBackend struct {
 	DeviceName string `json:"device_name"`
 	Timestamp  string `json:"timestamp"`
 	Raw        []int  `json:"raw"`
+
+	// handshake: device token, enroll_token only on first registration
+	Token       string `json:"token,omitempty"`
+	EnrollToken string `json:"enroll_token,omitempty"`
+
+	// handshake: what the firmware reports about itself
+	FirmwareVersion string `json:"firmware_version,omitempty"`
+	ChannelCount    int    `json:"channel_count,omitempty"`
+	SampleRate      int    `json:"sample_rate,omitempty"`
+	ADCBits         int    `json:"adc_bits,omitempty"`
+
+	// time_sync_reply: t1 echoed back, t2 receive and t3 send time on the ESP clock (ns)
+	T1 int64 `json:"t1,omitempty"`
+	T2 int64 `json:"t2,omitempty"`
+	T3 int64 `json:"t3,omitempty"`
+
+	// config_ack: version applied, error set when the ESP refused it
+	ConfigVersion int    `json:"config_version,omitempty"`
+	Error         string `json:"error,omitempty"`
 }
 
 type WsBackendToEsp struct {
 	Event      Event `json:"event"`
 	Duration   int   `json:"duration"`
 	ServerTime int64 `json:"server_time"`
+	T1         int64 `json:"t1,omitempty"` // time_sync: server send time (ns)
+
+	// raw_stream: movement being recorded, start_calibration: rest or mvc.
+	// The firmware ignores both, the simulator shapes its signal by them.
+	MovementID int    `json:"movement_id,omitempty"`
+	Phase      string `json:"phase,omitempty"`
+
+	// set_config
+	ConfigVersion int           `json:"config_version,omitempty"`
+	Config        *DeviceConfig `json:"config,omitempty"`
+}
+
+type WifiPowerMode string
+
+const (
+	WifiPowerNone WifiPowerMode = "none" // radio always on, lowest latency
+	WifiPowerMin  WifiPowerMode = "min"
+	WifiPowerMax  WifiPowerMode = "max"
+)
+
+// DeviceConfig is what set_config pushes to the ESP.
+type DeviceConfig struct {
+	SampleRate     int           `json:"sample_rate"`     // Hz
+	Gain           int           `json:"gain"`            // PGA gain
+	PacketSize     int           `json:"packet_size"`     // samples per raw_stream_in_process
+	ActiveChannels []int         `json:"active_channels"` // zero based
+	WifiPowerMode  WifiPowerMode `json:"wifi_power_mode"`
 }
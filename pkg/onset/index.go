@@ -0,0 +1,180 @@
+package onset
+
+import (
+	"math"
+	"sort"
+
+	"emg_esp32_classifier_backend/pkg/utils"
+)
+
+type Method string
+
+const (
+	// MethodEnvelope thresholds the moving RMS of the signal.
+	MethodEnvelope Method = "envelope"
+	// MethodTKEO thresholds the smoothed Teager-Kaiser energy, sharper
+	// onsets on noisy signals.
+	MethodTKEO Method = "tkeo"
+)
+
+func (m Method) Valid() bool {
+	return m == MethodEnvelope || m == MethodTKEO
+}
+
+const (
+	// windowSeconds of smoothing, 50 ms
+	windowSeconds = 0.05
+	// assumed when the sample rate is unknown
+	defaultSampleRate = 1000
+
+	// thresholds between the noise floor and the peak of the envelope
+	highFraction = 0.15
+	lowFraction  = 0.08
+
+	// minimum durations, shorter bursts and gaps are ignored
+	minActiveSeconds = 0.1
+	minRestSeconds   = 0.15
+)
+
+// Segment is a run of muscle activity, samples [Start, End) of the
+// interleaved input. Both are frame boundaries.
+type Segment struct {
+	Start int
+	End   int
+}
+
+// Detect finds active segments in x with a double threshold: activity starts
+// when the envelope stays above the high threshold for minActive and ends when
+// it stays below the low one for minRest. x carries channels samples per frame
+// interleaved, the envelope pools the channels (root of the mean channel
+// power, each channel around its own mean). sampleRate is per channel. noise
+// is the rest level of the same envelope, <= 0 estimates it from the quietest
+// 10 % of x.
+func Detect(x []int, channels int, sampleRate float64, method Method, noise float64) []Segment {
+	if sampleRate <= 0 {
+		sampleRate = defaultSampleRate
+	}
+	if channels < 1 {
+		channels = 1
+	}
+
+	chs := utils.Deinterleave(x, channels)
+	frames := len(chs[0])
+
+	win := max(int(sampleRate*windowSeconds), 1)
+	if frames < 2*win {
+		return nil
+	}
+
+	env := envelope(chs, win, method)
+
+	if noise <= 0 {
+		noise = percentile(env, 0.1)
+	} else if method == MethodTKEO {
+		// the rest level is an RMS, TKEO energy scales with amplitude squared
+		noise = noise * noise
+	}
+	peak := percentile(env, 0.99)
+	if peak <= noise {
+		return nil
+	}
+
+	high := noise + highFraction*(peak-noise)
+	low := noise + lowFraction*(peak-noise)
+
+	minActive := max(int(minActiveSeconds*sampleRate), 1)
+	minRest := max(int(minRestSeconds*sampleRate), 1)
+
+	var segs []Segment
+	active := false
+	start, run := 0, 0
+
+	for i, v := range env {
+		if !active {
+			if v > high {
+				run++
+			} else {
+				run = 0
+			}
+			if run >= minActive {
+				active, start, run = true, i-run+1, 0
+			}
+			continue
+		}
+
+		if v < low {
+			run++
+		} else {
+			run = 0
+		}
+		if run >= minRest {
+			segs = append(segs, Segment{Start: start * channels, End: (i - run + 1) * channels})
+			active, run = false, 0
+		}
+	}
+
+	if active {
+		segs = append(segs, Segment{Start: start * channels, End: frames * channels})
+	}
+
+	return segs
+}
+
+// envelope returns per frame the moving average of the squared signal (RMS)
+// or of the Teager-Kaiser energy, centred on the frame and averaged over the
+// channels.
+func envelope(chs [][]int, win int, method Method) []float64 {
+	frames := len(chs[0])
+	e := make([]float64, frames)
+
+	for _, x := range chs {
+		mean := 0.0
+		for _, v := range x {
+			mean += float64(v)
+		}
+		mean /= float64(len(x))
+
+		for i := range x {
+			c := float64(x[i]) - mean
+			if method != MethodTKEO {
+				e[i] += c * c
+				continue
+			}
+			if i == 0 || i == len(x)-1 {
+				continue
+			}
+			p, n := float64(x[i-1])-mean, float64(x[i+1])-mean
+			e[i] += math.Abs(c*c - p*n)
+		}
+	}
+
+	for i := range e {
+		e[i] /= float64(len(chs))
+	}
+
+	// prefix sums keep the moving average O(n)
+	sum := make([]float64, len(e)+1)
+	for i, v := range e {
+		sum[i+1] = sum[i] + v
+	}
+
+	out := make([]float64, len(e))
+	half := win / 2
+	for i := range e {
+		lo, hi := max(i-half, 0), min(i+half+1, len(e))
+		avg := (sum[hi] - sum[lo]) / float64(hi-lo)
+		if method == MethodTKEO {
+			out[i] = avg
+		} else {
+			out[i] = math.Sqrt(avg)
+		}
+	}
+
+	return out
+}
+
+func percentile(x []float64, p float64) float64 {
+	s := append([]float64(nil), x...)
+	sort.Float64s(s)
+	return s[int(p*float64(len(s)-1))]
+}
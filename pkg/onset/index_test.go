@@ -0,0 +1,136 @@
+package onset
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+const testRate = 1000
+
+// signal is one channel at testRate: offset plus uniform noise of ±noise,
+// with an 80 Hz sine of amplitude amp inside every active range of frames.
+func signal(frames, offset, noise, amp int, seed int64, active ...Segment) []int {
+	rng := rand.New(rand.NewSource(seed))
+	x := make([]int, frames)
+	for i := range x {
+		v := float64(offset) + float64(rng.Intn(2*noise+1)-noise)
+		for _, a := range active {
+			if i >= a.Start && i < a.End {
+				v += float64(amp) * math.Sin(2*math.Pi*80*float64(i)/testRate)
+			}
+		}
+		x[i] = int(v)
+	}
+	return x
+}
+
+func interleave(chs ...[]int) []int {
+	out := make([]int, 0, len(chs)*len(chs[0]))
+	for f := range chs[0] {
+		for _, ch := range chs {
+			out = append(out, ch[f])
+		}
+	}
+	return out
+}
+
+func TestDetect(t *testing.T) {
+	// the envelope smears edges by half a window, the thresholds by a bit more
+	const tolerance = 60
+
+	for _, method := range []Method{MethodEnvelope, MethodTKEO} {
+		tests := []struct {
+			name     string
+			x        []int
+			channels int
+			noise    float64
+			want     []Segment // in frames
+		}{
+			{
+				name:     "one burst",
+				x:        signal(5000, 2000, 5, 500, 1, Segment{1500, 3500}),
+				channels: 1,
+				want:     []Segment{{1500, 3500}},
+			},
+			{
+				name:     "one burst, calibrated noise",
+				x:        signal(5000, 2000, 5, 500, 2, Segment{1500, 3500}),
+				channels: 1,
+				noise:    3, // RMS of uniform ±5
+				want:     []Segment{{1500, 3500}},
+			},
+			{
+				name:     "open end",
+				x:        signal(5000, 2000, 5, 500, 3, Segment{4000, 5000}),
+				channels: 1,
+				want:     []Segment{{4000, 5000}},
+			},
+			{
+				name:     "two bursts",
+				x:        signal(5000, 2000, 5, 500, 4, Segment{1000, 2000}, Segment{3000, 4200}),
+				channels: 1,
+				want:     []Segment{{1000, 2000}, {3000, 4200}},
+			},
+			{
+				name: "channels with different offsets",
+				x: interleave(
+					signal(5000, 500, 5, 400, 5, Segment{2000, 4000}),
+					signal(5000, 3000, 5, 400, 6, Segment{2000, 4000}),
+					signal(5000, 1800, 5, 0, 7),
+				),
+				channels: 3,
+				want:     []Segment{{2000, 4000}},
+			},
+			{
+				name:     "burst shorter than the minimum",
+				x:        signal(5000, 2000, 5, 500, 8, Segment{2000, 2050}),
+				channels: 1,
+			},
+			{
+				name:     "flat",
+				x:        signal(5000, 2000, 0, 0, 9),
+				channels: 1,
+			},
+			{
+				name:     "noise above the peak",
+				x:        signal(5000, 2000, 5, 500, 10, Segment{1500, 3500}),
+				channels: 1,
+				noise:    2000, // rest level with the DC offset left in
+			},
+			{
+				name:     "shorter than two windows",
+				x:        signal(90, 2000, 5, 500, 11, Segment{0, 90}),
+				channels: 1,
+			},
+		}
+
+		for _, tt := range tests {
+			t.Run(string(method)+"/"+tt.name, func(t *testing.T) {
+				got := Detect(tt.x, tt.channels, testRate, method, tt.noise)
+				if len(got) != len(tt.want) {
+					t.Fatalf("got %d segments %v, want %v", len(got), got, tt.want)
+				}
+
+				for i, g := range got {
+					if g.Start%tt.channels != 0 || g.End%tt.channels != 0 {
+						t.Errorf("segment %d %v not on a frame boundary", i, g)
+					}
+
+					w := tt.want[i]
+					start, end := g.Start/tt.channels, g.End/tt.channels
+					if abs(start-w.Start) > tolerance || abs(end-w.End) > tolerance {
+						t.Errorf("segment %d frames [%d, %d), want [%d, %d) ±%d", i, start, end, w.Start, w.End, tolerance)
+					}
+				}
+			})
+		}
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
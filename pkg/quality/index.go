@@ -0,0 +1,218 @@
+package quality
+
+import (
+	"math"
+
+	"emg_esp32_classifier_backend/pkg/utils"
+)
+
+// Limits are the lowest and highest sample a device can deliver, samples at
+// either of them are saturated.
+type Limits struct {
+	Low, High int
+}
+
+// StorageLimits are the int16 limits IntSliceToBytea clamps to, used for
+// devices that did not report their ADC resolution.
+var StorageLimits = Limits{Low: -32768, High: 32767}
+
+// ADCLimits are the limits of a unipolar ADC with bits of resolution,
+// StorageLimits when bits is unknown or does not fit into int16.
+func ADCLimits(bits int) Limits {
+	if bits < 1 || bits > 15 {
+		return StorageLimits
+	}
+	return Limits{Low: 0, High: 1<<bits - 1}
+}
+
+const (
+	// flatlineRange: a window whose samples span less than this is a lost
+	// electrode or a dead channel
+	flatlineRange = 3
+	// mainsWarn is the share of power at 50/60 Hz above which a window is
+	// considered mains dominated
+	mainsWarn = 0.3
+	// FlagBelow marks a repetition for re-recording
+	FlagBelow = 0.5
+)
+
+// Metrics describes one window of samples, or a whole repetition.
+type Metrics struct {
+	Samples       int     `json:"samples"`
+	ClippingRatio float64 `json:"clipping_ratio"`
+	Flatline      bool    `json:"flatline"`
+	FlatlineRatio float64 `json:"flatline_ratio,omitempty"` // repetitions only: share of flat windows
+	MainsHz       int     `json:"mains_hz,omitempty"`       // 50 or 60, whichever is stronger
+	MainsRatio    float64 `json:"mains_ratio"`
+	SNRdB         float64 `json:"snr_db,omitempty"` // against the rest level, 0 without calibration
+	Score         float64 `json:"score"`            // 0 bad .. 1 good
+	Flagged       bool    `json:"flagged"`
+}
+
+// Assess computes the metrics of x, which carries channels samples per frame
+// interleaved (see utils.Deinterleave). Every channel is assessed on its own:
+// clipping is counted over all of them, one flat channel makes the window
+// flat, mains is the worst channel and the SNR the mean over the channels,
+// each against its own level in rest. sampleRate is per channel, <= 0 skips
+// the mains check; rest without a level per channel skips the SNR. Samples at
+// limits count as clipped.
+func Assess(x []int, channels int, sampleRate float64, rest []float64, limits Limits) Metrics {
+	m := Metrics{Samples: len(x)}
+	if len(x) == 0 {
+		return m
+	}
+
+	clipped := 0
+	for _, v := range x {
+		if v >= limits.High || v <= limits.Low {
+			clipped++
+		}
+	}
+	m.ClippingRatio = float64(clipped) / float64(len(x))
+
+	snrSum, snrN := 0.0, 0
+	for i, ch := range utils.Deinterleave(x, channels) {
+		if len(ch) == 0 {
+			continue
+		}
+
+		restRMS := 0.0
+		if len(rest) == channels {
+			restRMS = rest[i]
+		}
+
+		c := assessChannel(ch, sampleRate, restRMS)
+		m.Flatline = m.Flatline || c.Flatline
+		if c.MainsRatio > m.MainsRatio {
+			m.MainsRatio, m.MainsHz = c.MainsRatio, c.MainsHz
+		}
+		if c.SNRdB != 0 {
+			snrSum += c.SNRdB
+			snrN++
+		}
+	}
+	if snrN > 0 {
+		m.SNRdB = snrSum / float64(snrN)
+	}
+
+	m.score()
+	return m
+}
+
+// assessChannel fills the flatline, mains and SNR fields for the samples of
+// a single channel.
+func assessChannel(x []int, sampleRate, restRMS float64) Metrics {
+	var m Metrics
+
+	lo, hi := x[0], x[0]
+	mean := 0.0
+	for _, v := range x {
+		lo, hi = min(lo, v), max(hi, v)
+		mean += float64(v)
+	}
+	mean /= float64(len(x))
+
+	m.Flatline = hi-lo < flatlineRange
+
+	acPower := 0.0
+	for _, v := range x {
+		d := float64(v) - mean
+		acPower += d * d
+	}
+
+	if sampleRate > 0 && acPower > 0 && float64(len(x)) >= 2*sampleRate/50 {
+		for _, hz := range []int{50, 60} {
+			r := 2 * goertzel(x, mean, float64(hz), sampleRate) / float64(len(x)) / acPower
+			if r > m.MainsRatio {
+				m.MainsRatio, m.MainsHz = math.Min(r, 1), hz
+			}
+		}
+	}
+
+	if rms := math.Sqrt(acPower / float64(len(x))); restRMS > 0 && rms > 0 {
+		m.SNRdB = 20 * math.Log10(rms/restRMS)
+	}
+
+	return m
+}
+
+func (m *Metrics) score() {
+	s := 1 - math.Min(m.ClippingRatio*10, 1) // 10 % clipped samples is unusable
+	if m.MainsRatio > mainsWarn {
+		s *= 1 - m.MainsRatio
+	}
+	s *= 1 - m.FlatlineRatio
+	if m.Flatline {
+		s = 0
+	}
+
+	m.Score = s
+	m.Flagged = s < FlagBelow
+}
+
+// goertzel returns |X(f)|² of x with the mean removed.
+func goertzel(x []int, mean, f, sampleRate float64) float64 {
+	w := 2 * math.Pi * f / sampleRate
+	coeff := 2 * math.Cos(w)
+
+	var s1, s2 float64
+	for _, v := range x {
+		s0 := float64(v) - mean + coeff*s1 - s2
+		s2, s1 = s1, s0
+	}
+
+	return s1*s1 + s2*s2 - coeff*s1*s2
+}
+
+// Accumulator sums window metrics into the metrics of a repetition. Windows
+// overlap, so each is weighted by the n new samples it was computed for.
+type Accumulator struct {
+	samples, clipped float64
+	windows, flat    int
+	mainsSum, snrSum float64
+	mainsHz          int
+	snrN             float64
+}
+
+func (a *Accumulator) Add(m Metrics, newSamples int) {
+	n := float64(newSamples)
+	if n == 0 || m.Samples == 0 {
+		return
+	}
+
+	a.samples += n
+	a.clipped += m.ClippingRatio * n
+	a.windows++
+	if m.Flatline {
+		a.flat++
+	}
+
+	a.mainsSum += m.MainsRatio * n
+	if m.MainsHz != 0 {
+		a.mainsHz = m.MainsHz
+	}
+
+	if m.SNRdB != 0 {
+		a.snrSum += m.SNRdB * n
+		a.snrN += n
+	}
+}
+
+func (a *Accumulator) Result() Metrics {
+	m := Metrics{Samples: int(a.samples)}
+	if a.samples == 0 {
+		return m
+	}
+
+	m.ClippingRatio = a.clipped / a.samples
+	m.FlatlineRatio = float64(a.flat) / float64(a.windows)
+	m.Flatline = a.flat == a.windows
+	m.MainsRatio = a.mainsSum / a.samples
+	m.MainsHz = a.mainsHz
+	if a.snrN > 0 {
+		m.SNRdB = a.snrSum / a.snrN
+	}
+
+	m.score()
+	return m
+}
@@ -0,0 +1,276 @@
+package quality
+
+import (
+	"math"
+	"testing"
+)
+
+const testRate = 1000
+
+// sine is frames samples at testRate: offset plus a sine of amp at hz. A
+// second of it holds whole periods of 50, 60 and 80 Hz, so nothing leaks
+// between them.
+func sine(frames, offset int, amp, hz float64) []int {
+	x := make([]int, frames)
+	for i := range x {
+		x[i] = offset + int(math.Round(amp*math.Sin(2*math.Pi*hz*float64(i)/testRate)))
+	}
+	return x
+}
+
+// spikes sets every nth sample of x to v, starting at first.
+func spikes(x []int, first, n, v int) []int {
+	out := append([]int(nil), x...)
+	for i := first; i < len(out); i += n {
+		out[i] = v
+	}
+	return out
+}
+
+func interleave(chs ...[]int) []int {
+	out := make([]int, 0, len(chs)*len(chs[0]))
+	for f := range chs[0] {
+		for _, ch := range chs {
+			out = append(out, ch[f])
+		}
+	}
+	return out
+}
+
+func TestGoertzel(t *testing.T) {
+	tests := []struct {
+		name  string
+		hz    float64
+		probe float64
+		want  float64 // share of the AC power at probe
+	}{
+		{name: "50 Hz hum at 50", hz: 50, probe: 50, want: 1},
+		{name: "60 Hz hum at 60", hz: 60, probe: 60, want: 1},
+		{name: "50 Hz hum at 60", hz: 50, probe: 60, want: 0},
+		{name: "80 Hz sine at 50", hz: 80, probe: 50, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x := sine(testRate, 2048, 1000, tt.hz)
+
+			mean, power := 0.0, 0.0
+			for _, v := range x {
+				mean += float64(v)
+			}
+			mean /= float64(len(x))
+			for _, v := range x {
+				power += (float64(v) - mean) * (float64(v) - mean)
+			}
+
+			got := 2 * goertzel(x, mean, tt.probe, testRate) / float64(len(x)) / power
+			if math.Abs(got-tt.want) > 0.01 {
+				t.Errorf("share at %v Hz = %.4f, want %v", tt.probe, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssess(t *testing.T) {
+	adc12 := ADCLimits(12)
+
+	tests := []struct {
+		name     string
+		x        []int
+		channels int
+		rate     float64
+		rest     []float64
+		limits   Limits
+
+		clipping float64
+		flatline bool
+		mainsHz  int     // checked when mains > 0
+		mains    float64 // ±0.02
+		snr      float64 // ±0.1 dB
+		flagged  bool
+	}{
+		{
+			name:     "clean 80 Hz, 12 bit",
+			x:        sine(testRate, 2048, 500, 80),
+			channels: 1,
+			rate:     testRate,
+			limits:   adc12,
+		},
+		{
+			name:     "50 Hz hum",
+			x:        sine(testRate, 2048, 500, 50),
+			channels: 1,
+			rate:     testRate,
+			limits:   adc12,
+			mainsHz:  50,
+			mains:    1,
+			flagged:  true,
+		},
+		{
+			name:     "60 Hz hum",
+			x:        sine(testRate, 2048, 500, 60),
+			channels: 1,
+			rate:     testRate,
+			limits:   adc12,
+			mainsHz:  60,
+			mains:    1,
+			flagged:  true,
+		},
+		{
+			name:     "hum without sample rate",
+			x:        sine(testRate, 2048, 500, 50),
+			channels: 1,
+			limits:   adc12,
+		},
+		{
+			name:     "hum on one of two channels",
+			x:        interleave(sine(testRate, 2048, 500, 80), sine(testRate, 2048, 500, 60)),
+			channels: 2,
+			rate:     testRate,
+			limits:   adc12,
+			mainsHz:  60,
+			mains:    1,
+			flagged:  true,
+		},
+		{
+			name:     "flat",
+			x:        sine(testRate, 2048, 0, 80),
+			channels: 1,
+			rate:     testRate,
+			limits:   adc12,
+			flatline: true,
+			flagged:  true,
+		},
+		{
+			name:     "one of two channels flat",
+			x:        interleave(sine(testRate, 2048, 500, 80), sine(testRate, 1900, 1, 80)),
+			channels: 2,
+			rate:     testRate,
+			limits:   adc12,
+			flatline: true,
+			flagged:  true,
+		},
+		{
+			name:     "12 bit saturated",
+			x:        spikes(spikes(sine(testRate, 2048, 500, 80), 0, 10, 4095), 5, 10, 0),
+			channels: 1,
+			rate:     testRate,
+			limits:   adc12,
+			clipping: 0.2,
+			flagged:  true,
+		},
+		{
+			name:     "12 bit range against the int16 limits",
+			x:        spikes(spikes(sine(testRate, 2048, 500, 80), 0, 10, 4095), 5, 10, 0),
+			channels: 1,
+			rate:     testRate,
+			limits:   StorageLimits,
+		},
+		{
+			name:     "int16 saturated",
+			x:        spikes(spikes(sine(testRate, 0, 5000, 80), 0, 10, 32767), 5, 10, -32768),
+			channels: 1,
+			rate:     testRate,
+			limits:   StorageLimits,
+			clipping: 0.2,
+			flagged:  true,
+		},
+		{
+			name:     "snr against rest",
+			x:        sine(testRate, 2048, 1000, 80),
+			channels: 1,
+			rate:     testRate,
+			rest:     []float64{1000 / math.Sqrt2 / 10},
+			limits:   adc12,
+			snr:      20,
+		},
+		{
+			name:     "snr per channel",
+			x:        interleave(sine(testRate, 2048, 1000, 80), sine(testRate, 2048, 100, 80)),
+			channels: 2,
+			rate:     testRate,
+			rest:     []float64{1000 / math.Sqrt2 / 10, 100 / math.Sqrt2 / 100},
+			limits:   adc12,
+			snr:      30, // 20 and 40 dB
+		},
+		{
+			name:     "snr without a level per channel",
+			x:        interleave(sine(testRate, 2048, 1000, 80), sine(testRate, 2048, 100, 80)),
+			channels: 2,
+			rate:     testRate,
+			rest:     []float64{70},
+			limits:   adc12,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Assess(tt.x, tt.channels, tt.rate, tt.rest, tt.limits)
+
+			if m.Samples != len(tt.x) {
+				t.Errorf("samples = %d, want %d", m.Samples, len(tt.x))
+			}
+			if math.Abs(m.ClippingRatio-tt.clipping) > 1e-9 {
+				t.Errorf("clipping = %v, want %v", m.ClippingRatio, tt.clipping)
+			}
+			if m.Flatline != tt.flatline {
+				t.Errorf("flatline = %v, want %v", m.Flatline, tt.flatline)
+			}
+			if tt.mains > 0 && m.MainsHz != tt.mainsHz {
+				t.Errorf("mains hz = %d, want %d", m.MainsHz, tt.mainsHz)
+			}
+			if math.Abs(m.MainsRatio-tt.mains) > 0.02 {
+				t.Errorf("mains ratio = %.4f, want %v", m.MainsRatio, tt.mains)
+			}
+			if math.Abs(m.SNRdB-tt.snr) > 0.1 {
+				t.Errorf("snr = %.2f dB, want %v", m.SNRdB, tt.snr)
+			}
+			if m.Flagged != tt.flagged {
+				t.Errorf("flagged = %v (score %.2f), want %v", m.Flagged, m.Score, tt.flagged)
+			}
+		})
+	}
+}
+
+func TestADCLimits(t *testing.T) {
+	tests := []struct {
+		bits int
+		want Limits
+	}{
+		{bits: 12, want: Limits{Low: 0, High: 4095}},
+		{bits: 15, want: Limits{Low: 0, High: 32767}},
+		{bits: 0, want: StorageLimits},
+		{bits: 16, want: StorageLimits},
+		{bits: -1, want: StorageLimits},
+	}
+
+	for _, tt := range tests {
+		if got := ADCLimits(tt.bits); got != tt.want {
+			t.Errorf("ADCLimits(%d) = %+v, want %+v", tt.bits, got, tt.want)
+		}
+	}
+}
+
+func TestAccumulator(t *testing.T) {
+	var a Accumulator
+	clean := Assess(sine(testRate, 2048, 500, 80), 1, testRate, nil, ADCLimits(12))
+	flat := Assess(sine(testRate, 2048, 0, 80), 1, testRate, nil, ADCLimits(12))
+
+	a.Add(clean, 300)
+	a.Add(clean, 300)
+	a.Add(flat, 400)
+
+	m := a.Result()
+	if m.Samples != 1000 {
+		t.Errorf("samples = %d, want 1000", m.Samples)
+	}
+	if math.Abs(m.FlatlineRatio-1.0/3) > 1e-9 {
+		t.Errorf("flatline ratio = %v, want 1/3", m.FlatlineRatio)
+	}
+	if m.Flatline {
+		t.Error("repetition flat with two of three windows clean")
+	}
+	if math.Abs(m.Score-2.0/3) > 1e-9 || m.Flagged {
+		t.Errorf("score = %v flagged %v, want 2/3 not flagged", m.Score, m.Flagged)
+	}
+}
@@ -1,33 +1,94 @@
 package sessions
 
 import (
+	"context"
+	"log/slog"
 	"sync"
+	"time"
 )
 
 type device_id int
 
 type Session struct {
-	TrainingID int
-	Rep        int
-	MovementID int
-	DeviceID   int
+	TrainingID int    `json:"training_id"`
+	Rep        int    `json:"rep"`
+	MovementID int    `json:"movement_id"`
+	DeviceID   int    `json:"device_id"`
+	Subject    string `json:"subject"`
+
+	// Recording is true between raw_stream_begin and raw_stream_finish.
+	Recording    bool      `json:"recording"`
+	RepStartedAt time.Time `json:"rep_started_at"`
+	Duration     int       `json:"duration"` // seconds, as sent to the ESP
+
+	// InterruptedAt is set when the ESP socket drops during the session.
+	InterruptedAt time.Time `json:"interrupted_at"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Store persists sessions so that a backend restart does not lose trainings.
+type Store interface {
+	SaveSession(ctx context.Context, sess *Session) error
+	DeleteSession(ctx context.Context, deviceID int) error
+	LoadSessions(ctx context.Context) ([]*Session, error)
 }
 
+// ResumePolicy says what happens to a repetition that was cut by an ESP
+// reconnect.
+type ResumePolicy string
+
+const (
+	// ResumeDiscard deletes the samples of the cut repetition, the frontend
+	// has to start the same rep again.
+	ResumeDiscard ResumePolicy = "discard"
+	// ResumeContinue keeps the samples and asks the ESP to record the rest
+	// of the repetition.
+	ResumeContinue ResumePolicy = "continue"
+)
+
 type SessionManager struct {
-	mu sync.RWMutex
-	s  map[device_id]*Session
+	mu    sync.RWMutex
+	s     map[device_id]*Session
+	store Store
 }
 
-func NewSessionManager() *SessionManager {
+// NewSessionManager keeps sessions in memory only when store is nil,
+// otherwise every change is written through to the store.
+func NewSessionManager(store Store) *SessionManager {
 	return &SessionManager{
-		s: make(map[device_id]*Session),
+		s:     make(map[device_id]*Session),
+		store: store,
 	}
 }
 
+// Load replaces the in-memory sessions with the stored ones.
+func (m *SessionManager) Load(ctx context.Context) error {
+	if m.store == nil {
+		return nil
+	}
+
+	list, err := m.store.LoadSessions(ctx)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.s = make(map[device_id]*Session, len(list))
+	for _, sess := range list {
+		m.s[device_id(sess.DeviceID)] = sess
+	}
+
+	return nil
+}
+
 func (m *SessionManager) Set(id int, sess *Session) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.s[device_id(id)] = sess
+	m.save(sess)
 }
 
 func (m *SessionManager) Get(id int) (*Session, bool) {
@@ -47,12 +108,34 @@ func (m *SessionManager) Update(id int, fn func(s *Session)) {
 	}
 
 	fn(sess)
+	m.save(sess)
 }
 
 func (m *SessionManager) Delete(id int) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	delete(m.s, device_id(id))
+
+	if m.store == nil {
+		return
+	}
+	if err := m.store.DeleteSession(context.Background(), id); err != nil {
+		slog.Error("delete session", "device_id", id, "err", err)
+	}
+}
+
+// save runs under m.mu so writes for one device reach the store in order.
+// A failed write only costs the ability to resume after a restart, so it is
+// logged and not returned.
+func (m *SessionManager) save(sess *Session) {
+	sess.UpdatedAt = time.Now()
+
+	if m.store == nil {
+		return
+	}
+	if err := m.store.SaveSession(context.Background(), sess); err != nil {
+		slog.Error("save session", "device_id", sess.DeviceID, "training_id", sess.TrainingID, "err", err)
+	}
 }
 
 func (m *SessionManager) List() []*Session {
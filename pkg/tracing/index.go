@@ -0,0 +1,133 @@
+// Package tracing sets up OpenTelemetry for the backend: the SDK tracer
+// provider with a stdout or OTLP/HTTP exporter, head sampling and W3C
+// traceparent propagation on incoming and outgoing HTTP requests.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// scope is the instrumentation name every span of the backend is recorded
+// under.
+const scope = "emg_esp32_classifier_backend"
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. kind is "stdout", "otlp" (endpoint is the collector base URL,
+// e.g. http://otel-collector:4318) or "" / "none" to record nothing; a
+// traceparent that comes in is still passed on then. The returned function
+// exports what is queued and stops the provider, it is safe to call more
+// than once.
+func Setup(kind, endpoint, serviceName string, ratio float64) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var exp sdktrace.SpanExporter
+	var err error
+	switch kind {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		exp, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "otlp":
+		if endpoint == "" {
+			return nil, fmt.Errorf("tracing: otlp needs an endpoint")
+		}
+		exp, err = otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpointURL(strings.TrimSuffix(endpoint, "/")+"/v1/traces"))
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", kind)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	// the sdk reports failed exports here instead of to the traced code
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		exportErrors.Inc()
+		slog.Warn("tracing", "err", err)
+	}))
+
+	tp := newProvider(sdktrace.WithBatcher(exp), serviceName, ratio)
+	otel.SetTracerProvider(tp)
+
+	return tp.Shutdown, nil
+}
+
+// newProvider samples ratio of new traces, a trace that comes in with a
+// traceparent keeps the decision of the caller.
+func newProvider(processor sdktrace.TracerProviderOption, serviceName string, ratio float64) *sdktrace.TracerProvider {
+	res, _ := resource.Merge(resource.Default(),
+		resource.NewSchemaless(attribute.String("service.name", serviceName)))
+
+	return sdktrace.NewTracerProvider(
+		processor,
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(math.Max(0, math.Min(1, ratio))))),
+	)
+}
+
+// Start begins a span under the one in ctx, or a new trace when there is
+// none. The returned context carries the new span.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(scope).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// SetError marks the span failed, a nil err is ignored.
+func SetError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// EndErr is SetError followed by End.
+func EndErr(span trace.Span, err error) {
+	SetError(span, err)
+	span.End()
+}
+
+// Handler traces every request and continues the trace of its traceparent
+// header. Requests to the skipped paths, probes and WebSockets that would
+// be one span for the whole connection, are passed through untraced.
+func Handler(next http.Handler, skip ...string) http.Handler {
+	return otelhttp.NewHandler(next, "http",
+		otelhttp.WithFilter(func(r *http.Request) bool {
+			return !slices.Contains(skip, r.URL.Path)
+		}),
+		// the route the mux picked, paths carry ids; the span is renamed once
+		// the mux has set it
+		otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+			if r.Pattern == "" {
+				return r.Method
+			}
+			return r.Method + " " + r.Pattern
+		}),
+	)
+}
+
+// Transport traces outgoing requests and sends the traceparent of the span in
+// their context. A nil base is http.DefaultTransport.
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return otelhttp.NewTransport(base)
+}
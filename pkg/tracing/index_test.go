@@ -0,0 +1,191 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestSetup(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	tests := []struct {
+		kind, endpoint string
+		wantErr        bool
+	}{
+		{kind: ""},
+		{kind: "none"},
+		{kind: "stdout"},
+		{kind: "otlp", endpoint: "http://127.0.0.1:1"},
+		{kind: "otlp", wantErr: true},
+		{kind: "jaeger", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			shutdown, err := Setup(tt.kind, tt.endpoint, "test", 1)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// nothing was recorded, so nothing waits for the unreachable
+			// collector; a second call must not block or fail either
+			for range 2 {
+				if err := shutdown(context.Background()); err != nil {
+					t.Fatalf("shutdown: %v", err)
+				}
+			}
+		})
+	}
+}
+
+const (
+	incomingTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+	incomingSpan  = "00f067aa0ba902b7"
+)
+
+func TestPropagation(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	prev := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	tests := []struct {
+		name        string
+		traceparent string
+		ratio       float64
+		recorded    bool
+		sameTrace   bool // the ML call continues the incoming trace
+	}{
+		{
+			name:        "sampled caller wins over the ratio",
+			traceparent: "00-" + incomingTrace + "-" + incomingSpan + "-01",
+			ratio:       0,
+			recorded:    true,
+			sameTrace:   true,
+		},
+		{
+			name:        "unsampled caller wins over the ratio",
+			traceparent: "00-" + incomingTrace + "-" + incomingSpan + "-00",
+			ratio:       1,
+			sameTrace:   true,
+		},
+		{name: "new trace, sampled", ratio: 1, recorded: true},
+		{name: "new trace, not sampled", ratio: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := tracetest.NewSpanRecorder()
+			otel.SetTracerProvider(newProvider(sdktrace.WithSpanProcessor(rec), "test", tt.ratio))
+
+			var outgoing string
+			ml := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				outgoing = r.Header.Get("traceparent")
+			}))
+			defer ml.Close()
+
+			client := &http.Client{Transport: Transport(nil)}
+			mux := http.NewServeMux()
+			mux.HandleFunc("/predict", func(w http.ResponseWriter, r *http.Request) {
+				ctx, span := Start(r.Context(), "work")
+				defer span.End()
+
+				req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ml.URL, nil)
+				resp, err := client.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+			})
+
+			srv := httptest.NewServer(Handler(mux, "/livez"))
+			defer srv.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/predict", nil)
+			if tt.traceparent != "" {
+				req.Header.Set("traceparent", tt.traceparent)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			parts := strings.Split(outgoing, "-")
+			if len(parts) != 4 {
+				t.Fatalf("outgoing traceparent %q", outgoing)
+			}
+			if got := parts[1] == incomingTrace; got != tt.sameTrace {
+				t.Errorf("outgoing trace %s, continues %s: %v, want %v", parts[1], incomingTrace, got, tt.sameTrace)
+			}
+			if wantFlags := map[bool]string{true: "01", false: "00"}[tt.recorded]; parts[3] != wantFlags {
+				t.Errorf("outgoing flags %s, want %s", parts[3], wantFlags)
+			}
+
+			spans := rec.Ended()
+			if !tt.recorded {
+				if len(spans) != 0 {
+					t.Errorf("recorded %d spans, want none", len(spans))
+				}
+				return
+			}
+
+			// work, the ML call and the request, one trace
+			if len(spans) != 3 {
+				t.Fatalf("recorded %d spans, want 3", len(spans))
+			}
+			for _, s := range spans {
+				if s.SpanContext().TraceID().String() != parts[1] {
+					t.Errorf("span %q in trace %s, want %s", s.Name(), s.SpanContext().TraceID(), parts[1])
+				}
+			}
+
+			server := spans[2]
+			if server.SpanKind() != trace.SpanKindServer || server.Name() != "GET /predict" {
+				t.Fatalf("last span %q kind %v, want the server span GET /predict", server.Name(), server.SpanKind())
+			}
+			if tt.traceparent != "" && server.Parent().SpanID().String() != incomingSpan {
+				t.Errorf("server span parent %s, want %s", server.Parent().SpanID(), incomingSpan)
+			}
+		})
+	}
+}
+
+func TestHandlerSkip(t *testing.T) {
+	prev := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(newProvider(sdktrace.WithSpanProcessor(rec), "test", 1))
+
+	h := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "/livez")
+
+	for _, path := range []string{"/livez", "/devices"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	spans := rec.Ended()
+	if len(spans) != 1 || spans[0].Name() != "GET" {
+		names := make([]string, len(spans))
+		for i, s := range spans {
+			names[i] = s.Name()
+		}
+		t.Errorf("spans %v, want only the unrouted GET /devices", names)
+	}
+}
@@ -0,0 +1,12 @@
+package tracing
+
+import (
+	"emg_esp32_classifier_backend/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var exportErrors = metrics.Factory.NewCounter(prometheus.CounterOpts{
+	Name: "emg_trace_export_errors_total",
+	Help: "Errors reported by the tracing sdk, mostly failed span exports.",
+})
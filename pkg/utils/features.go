@@ -6,7 +6,12 @@ import (
 	"gonum.org/v1/gonum/dsp/fourier"
 )
 
-func MAV(x []int) float64 {
+// Sample is a raw ADC value, or one centred and scaled by NormalizedFeatures.
+type Sample interface {
+	~int | ~float64
+}
+
+func MAV[T Sample](x []T) float64 {
 	sum := 0.0
 	for _, v := range x {
 		sum += math.Abs(float64(v))
@@ -14,7 +19,7 @@ func MAV(x []int) float64 {
 	return sum / float64(len(x))
 }
 
-func RMS(x []int) float64 {
+func RMS[T Sample](x []T) float64 {
 	sum := 0.0
 	for _, v := range x {
 		f := float64(v)
@@ -23,7 +28,7 @@ func RMS(x []int) float64 {
 	return math.Sqrt(sum / float64(len(x)))
 }
 
-func WL(x []int) float64 {
+func WL[T Sample](x []T) float64 {
 	sum := 0.0
 	for i := 1; i < len(x); i++ {
 		sum += math.Abs(float64(x[i] - x[i-1]))
@@ -31,7 +36,7 @@ func WL(x []int) float64 {
 	return sum
 }
 
-func VAR(x []int) float64 {
+func VAR[T Sample](x []T) float64 {
 	mean := 0.0
 	for _, v := range x {
 		mean += float64(v)
@@ -46,7 +51,7 @@ func VAR(x []int) float64 {
 	return variance / float64(len(x))
 }
 
-func ZeroCross(x []int) float64 {
+func ZeroCross[T Sample](x []T) float64 {
 	count := 0.0
 	for i := 1; i < len(x); i++ {
 		if float64(x[i])*float64(x[i-1]) < 0 {
@@ -56,7 +61,7 @@ func ZeroCross(x []int) float64 {
 	return count
 }
 
-func SSC(x []int) float64 {
+func SSC[T Sample](x []T) float64 {
 	count := 0.0
 	for i := 1; i < len(x)-1; i++ {
 		a := float64(x[i-1])
@@ -69,7 +74,7 @@ func SSC(x []int) float64 {
 	return count
 }
 
-func Max(x []int) float64 {
+func Max[T Sample](x []T) float64 {
 	m := x[0]
 	for _, v := range x {
 		if v > m {
@@ -79,7 +84,7 @@ func Max(x []int) float64 {
 	return float64(m)
 }
 
-func Min(x []int) float64 {
+func Min[T Sample](x []T) float64 {
 	m := x[0]
 	for _, v := range x {
 		if v < m {
@@ -89,7 +94,7 @@ func Min(x []int) float64 {
 	return float64(m)
 }
 
-func IEMG(x []int) float64 {
+func IEMG[T Sample](x []T) float64 {
 	sum := 0.0
 	for _, v := range x {
 		sum += math.Abs(float64(v))
@@ -97,7 +102,7 @@ func IEMG(x []int) float64 {
 	return sum
 }
 
-func KF(x []int) float64 {
+func KF[T Sample](x []T) float64 {
 	sumSq := 0.0
 	for _, v := range x {
 		f := float64(v)
@@ -106,9 +111,9 @@ func KF(x []int) float64 {
 	return math.Sqrt(sumSq) / float64(len(x))
 }
 
-func MeanFreq(x []int) float64 {
+func MeanFreq[T Sample](x []T) float64 {
 	N := len(x)
-	rfft := fourier.NewFFT(N).Coefficients(nil, intsToFloat64(x))
+	rfft := fourier.NewFFT(N).Coefficients(nil, toFloat64(x))
 	mags := make([]float64, N/2+1)
 
 	sum := 0.0
@@ -119,9 +124,9 @@ func MeanFreq(x []int) float64 {
 	return sum / float64(len(mags))
 }
 
-func PeakFreq(x []int) float64 {
+func PeakFreq[T Sample](x []T) float64 {
 	N := len(x)
-	rfft := fourier.NewFFT(N).Coefficients(nil, intsToFloat64(x))
+	rfft := fourier.NewFFT(N).Coefficients(nil, toFloat64(x))
 	maxIdx := 0
 	maxVal := 0.0
 
@@ -137,7 +142,7 @@ func PeakFreq(x []int) float64 {
 
 // utils
 
-func intsToFloat64(x []int) []float64 {
+func toFloat64[T Sample](x []T) []float64 {
 	out := make([]float64, len(x))
 	for i, v := range x {
 		out[i] = float64(v)
@@ -149,7 +154,49 @@ func cmplxAbs(c complex128) float64 {
 	return math.Sqrt(real(c)*real(c) + imag(c)*imag(c))
 }
 
-func ExtractFeatures(raw []int) []float64 {
+// NormalizedFeatures is ExtractFeatures for a calibrated subject. raw carries
+// len(mvc) channels interleaved, every channel is taken around its own mean
+// (the ADC is unipolar) and in fractions of its own MVC level, so a weak
+// channel is not scaled by a strong one. The rest noise, rest[ch] per channel,
+// is removed from RMS and VAR in quadrature. rest and mvc are the levels of a
+// calibration, taken the same way.
+func NormalizedFeatures(raw []int, rest, mvc []float64) []float64 {
+	if len(mvc) == 0 || len(rest) != len(mvc) {
+		return ExtractFeatures(raw)
+	}
+
+	chs := Deinterleave(raw, len(mvc))
+	frames := len(chs[0])
+	if frames == 0 {
+		return make([]float64, 12)
+	}
+
+	x := make([]float64, frames*len(mvc))
+	noise := 0.0 // mean square of the rest levels, in MVC units
+	for ch, samples := range chs {
+		mean := 0.0
+		for _, v := range samples {
+			mean += float64(v)
+		}
+		mean /= float64(frames)
+
+		for i, v := range samples {
+			x[i*len(mvc)+ch] = (float64(v) - mean) / mvc[ch]
+		}
+
+		r := rest[ch] / mvc[ch]
+		noise += r * r
+	}
+	noise /= float64(len(mvc))
+
+	f := ExtractFeatures(x)
+	f[1] = math.Sqrt(math.Max(f[1]*f[1]-noise, 0))
+	f[3] = math.Max(f[3]-noise, 0)
+
+	return f
+}
+
+func ExtractFeatures[T Sample](raw []T) []float64 {
 	return []float64{
 		MAV(raw),
 		RMS(raw),
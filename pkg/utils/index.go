@@ -53,8 +53,27 @@ func DecodeRawBytes(b []byte) []int {
 
 	for i := 0; i < len(b); i += 2 {
 		val := binary.LittleEndian.Uint16(b[i : i+2])
-		out[i/2] = int(val)
+		out[i/2] = int(int16(val)) // stored as int16 by IntSliceToBytea
 	}
 
 	return out
 }
+
+// Deinterleave splits a packet that carries channels samples per frame (the
+// active channels in config order) into one slice per channel. An incomplete
+// last frame is dropped, channels < 1 is one channel.
+func Deinterleave(x []int, channels int) [][]int {
+	if channels < 1 {
+		channels = 1
+	}
+
+	frames := len(x) / channels
+	out := make([][]int, channels)
+	for ch := range out {
+		out[ch] = make([]int, frames)
+		for f := 0; f < frames; f++ {
+			out[ch][f] = x[f*channels+ch]
+		}
+	}
+	return out
+}